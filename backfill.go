@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// zkillboardMaxPastSeconds is the furthest back the zKillboard API can be asked for kills, a week
+const zkillboardMaxPastSeconds = 7 * 24 * 60 * 60
+
+// zkillboardBackfillModifiers maps the categories of tracked IDs to the zKillboard API modifier listing their kills,
+// IDs of other categories aren't backfilled
+var zkillboardBackfillModifiers = map[string]string{
+	"alliance":       "allianceID",
+	"corporation":    "corporationID",
+	"character":      "characterID",
+	"inventory_type": "shipTypeID",
+}
+
+// backfillPastSeconds converts the time since the feed went down into the pastSeconds the zKillboard API accepts, whole hours up to a week
+func backfillPastSeconds(gap time.Duration) int {
+	hours := int((gap + time.Hour - 1) / time.Hour)
+	if hours < 1 {
+		hours = 1
+	}
+
+	pastSeconds := hours * 60 * 60
+	if pastSeconds > zkillboardMaxPastSeconds {
+		pastSeconds = zkillboardMaxPastSeconds
+	}
+	return pastSeconds
+}
+
+// backfill delivers kills of every tracked ID since the given time, oldest first, stopping early if the context is cancelled.
+// Kills already sent are dropped by buildDeliveries' de-duplication.
+func (bot *ZKillBot) backfill(cContext context.Context, since time.Time) {
+	log := bot.log
+	pastSeconds := backfillPastSeconds(time.Since(since))
+
+	// Copy the tracked IDs so the lock isn't held during requests
+	bot.mux.Lock()
+	categories := make(map[int]string)
+	for eveID, subs := range bot.dataStorage.SubMap {
+		for _, subData := range subs {
+			categories[eveID] = subData.EveCategory
+			break
+		}
+	}
+	bot.mux.Unlock()
+
+	// Kills involving several tracked IDs are listed once per ID
+	kills := make(map[int]ZkbData)
+	for eveID, category := range categories {
+		if cContext.Err() != nil {
+			return
+		}
+		modifier, ok := zkillboardBackfillModifiers[category]
+		if !ok {
+			log.Debugf("Not backfilling kills of %v %v, unsupported category", category, eveID)
+			continue
+		}
+		found, err := bot.zkillboardAPIKills(fmt.Sprintf("%v/%v/pastSeconds/%v/", modifier, eveID, pastSeconds))
+		if err != nil {
+			log.Errorf("Failed to backfill kills of %v %v: %v", category, eveID, err)
+			continue
+		}
+		for _, kill := range found {
+			kills[kill.KillmailID] = kill.Zkb
+		}
+	}
+
+	// pastSeconds is rounded up to whole hours, the killmail time tells which kills were actually missed
+	var missed []*enrichedKill
+	for killID, zkb := range kills {
+		if cContext.Err() != nil {
+			return
+		}
+		enriched, err := bot.fetchKillmail(KillSummary{
+			KillID:     killID,
+			URL:        fmt.Sprintf("https://zkillboard.com/kill/%d/", killID),
+			Zkb:        zkb,
+			Backfilled: true,
+		})
+		if err != nil {
+			log.Errorf("Failed to fetch backfilled killmail %v: %v", killID, err)
+			continue
+		}
+		if enriched.Killmail.KillmailTime.Before(since) {
+			continue
+		}
+		missed = append(missed, enriched)
+	}
+	sortKillsByTime(missed)
+
+	log.Infof("Backfilling %v kills from %v tracked IDs", len(missed), len(categories))
+	for _, enriched := range missed {
+		// The killmail was already fetched to check its time
+		deliveries := bot.buildDeliveries(bot.matchKill(enriched.Summary, enriched))
+		if !bot.pool.Deliver(deliveries) {
+			// The kill was marked as seen when it was built, so it is backfilled again after a restart
+			for _, delivery := range deliveries {
+				bot.seen.Forget(delivery.KillID, delivery.ChannelID)
+			}
+			return
+		}
+	}
+}
+
+// sortKillsByTime sorts kills oldest first, by kill ID when the times are equal
+func sortKillsByTime(kills []*enrichedKill) {
+	sort.Slice(kills, func(i, j int) bool {
+		a, b := kills[i].Killmail.KillmailTime, kills[j].Killmail.KillmailTime
+		if a.Equal(b) {
+			return kills[i].Summary.KillID < kills[j].Summary.KillID
+		}
+		return a.Before(b)
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackfillPastSeconds(t *testing.T) {
+	tests := []struct {
+		gap         time.Duration
+		pastSeconds int
+	}{
+		{0, 3600},
+		{5 * time.Minute, 3600},
+		{time.Hour, 3600},
+		{time.Hour + time.Second, 7200},
+		{30 * 24 * time.Hour, zkillboardMaxPastSeconds},
+	}
+
+	for _, test := range tests {
+		if pastSeconds := backfillPastSeconds(test.gap); pastSeconds != test.pastSeconds {
+			t.Logf("Expected %v for gap %v, got %v", test.pastSeconds, test.gap, pastSeconds)
+			t.Fail()
+		}
+	}
+}
+
+func TestSortKillsByTime(t *testing.T) {
+	now := time.Now()
+	kill := func(killID int, killTime time.Time) *enrichedKill {
+		enriched := &enrichedKill{Summary: KillSummary{KillID: killID}}
+		enriched.Killmail.KillmailTime = killTime
+		return enriched
+	}
+
+	kills := []*enrichedKill{
+		kill(3, now),
+		kill(1, now.Add(-time.Minute)),
+		kill(4, now.Add(-time.Hour)),
+		kill(2, now.Add(-time.Minute)),
+	}
+	sortKillsByTime(kills)
+
+	for i, expected := range []int{4, 1, 2, 3} {
+		if kills[i].Summary.KillID != expected {
+			t.Logf("Expected kill %v at %v, got %v", expected, i, kills[i].Summary.KillID)
+			t.Fail()
+		}
+	}
+}
+
+func TestKillEmbedBackfilled(t *testing.T) {
+	kill := testEnrichedKill()
+	if embed := killEmbed(kill, false); embed.Footer != nil {
+		t.Logf("Live kills should have no footer, got %v", embed.Footer.Text)
+		t.Fail()
+	}
+
+	kill.Summary.Backfilled = true
+	if embed := killEmbed(kill, false); embed.Footer == nil {
+		t.Logf("Backfilled kills should be marked")
+		t.Fail()
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/sirupsen/logrus"
+)
+
+// commandQueueSize is how many messages a command holds while handling another, more are turned away as busy.
+// Commands mostly wait on ESI, a few queued covers several people using one at once without a long wait.
+const commandQueueSize = 10
+
+// Command is a chat command registered with the CommandRouter
+type Command struct {
+	// Name follows the prefix, e.g. track for !track
+	Name string
+	// Aliases are alternative names for the command
+	Aliases []string
+	// Args describes the arguments in help, e.g. <search>
+	Args string
+	// MinArgs is the number of space separated arguments required, fewer replies with the usage
+	MinArgs int
+	// Description is the single line summary shown by help
+	Description string
+	// Usage is the detailed help shown by help <command>, every line is prefixed with the command
+	Usage string
+	// Handler runs for every message invoking the command, one message at a time per command
+	Handler func(message discordCommand)
+
+	queue chan discordCommand
+}
+
+// CommandRouter dispatches discord messages to registered commands.
+//
+// Each command has its own queue and processing thread, started by Start.
+type CommandRouter struct {
+	mux      sync.RWMutex
+	commands []*Command
+	names    map[string]*Command
+
+	// Prefix used by guilds without their own
+	prefix        string
+	guildPrefixes map[string]string
+
+	log *logrus.Logger
+}
+
+// NewCommandRouter creates a router with the built in help command registered.
+// guildPrefixes maps discord guild IDs to a prefix replacing the default for that guild.
+func NewCommandRouter(prefix string, guildPrefixes map[string]string, log *logrus.Logger) *CommandRouter {
+	router := &CommandRouter{
+		names:         make(map[string]*Command),
+		prefix:        prefix,
+		guildPrefixes: guildPrefixes,
+		log:           log,
+	}
+
+	router.Register(&Command{
+		Name:        "help",
+		Aliases:     []string{"commands"},
+		Args:        "[command]",
+		Description: "List commands or show the usage of a command",
+		Handler:     router.help,
+	})
+
+	return router
+}
+
+// Register adds a command to the router, names and aliases must be unique
+func (router *CommandRouter) Register(command *Command) {
+	router.mux.Lock()
+	defer router.mux.Unlock()
+
+	for _, name := range append([]string{command.Name}, command.Aliases...) {
+		if _, ok := router.names[name]; ok {
+			// programming error, fail loudly at startup
+			panic(fmt.Sprintf("command %v registered twice", name))
+		}
+		router.names[name] = command
+	}
+
+	command.queue = make(chan discordCommand, commandQueueSize)
+	router.commands = append(router.commands, command)
+}
+
+// Start runs a processing thread per command until the context is cancelled, wg is done as each stops
+func (router *CommandRouter) Start(cContext context.Context, wg *sync.WaitGroup) {
+	router.mux.RLock()
+	defer router.mux.RUnlock()
+
+	for _, command := range router.commands {
+		wg.Add(1)
+		go func(command *Command) {
+			defer wg.Done()
+			router.run(cContext, command)
+		}(command)
+	}
+}
+
+// run processes a single command's queue
+func (router *CommandRouter) run(cContext context.Context, command *Command) {
+	log := router.log
+
+	log.Debugf("Starting %v command thread", command.Name)
+	for {
+		select {
+		// cancel cleanly
+		case <-cContext.Done():
+			log.Debugf("Exited %v command thread", command.Name)
+			return
+			// on message do work
+		case message := <-command.queue:
+			command.Handler(message)
+		}
+	}
+}
+
+// Prefix returns the command prefix used in the guild
+func (router *CommandRouter) Prefix(guildID string) string {
+	if prefix, ok := router.guildPrefixes[guildID]; ok && len(prefix) > 0 {
+		return prefix
+	}
+	return router.prefix
+}
+
+// Dispatch queues the message for its command, filling in the command, prefix and arguments.
+// It returns false if the message is not a known command.
+func (router *CommandRouter) Dispatch(message discordCommand) bool {
+	prefix := router.Prefix(message.GuildID)
+	if !strings.HasPrefix(message.Message, prefix) {
+		return false
+	}
+
+	// Split name from arguments
+	content := strings.TrimSpace(strings.TrimPrefix(message.Message, prefix))
+	fields := strings.Fields(content)
+	if len(fields) == 0 {
+		return false
+	}
+	name := strings.ToLower(fields[0])
+
+	message.Prefix = prefix
+	message.Command = name
+	message.Args = strings.TrimSpace(content[len(fields[0]):])
+
+	return router.Queue(message)
+}
+
+// Queue queues an already parsed message for its command, used for commands that do not arrive as text such as slash commands.
+// It returns false if the message is not a known command.
+// Queue never blocks, when the command's queue is full, or nothing drains it during shutdown, the author is asked to try again.
+func (router *CommandRouter) Queue(message discordCommand) bool {
+	router.mux.RLock()
+	command, ok := router.names[message.Command]
+	router.mux.RUnlock()
+	if !ok {
+		return false
+	}
+
+	// Aliases are resolved to the command's name
+	message.Command = command.Name
+
+	// Not enough arguments, reply with usage instead
+	if len(strings.Fields(message.Args)) < command.MinArgs {
+		message.ReplyError("Missing arguments, ```" + router.usage(message.Prefix, command.Name) + "```")
+		return true
+	}
+
+	select {
+	case command.queue <- message:
+	default:
+		router.log.Warnf("%v command queue is full, dropped command from user %v", command.Name, message.AuthorID)
+		message.ReplyError("Busy handling other " + message.Prefix + command.Name + " commands, try again in a moment")
+	}
+	return true
+}
+
+// usage returns the usage text of a command
+func (router *CommandRouter) usage(prefix string, name string) string {
+	router.mux.RLock()
+	command, ok := router.names[name]
+	router.mux.RUnlock()
+	if !ok {
+		return ""
+	}
+
+	// Default to the one line summary
+	if len(command.Usage) == 0 {
+		return fmt.Sprintf("%v%v %v - %v", prefix, command.Name, command.Args, command.Description)
+	}
+
+	var lines []string
+	for _, line := range strings.Split(command.Usage, "\n") {
+		lines = append(lines, prefix+command.Name+" "+line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// help is the handler of the built in help command
+func (router *CommandRouter) help(message discordCommand) {
+	// Usage of a single command
+	if len(message.Args) > 0 {
+		name := strings.ToLower(strings.TrimPrefix(message.Args, message.Prefix))
+		router.mux.RLock()
+		command, ok := router.names[name]
+		router.mux.RUnlock()
+		if !ok {
+			message.ReplyError(fmt.Sprintf("Unknown command %v, use %vhelp to list commands", name, message.Prefix))
+			return
+		}
+
+		text := router.usage(message.Prefix, command.Name)
+		if len(command.Aliases) > 0 {
+			text += "\n\nAliases: " + strings.Join(command.Aliases, ", ")
+		}
+		message.Reply("```" + text + "```")
+		return
+	}
+
+	// Every command
+	router.mux.RLock()
+	commands := make([]*Command, len(router.commands))
+	copy(commands, router.commands)
+	router.mux.RUnlock()
+	sort.Slice(commands, func(i, j int) bool {
+		return commands[i].Name < commands[j].Name
+	})
+
+	var lines []string
+	for _, command := range commands {
+		lines = append(lines, fmt.Sprintf("%-30v - %v", strings.TrimSpace(message.Prefix+command.Name+" "+command.Args), command.Description))
+	}
+	message.Reply("Valid commands: ```" + strings.Join(lines, "\n") + "```")
+}
+
+// commandResponder sends a command's replies back to where the command came from
+type commandResponder interface {
+	Reply(content string) error
+	ReplyEmbed(embed *discordgo.MessageEmbed) error
+	// ReplyError is only shown to the user who ran the command where discord allows it
+	ReplyError(content string) error
+}
+
+// channelResponder replies to text commands with regular messages in the channel, sent through the Outbox
+type channelResponder struct {
+	outbox    *Outbox
+	channelID string
+}
+
+// Reply queues a message to the channel
+func (responder *channelResponder) Reply(content string) error {
+	responder.outbox.Send(responder.channelID, outboundMessage{Content: content})
+	return nil
+}
+
+// ReplyEmbed queues an embed to the channel
+func (responder *channelResponder) ReplyEmbed(embed *discordgo.MessageEmbed) error {
+	responder.outbox.Send(responder.channelID, outboundMessage{Embeds: []*discordgo.MessageEmbed{embed}})
+	return nil
+}
+
+// ReplyError queues a message to the channel, text commands have no private replies
+func (responder *channelResponder) ReplyError(content string) error {
+	return responder.Reply(content)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// fakeResponder records every reply sent for a command
+type fakeResponder struct {
+	replies []string
+	embeds  []*discordgo.MessageEmbed
+	errors  []string
+}
+
+func (responder *fakeResponder) Reply(content string) error {
+	responder.replies = append(responder.replies, content)
+	return nil
+}
+
+func (responder *fakeResponder) ReplyEmbed(embed *discordgo.MessageEmbed) error {
+	responder.embeds = append(responder.embeds, embed)
+	return nil
+}
+
+func (responder *fakeResponder) ReplyError(content string) error {
+	responder.errors = append(responder.errors, content)
+	return nil
+}
+
+// testRouter returns a router with a single echo command and the channel its handler writes to
+func testRouter(guildPrefixes map[string]string) (*CommandRouter, chan discordCommand) {
+	received := make(chan discordCommand, 5)
+
+	router := NewCommandRouter("!", guildPrefixes, log.StandardLogger())
+	router.Register(&Command{
+		Name:        "echo",
+		Aliases:     []string{"say"},
+		Args:        "<text>",
+		MinArgs:     1,
+		Description: "Repeat text",
+		Usage:       "<text> - Repeat text",
+		Handler: func(message discordCommand) {
+			received <- message
+		},
+	})
+
+	return router, received
+}
+
+func TestCommandRouter_Dispatch(t *testing.T) {
+	router, received := testRouter(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	router.Start(ctx, &sync.WaitGroup{})
+
+	// Alias with arguments
+	if !router.Dispatch(discordCommand{ChannelID: "chan-a", Message: "!say hello world"}) {
+		t.Logf("Alias should be dispatched")
+		t.FailNow()
+	}
+
+	select {
+	case message := <-received:
+		if message.Command != "echo" || message.Args != "hello world" || message.Prefix != "!" {
+			t.Logf("Unexpected command parsing: %+v", message)
+			t.Fail()
+		}
+	case <-time.After(time.Second):
+		t.Logf("Handler was not run")
+		t.Fail()
+	}
+
+	// Not commands
+	for _, content := range []string{"hello", "!unknown", "!", "?echo hi"} {
+		if router.Dispatch(discordCommand{ChannelID: "chan-a", Message: content}) {
+			t.Logf("%v should not be dispatched", content)
+			t.Fail()
+		}
+	}
+}
+
+func TestCommandRouter_DispatchMissingArgs(t *testing.T) {
+	router, received := testRouter(nil)
+	responder := &fakeResponder{}
+
+	router.Dispatch(discordCommand{ChannelID: "chan-a", Message: "!echo", commandResponder: responder})
+
+	if len(received) != 0 || len(router.names["echo"].queue) != 0 {
+		t.Logf("Handler should not be queued without its arguments")
+		t.Fail()
+	}
+	if len(responder.errors) != 1 || !strings.Contains(responder.errors[0], "!echo <text> - Repeat text") {
+		t.Logf("Expected usage reply, but got %v", responder.errors)
+		t.Fail()
+	}
+}
+
+func TestCommandRouter_Queue(t *testing.T) {
+	router, _ := testRouter(nil)
+
+	// Pre-parsed commands skip the prefix, aliases still resolve
+	if !router.Queue(discordCommand{Prefix: "/", Command: "say", Args: "hi"}) {
+		t.Logf("Alias should be queued")
+		t.Fail()
+	}
+	if router.Queue(discordCommand{Prefix: "/", Command: "unknown", Args: "hi"}) {
+		t.Logf("Unknown command should not be queued")
+		t.Fail()
+	}
+
+	message := <-router.names["echo"].queue
+	if message.Command != "echo" {
+		t.Logf("Alias should be resolved to the command name, but was %v", message.Command)
+		t.Fail()
+	}
+}
+
+func TestCommandRouter_QueueFull(t *testing.T) {
+	router, _ := testRouter(nil)
+	responder := &fakeResponder{}
+
+	// Nothing is started to drain the queue, as during shutdown
+	done := make(chan bool)
+	go func() {
+		for i := 0; i <= cap(router.names["echo"].queue); i++ {
+			router.Queue(discordCommand{Prefix: "!", Command: "echo", Args: "hi", commandResponder: responder})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Queue blocked on a full queue")
+	}
+	if len(responder.errors) != 1 || !strings.Contains(responder.errors[0], "try again") {
+		t.Logf("Expected a busy reply for the command over capacity, got %v", responder.errors)
+		t.Fail()
+	}
+}
+
+func TestCommandRouter_GuildPrefix(t *testing.T) {
+	router, _ := testRouter(map[string]string{"guild-a": "?"})
+
+	if router.Dispatch(discordCommand{GuildID: "guild-a", Message: "!echo hi"}) {
+		t.Logf("Default prefix should not be used in a guild with its own")
+		t.Fail()
+	}
+	if !router.Dispatch(discordCommand{GuildID: "guild-a", Message: "?echo hi"}) {
+		t.Logf("Guild prefix should be dispatched")
+		t.Fail()
+	}
+	if !router.Dispatch(discordCommand{GuildID: "guild-b", Message: "!echo hi"}) {
+		t.Logf("Default prefix should be used in other guilds")
+		t.Fail()
+	}
+	// Router has not been started so messages stay queued
+	if len(router.names["echo"].queue) != 2 {
+		t.Logf("Expected 2 queued messages, but got %v", len(router.names["echo"].queue))
+		t.Fail()
+	}
+}
+
+func TestCommandRouter_Help(t *testing.T) {
+	router, _ := testRouter(map[string]string{"guild-a": "?"})
+	responder := &fakeResponder{}
+
+	router.help(discordCommand{GuildID: "guild-a", Prefix: "?", commandResponder: responder})
+	if len(responder.replies) != 1 || !strings.Contains(responder.replies[0], "?echo <text>") || !strings.Contains(responder.replies[0], "?help [command]") {
+		t.Logf("Help should list every command with the guild's prefix, got %v", responder.replies)
+		t.Fail()
+	}
+
+	router.help(discordCommand{Prefix: "!", Args: "say", commandResponder: responder})
+	if len(responder.replies) != 2 || !strings.Contains(responder.replies[1], "!echo <text> - Repeat text") || !strings.Contains(responder.replies[1], "Aliases: say") {
+		t.Logf("Help for an alias should show the command's usage, got %v", responder.replies)
+		t.Fail()
+	}
+}
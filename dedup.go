@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// seenKill is a kill delivered to a discord channel
+type seenKill struct {
+	KillID    int       `json:"kill_id"`
+	ChannelID string    `json:"channel_id"`
+	Seen      time.Time `json:"seen"`
+}
+
+// seenKey identifies a seenKill
+type seenKey struct {
+	KillID    int
+	ChannelID string
+}
+
+// KillDeduper remembers which kills were recently sent to which channels, so reconnects and overlapping feeds don't post a kill twice
+//
+// Kills are forgotten once older than the window, or oldest first once more than max are remembered.
+// The seen kills can be saved to disk so a restart does not repost them.
+type KillDeduper struct {
+	mux  sync.Mutex
+	seen map[seenKey]time.Time
+	// Oldest first, for expiring
+	order []seenKill
+
+	window time.Duration
+	max    int
+	path   string
+
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// NewKillDeduper creates a KillDeduper, loading any kills previously saved at path.
+// An empty path disables saving.
+func NewKillDeduper(window time.Duration, max int, path string) (*KillDeduper, error) {
+	deduper := &KillDeduper{
+		seen:   make(map[seenKey]time.Time),
+		window: window,
+		max:    max,
+		path:   path,
+		now:    time.Now,
+	}
+
+	return deduper, deduper.load()
+}
+
+// Deliver marks a kill as sent to a channel, returning false if it already was within the window.
+// The kill is marked before it is sent so a copy arriving meanwhile is dropped, Forget it if sending fails.
+func (deduper *KillDeduper) Deliver(killID int, channelID string) bool {
+	deduper.mux.Lock()
+	defer deduper.mux.Unlock()
+
+	now := deduper.now()
+	deduper.expire(now)
+
+	key := seenKey{KillID: killID, ChannelID: channelID}
+	if _, ok := deduper.seen[key]; ok {
+		return false
+	}
+
+	deduper.seen[key] = now
+	deduper.order = append(deduper.order, seenKill{KillID: killID, ChannelID: channelID, Seen: now})
+	deduper.expire(now)
+	return true
+}
+
+// Forget unmarks a kill as sent to a channel, for deliveries that failed so the kill may be sent again
+func (deduper *KillDeduper) Forget(killID int, channelID string) {
+	deduper.mux.Lock()
+	defer deduper.mux.Unlock()
+
+	key := seenKey{KillID: killID, ChannelID: channelID}
+	if _, ok := deduper.seen[key]; !ok {
+		return
+	}
+
+	delete(deduper.seen, key)
+	for i, kill := range deduper.order {
+		if kill.KillID == killID && kill.ChannelID == channelID {
+			deduper.order = append(deduper.order[:i:i], deduper.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// Len returns the number of kills remembered
+func (deduper *KillDeduper) Len() int {
+	deduper.mux.Lock()
+	defer deduper.mux.Unlock()
+
+	return len(deduper.seen)
+}
+
+// expire forgets kills older than the window or over max, callers must hold mux
+func (deduper *KillDeduper) expire(now time.Time) {
+	drop := 0
+	for drop < len(deduper.order) {
+		oldest := deduper.order[drop]
+		if len(deduper.order)-drop <= deduper.max && now.Sub(oldest.Seen) < deduper.window {
+			break
+		}
+		delete(deduper.seen, seenKey{KillID: oldest.KillID, ChannelID: oldest.ChannelID})
+		drop++
+	}
+
+	if drop > 0 {
+		deduper.order = append([]seenKill(nil), deduper.order[drop:]...)
+	}
+}
+
+// load reads the kills saved at path
+func (deduper *KillDeduper) load() error {
+	if len(deduper.path) == 0 {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(deduper.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var kills []seenKill
+	err = json.Unmarshal(data, &kills)
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(kills, func(i, j int) bool {
+		return kills[i].Seen.Before(kills[j].Seen)
+	})
+
+	deduper.mux.Lock()
+	defer deduper.mux.Unlock()
+
+	for _, kill := range kills {
+		deduper.seen[seenKey{KillID: kill.KillID, ChannelID: kill.ChannelID}] = kill.Seen
+	}
+	deduper.order = kills
+	deduper.expire(deduper.now())
+	return nil
+}
+
+// Save writes the kills still within the window to disk
+func (deduper *KillDeduper) Save() error {
+	if len(deduper.path) == 0 {
+		return nil
+	}
+
+	deduper.mux.Lock()
+	deduper.expire(deduper.now())
+	data, err := json.Marshal(deduper.order)
+	deduper.mux.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(deduper.path, data)
+}
+
+// saveSeenEvery periodically saves the seen kills until the context is cancelled
+func (bot *ZKillBot) saveSeenEvery(cContext context.Context, interval time.Duration) {
+	log := bot.log
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cContext.Done():
+			log.Debugf("Exited saveSeenEvery thread")
+			return
+		case <-ticker.C:
+			err := bot.seen.Save()
+			if err != nil {
+				log.Errorf("Failed to save seen kills: %v", err)
+				break
+			}
+			log.Debugf("Saved %v seen kills", bot.seen.Len())
+		}
+	}
+}
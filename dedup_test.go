@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKillDeduper_Deliver(t *testing.T) {
+	deduper, _ := NewKillDeduper(time.Hour, 100, "")
+	now := time.Now()
+	deduper.now = func() time.Time { return now }
+
+	if !deduper.Deliver(1, "chan-a") {
+		t.Logf("Expected first delivery to be allowed")
+		t.Fail()
+	}
+	if deduper.Deliver(1, "chan-a") {
+		t.Logf("Expected repeat delivery to be dropped")
+		t.Fail()
+	}
+	if !deduper.Deliver(1, "chan-b") {
+		t.Logf("Expected delivery to another channel to be allowed")
+		t.Fail()
+	}
+
+	// Forgotten after the window
+	now = now.Add(time.Hour)
+	if !deduper.Deliver(1, "chan-a") {
+		t.Logf("Expected delivery after the window to be allowed")
+		t.Fail()
+	}
+	if deduper.Len() != 1 {
+		t.Logf("Expected 1 remembered kill, got %v", deduper.Len())
+		t.Fail()
+	}
+
+	// Forgotten after failing to send
+	deduper.Forget(1, "chan-a")
+	if deduper.Len() != 0 || !deduper.Deliver(1, "chan-a") {
+		t.Logf("Expected a forgotten kill to be delivered again")
+		t.Fail()
+	}
+}
+
+func TestKillDeduper_Max(t *testing.T) {
+	deduper, _ := NewKillDeduper(time.Hour, 2, "")
+
+	deduper.Deliver(1, "chan-a")
+	deduper.Deliver(2, "chan-a")
+	deduper.Deliver(3, "chan-a")
+
+	if deduper.Len() != 2 {
+		t.Logf("Expected 2 remembered kills, got %v", deduper.Len())
+		t.Fail()
+	}
+	// The oldest is forgotten first
+	if !deduper.Deliver(1, "chan-a") || deduper.Deliver(3, "chan-a") {
+		t.Logf("Expected kill 1 to be forgotten and 3 remembered")
+		t.Fail()
+	}
+}
+
+func TestKillDeduper_SaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zkillbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "seen.json")
+
+	deduper, err := NewKillDeduper(time.Hour, 100, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deduper.Deliver(1, "chan-a")
+	deduper.Deliver(2, "chan-b")
+	err = deduper.Save()
+	if err != nil {
+		t.Logf("Save failed: %v", err)
+		t.Fail()
+	}
+
+	loaded, err := NewKillDeduper(time.Hour, 100, path)
+	if err != nil {
+		t.Logf("Load failed: %v", err)
+		t.Fail()
+	}
+	if loaded.Deliver(1, "chan-a") || loaded.Deliver(2, "chan-b") {
+		t.Logf("Expected saved kills to be remembered after loading")
+		t.Fail()
+	}
+	if !loaded.Deliver(2, "chan-a") {
+		t.Logf("Expected unsent kill to be allowed after loading")
+		t.Fail()
+	}
+}
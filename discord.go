@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+// discordDisallowedIntents is the gateway close code for intents the bot isn't allowed in the developer portal
+const discordDisallowedIntents = 4014
+
+// DiscordSender is the part of the discord API the bot calls, a *discordgo.Session outside of tests.
+//
+// Incoming events still arrive through the session's handlers, only outgoing requests go through the DiscordSender.
+type DiscordSender interface {
+	// Channel messages
+	ChannelMessageSendComplex(channelID string, data *discordgo.MessageSend, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	UserChannelPermissions(userID string, channelID string, fetchOptions ...discordgo.RequestOption) (int64, error)
+
+	// Slash commands
+	ApplicationCommandBulkOverwrite(appID string, guildID string, commands []*discordgo.ApplicationCommand, options ...discordgo.RequestOption) ([]*discordgo.ApplicationCommand, error)
+	InteractionRespond(interaction *discordgo.Interaction, resp *discordgo.InteractionResponse, options ...discordgo.RequestOption) error
+	InteractionResponseEdit(interaction *discordgo.Interaction, newresp *discordgo.WebhookEdit, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	InteractionResponseDelete(interaction *discordgo.Interaction, options ...discordgo.RequestOption) error
+	FollowupMessageCreate(interaction *discordgo.Interaction, wait bool, data *discordgo.WebhookParams, options ...discordgo.RequestOption) (*discordgo.Message, error)
+}
+
+// newDiscordSession creates a session for the bot token.
+//
+// Text commands need the privileged message content intent, without it discord sends guild messages with empty content.
+func newDiscordSession(token string) (*discordgo.Session, error) {
+	discord, err := discordgo.New("Bot " + token)
+	if err != nil {
+		return nil, err
+	}
+	discord.Identify.Intents = discordgo.IntentsAllWithoutPrivileged | discordgo.IntentsMessageContent
+
+	return discord, nil
+}
+
+// openDiscordSession opens the session's websocket.
+// When the message content intent isn't allowed for the bot it connects without it, leaving only slash commands working.
+func openDiscordSession(discord *discordgo.Session, log *logrus.Logger) error {
+	err := discord.Open()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != discordDisallowedIntents {
+		return err
+	}
+
+	log.Warn("Discord refused the message content intent, text commands are disabled until it's switched on in the developer portal")
+	discord.Close()
+	discord.Identify.Intents = discordgo.IntentsAllWithoutPrivileged
+	return discord.Open()
+}
+
+// Make sure the session keeps satisfying the interface
+var _ DiscordSender = (*discordgo.Session)(nil)
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// fakeDiscordMessage is a message sent to a channel through the fakeDiscord
+type fakeDiscordMessage struct {
+	ChannelID string
+	*discordgo.MessageSend
+}
+
+// fakeDiscord is a DiscordSender recording every request, channel messages are also sent on sent
+type fakeDiscord struct {
+	mux       sync.Mutex
+	messages  []fakeDiscordMessage
+	responses []*discordgo.InteractionResponse
+	edits     []*discordgo.WebhookEdit
+	deletes   int
+	followups []*discordgo.WebhookParams
+	commands  []*discordgo.ApplicationCommand
+
+	// Permissions every user has in every channel
+	permissions int64
+
+	sent chan fakeDiscordMessage
+}
+
+func newFakeDiscord() *fakeDiscord {
+	return &fakeDiscord{
+		sent: make(chan fakeDiscordMessage, 100),
+	}
+}
+
+func (discord *fakeDiscord) ChannelMessageSendComplex(channelID string, data *discordgo.MessageSend, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	discord.mux.Lock()
+	defer discord.mux.Unlock()
+
+	message := fakeDiscordMessage{ChannelID: channelID, MessageSend: data}
+	discord.messages = append(discord.messages, message)
+	discord.sent <- message
+	return &discordgo.Message{ChannelID: channelID, Content: data.Content, Embeds: data.Embeds}, nil
+}
+
+func (discord *fakeDiscord) UserChannelPermissions(userID string, channelID string, fetchOptions ...discordgo.RequestOption) (int64, error) {
+	discord.mux.Lock()
+	defer discord.mux.Unlock()
+
+	return discord.permissions, nil
+}
+
+func (discord *fakeDiscord) ApplicationCommandBulkOverwrite(appID string, guildID string, commands []*discordgo.ApplicationCommand, options ...discordgo.RequestOption) ([]*discordgo.ApplicationCommand, error) {
+	discord.mux.Lock()
+	defer discord.mux.Unlock()
+
+	discord.commands = commands
+	return commands, nil
+}
+
+func (discord *fakeDiscord) InteractionRespond(interaction *discordgo.Interaction, resp *discordgo.InteractionResponse, options ...discordgo.RequestOption) error {
+	discord.mux.Lock()
+	defer discord.mux.Unlock()
+
+	discord.responses = append(discord.responses, resp)
+	return nil
+}
+
+func (discord *fakeDiscord) InteractionResponseEdit(interaction *discordgo.Interaction, newresp *discordgo.WebhookEdit, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	discord.mux.Lock()
+	defer discord.mux.Unlock()
+
+	discord.edits = append(discord.edits, newresp)
+	return &discordgo.Message{}, nil
+}
+
+func (discord *fakeDiscord) InteractionResponseDelete(interaction *discordgo.Interaction, options ...discordgo.RequestOption) error {
+	discord.mux.Lock()
+	defer discord.mux.Unlock()
+
+	discord.deletes++
+	return nil
+}
+
+func (discord *fakeDiscord) FollowupMessageCreate(interaction *discordgo.Interaction, wait bool, data *discordgo.WebhookParams, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	discord.mux.Lock()
+	defer discord.mux.Unlock()
+
+	discord.followups = append(discord.followups, data)
+	return &discordgo.Message{}, nil
+}
+
+// testSession returns a discord session that was never opened, with only the bot's user in its state
+func testSession(botID string) *discordgo.Session {
+	state := discordgo.NewState()
+	state.User = &discordgo.User{ID: botID}
+	return &discordgo.Session{State: state}
+}
+
+// next waits for the next channel message
+func (discord *fakeDiscord) next(t *testing.T) fakeDiscordMessage {
+	select {
+	case message := <-discord.sent:
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for a discord message")
+	}
+	return fakeDiscordMessage{}
+}
+
+// channelMessages returns the content of every message sent to a channel, embeds by title
+func (discord *fakeDiscord) channelMessages(channelID string) []string {
+	discord.mux.Lock()
+	defer discord.mux.Unlock()
+
+	var messages []string
+	for _, message := range discord.messages {
+		if message.ChannelID != channelID {
+			continue
+		}
+		if len(message.Content) > 0 {
+			messages = append(messages, message.Content)
+		}
+		for _, embed := range message.Embeds {
+			messages = append(messages, embed.Title)
+		}
+	}
+	return messages
+}
+
+func TestNewDiscordSession(t *testing.T) {
+	discord, err := newDiscordSession("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Text commands only get message content with the privileged intent
+	for _, intent := range []discordgo.Intent{discordgo.IntentsGuildMessages, discordgo.IntentsMessageContent} {
+		if discord.Identify.Intents&intent != intent {
+			t.Logf("Expected the session to ask for intent %v, got intents %v", intent, discord.Identify.Intents)
+			t.Fail()
+		}
+	}
+}
+
+// fakeGateway is a discord gateway closing connections that ask for the message content intent with code 4014,
+// as discord does when the intent isn't switched on in the developer portal.
+// It records the intents of every identify, and signals heartbeat on the first heartbeat of a connection it accepted.
+func fakeGateway(t *testing.T) (server *httptest.Server, identified chan discordgo.Intent, heartbeat chan struct{}) {
+	identified = make(chan discordgo.Intent, 10)
+	heartbeat = make(chan struct{}, 10)
+	upgrader := websocket.Upgrader{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/gateway", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"url":"ws%v/ws"}`, strings.TrimPrefix(server.URL, "http"))
+	})
+	mux.HandleFunc("/ws/", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Logf("Upgrade failed: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"op":10,"d":{"heartbeat_interval":45000}}`))
+		var identify struct {
+			Data struct {
+				Intents discordgo.Intent `json:"intents"`
+			} `json:"d"`
+		}
+		if err := conn.ReadJSON(&identify); err != nil {
+			return
+		}
+		identified <- identify.Data.Intents
+
+		if identify.Data.Intents&discordgo.IntentsMessageContent != 0 {
+			message := websocket.FormatCloseMessage(discordDisallowedIntents, "Disallowed intent(s).")
+			conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+			return
+		}
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"op":0,"t":"READY","s":1,"d":{"session_id":"session","user":{"id":"bot"}}}`))
+
+		// Stay connected until the session closes
+		for beats := 0; ; beats++ {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+			if beats == 0 {
+				heartbeat <- struct{}{}
+			}
+		}
+	})
+	server = httptest.NewServer(mux)
+
+	return server, identified, heartbeat
+}
+
+func TestOpenDiscordSession_disallowedIntents(t *testing.T) {
+	server, identified, heartbeat := fakeGateway(t)
+	defer server.Close()
+	endpoint := discordgo.EndpointGateway
+	discordgo.EndpointGateway = server.URL + "/gateway"
+	defer func() { discordgo.EndpointGateway = endpoint }()
+
+	discord, err := newDiscordSession("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	discord.ShouldReconnectOnError = false
+
+	// Refused with the message content intent, connected again without it
+	err = openDiscordSession(discord, log.StandardLogger())
+	if err != nil {
+		t.Fatalf("Expected the session to open without the message content intent, got %v", err)
+	}
+	defer discord.Close()
+
+	for _, expected := range []discordgo.Intent{discordgo.IntentsAllWithoutPrivileged | discordgo.IntentsMessageContent, discordgo.IntentsAllWithoutPrivileged} {
+		select {
+		case intents := <-identified:
+			if intents != expected {
+				t.Logf("Expected to identify with intents %v, got %v", expected, intents)
+				t.Fail()
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for identify with intents %v", expected)
+		}
+	}
+
+	// Closing races the session's first heartbeat otherwise
+	select {
+	case <-heartbeat:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for a heartbeat")
+	}
+}
+
+func TestZKillBot_discordInteraction(t *testing.T) {
+	discord := newFakeDiscord()
+	bot := testBot()
+	bot.discord = testSession("bot")
+	bot.sender = discord
+	bot.kills = newFakeKillSource()
+	bot.commands = NewCommandRouter("!", nil, log.StandardLogger())
+	bot.registerCommands()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	bot.commands.Start(ctx, &bot.wg)
+
+	bot.registerSlashCommands()
+	if len(discord.commands) != len(slashCommands) {
+		t.Logf("Expected %v slash commands registered, got %v", len(slashCommands), len(discord.commands))
+		t.Fail()
+	}
+
+	// /status is acknowledged then answered by editing the deferred response
+	bot.discordInteraction(bot.discord, &discordgo.InteractionCreate{Interaction: &discordgo.Interaction{
+		Type:      discordgo.InteractionApplicationCommand,
+		ChannelID: "chan-a",
+		Data:      discordgo.ApplicationCommandInteractionData{Name: "status"},
+		User:      &discordgo.User{ID: "user"},
+	}})
+
+	// /track remove without permission is answered privately, guild members only have the permissions discord resolved
+	bot.discordInteraction(bot.discord, &discordgo.InteractionCreate{Interaction: &discordgo.Interaction{
+		Type:      discordgo.InteractionApplicationCommand,
+		GuildID:   "guild",
+		ChannelID: "chan-a",
+		Data: discordgo.ApplicationCommandInteractionData{Name: "track", Options: []*discordgo.ApplicationCommandInteractionDataOption{
+			{Name: "remove", Type: discordgo.ApplicationCommandOptionSubCommand},
+		}},
+		Member: &discordgo.Member{User: &discordgo.User{ID: "user"}},
+	}})
+
+	// Commands still queued when the context is cancelled are dropped, wait for both replies
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		discord.mux.Lock()
+		replies := len(discord.edits) + len(discord.followups)
+		discord.mux.Unlock()
+		if replies == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	bot.Shutdown(5 * time.Second)
+
+	if len(discord.responses) != 2 || discord.responses[0].Type != discordgo.InteractionResponseDeferredChannelMessageWithSource {
+		t.Logf("Expected both commands to be acknowledged, got %+v", discord.responses)
+		t.Fail()
+	}
+	if len(discord.edits) != 1 || discord.edits[0].Content == nil || !strings.Contains(*discord.edits[0].Content, "Kill feed:") {
+		t.Logf("Expected the status in the deferred response, got %+v", discord.edits)
+		t.Fail()
+	}
+	if discord.deletes != 1 || len(discord.followups) != 1 || discord.followups[0].Flags != discordgo.MessageFlagsEphemeral {
+		t.Logf("Expected the denied track to be replied to privately, got %v deletes and %+v", discord.deletes, discord.followups)
+		t.Fail()
+	}
+}
@@ -0,0 +1,774 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// A filter expression is set with !track <eve_id> --filter <expression>, for example
+//
+//	value > 1b && region == "Delve" && !npc && attackers <= 5
+//
+// Expressions combine comparisons of a kill's fields with && (and), || (or), ! (not) and parentheses.
+// Numbers compare with ==, !=, <, <=, > and >=, may be negative, and may end in k, m, b or t for thousands, millions, billions or trillions.
+// Names are quoted, compare with == and != ignoring case, and are looked up once when the filter is added.
+// Boolean fields are used on their own or compared to true or false.
+//
+// Expressions are only ever interpreted against filterFields, they can't call anything.
+// Fields not known for a kill are unknown rather than false: a known false side decides &&, a known true side decides ||,
+// and only when the whole expression is unknown does the filter pass, like every other filter.
+// The value is the exception, comparing an unknown value is false so a failing zKillboard lookup can't flood channels,
+// the same as a minimum value.
+
+// filterMaxLength is the longest filter expression accepted
+const filterMaxLength = 500
+
+// Kinds of filter fields, deciding what they compare to
+const (
+	fieldNumber = "number"
+	fieldBool   = "true or false"
+	fieldName   = "name"
+	fieldSpace  = "space"
+)
+
+// filterValue is the value of a field for a kill or of a literal, which member is used depends on the field's kind
+type filterValue struct {
+	Number float64
+	Bool   bool
+	// Name fields are IDs, literals may match several IDs
+	ID  int32
+	IDs []int32
+	// Security space band
+	Space string
+}
+
+// filterField is a field filter expressions can use
+type filterField struct {
+	Kind        string
+	Description string
+
+	// Lookup is the kind of name looked up through ESI for name fields, ship groups are known without
+	Lookup string
+	// What killFacts has to look up for the field
+	NeedsLocation bool
+	NeedsGroups   bool
+	// UnknownFails makes comparisons of the field false when it isn't known, rather than unknown
+	UnknownFails bool
+
+	// value returns the field's value for the kill, false if it isn't known
+	value func(facts *killFacts) (filterValue, bool)
+}
+
+// filterFields are the fields filter expressions can use, keep the table in the README in step
+var filterFields = map[string]*filterField{
+	"value": {
+		Kind:         fieldNumber,
+		Description:  "total isk value of the kill",
+		UnknownFails: true,
+		value: func(facts *killFacts) (filterValue, bool) {
+			return filterValue{Number: facts.Value}, facts.Value != 0
+		},
+	},
+	"attackers": {
+		Kind:        fieldNumber,
+		Description: "number of attackers",
+		value: func(facts *killFacts) (filterValue, bool) {
+			return filterValue{Number: float64(facts.Attackers)}, facts.Killmail
+		},
+	},
+	"security": {
+		Kind:          fieldNumber,
+		Description:   "security status of the solar system",
+		NeedsLocation: true,
+		value: func(facts *killFacts) (filterValue, bool) {
+			return filterValue{Number: float64(facts.Security)}, len(facts.Space) > 0
+		},
+	},
+	"npc": {
+		Kind:        fieldBool,
+		Description: "only NPCs were involved",
+		// zKillboard's flag, or worked out from the attackers of the killmail
+		value: func(facts *killFacts) (filterValue, bool) {
+			return filterValue{Bool: facts.NPC}, facts.Zkb || facts.Killmail
+		},
+	},
+	"solo": {
+		Kind:        fieldBool,
+		Description: "zKillboard counts the kill as solo",
+		value: func(facts *killFacts) (filterValue, bool) {
+			return filterValue{Bool: facts.Solo}, facts.Zkb
+		},
+	},
+	"awox": {
+		Kind:        fieldBool,
+		Description: "the victim was killed by their own corporation or alliance",
+		value: func(facts *killFacts) (filterValue, bool) {
+			return filterValue{Bool: facts.Awox}, facts.Zkb
+		},
+	},
+	"space": {
+		Kind:          fieldSpace,
+		Description:   "highsec, lowsec, nullsec, wormhole, pochven or abyssal",
+		NeedsLocation: true,
+		value: func(facts *killFacts) (filterValue, bool) {
+			return filterValue{Space: facts.Space}, len(facts.Space) > 0
+		},
+	},
+	"region": {
+		Kind:          fieldName,
+		Description:   "region name or ID",
+		Lookup:        locationRegion,
+		NeedsLocation: true,
+		value: func(facts *killFacts) (filterValue, bool) {
+			return filterValue{ID: facts.RegionID}, facts.RegionID != 0
+		},
+	},
+	"constellation": {
+		Kind:          fieldName,
+		Description:   "constellation name or ID",
+		Lookup:        locationConstellation,
+		NeedsLocation: true,
+		value: func(facts *killFacts) (filterValue, bool) {
+			return filterValue{ID: facts.ConstellationID}, facts.ConstellationID != 0
+		},
+	},
+	"system": {
+		Kind:        fieldName,
+		Description: "solar system name or ID",
+		Lookup:      locationSystem,
+		value: func(facts *killFacts) (filterValue, bool) {
+			return filterValue{ID: facts.SolarSystemID}, facts.SolarSystemID != 0
+		},
+	},
+	"ship": {
+		Kind:        fieldName,
+		Description: "victim's ship type name or ID",
+		Lookup:      "ship",
+		value: func(facts *killFacts) (filterValue, bool) {
+			return filterValue{ID: facts.VictimShip}, facts.VictimShip != 0
+		},
+	},
+	"ship_group": {
+		Kind:        fieldName,
+		Description: "victim's ship group, the same names as --ships, e.g. capital or frigate",
+		NeedsGroups: true,
+		value: func(facts *killFacts) (filterValue, bool) {
+			group, ok := facts.ShipGroups[facts.VictimShip]
+			return filterValue{ID: group}, ok
+		},
+	},
+}
+
+// filterFieldNames returns the names of filterFields in order
+func filterFieldNames() []string {
+	var names []string
+	for name := range filterFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// filterResult is the result of evaluating an expression, three valued as fields may not be known for a kill
+type filterResult int
+
+const (
+	filterFalse filterResult = iota
+	filterTrue
+	// filterUnknown depends on a field not known for the kill
+	filterUnknown
+)
+
+// filterBool returns the filterResult of a known comparison
+func filterBool(result bool) filterResult {
+	if result {
+		return filterTrue
+	}
+	return filterFalse
+}
+
+// filterNode is a node of a compiled filter expression
+type filterNode interface {
+	eval(facts *killFacts) filterResult
+}
+
+// filterAnd is false if either side is known to be false, whichever order they are in
+type filterAnd struct{ left, right filterNode }
+
+func (node *filterAnd) eval(facts *killFacts) filterResult {
+	left := node.left.eval(facts)
+	if left == filterFalse {
+		return filterFalse
+	}
+	right := node.right.eval(facts)
+	if right == filterFalse {
+		return filterFalse
+	}
+	if left == filterUnknown || right == filterUnknown {
+		return filterUnknown
+	}
+	return filterTrue
+}
+
+// filterOr is true if either side is known to be true, whichever order they are in
+type filterOr struct{ left, right filterNode }
+
+func (node *filterOr) eval(facts *killFacts) filterResult {
+	left := node.left.eval(facts)
+	if left == filterTrue {
+		return filterTrue
+	}
+	right := node.right.eval(facts)
+	if right == filterTrue {
+		return filterTrue
+	}
+	if left == filterUnknown || right == filterUnknown {
+		return filterUnknown
+	}
+	return filterFalse
+}
+
+// filterNot negates a known result, unknown stays unknown
+type filterNot struct{ node filterNode }
+
+func (node *filterNot) eval(facts *killFacts) filterResult {
+	switch node.node.eval(facts) {
+	case filterTrue:
+		return filterFalse
+	case filterFalse:
+		return filterTrue
+	}
+	return filterUnknown
+}
+
+// filterCompare compares a field to a literal, a boolean field on its own compares == true
+type filterCompare struct {
+	name  string
+	field *filterField
+	op    string
+	value filterValue
+
+	// Name looked up through ESI for the literal, the IDs are set once it is
+	lookup string
+}
+
+func (node *filterCompare) eval(facts *killFacts) filterResult {
+	value, ok := node.field.value(facts)
+	if !ok && node.field.UnknownFails {
+		return filterFalse
+	}
+	if !ok {
+		return filterUnknown
+	}
+
+	switch node.field.Kind {
+	case fieldNumber:
+		switch node.op {
+		case "==":
+			return filterBool(value.Number == node.value.Number)
+		case "!=":
+			return filterBool(value.Number != node.value.Number)
+		case "<":
+			return filterBool(value.Number < node.value.Number)
+		case "<=":
+			return filterBool(value.Number <= node.value.Number)
+		case ">":
+			return filterBool(value.Number > node.value.Number)
+		case ">=":
+			return filterBool(value.Number >= node.value.Number)
+		}
+	case fieldBool:
+		return filterBool((value.Bool == node.value.Bool) == (node.op == "=="))
+	case fieldName:
+		return filterBool(containsID(node.value.IDs, value.ID) == (node.op == "=="))
+	case fieldSpace:
+		return filterBool((value.Space == node.value.Space) == (node.op == "=="))
+	}
+	// Only operators the field's kind supports get past parsing
+	return filterUnknown
+}
+
+// key is the key of the compared name in filterExpression.IDs
+func (node *filterCompare) key() string {
+	return node.name + ":" + strings.ToLower(node.lookup)
+}
+
+// filterProgram is a parsed filter expression
+type filterProgram struct {
+	root filterNode
+	// Comparisons with names to look up through ESI
+	lookups []*filterCompare
+
+	needsLocation bool
+	needsGroups   bool
+}
+
+// bind sets the IDs of the names looked up through ESI
+func (program *filterProgram) bind(IDs map[string][]int32) error {
+	for _, compare := range program.lookups {
+		found, ok := IDs[compare.key()]
+		if !ok {
+			return fmt.Errorf("%v %q was not looked up", compare.field.Lookup, compare.lookup)
+		}
+		compare.value.IDs = found
+	}
+	return nil
+}
+
+// filterExpression is a subscription's filter expression
+type filterExpression struct {
+	// As typed in the track command, shown in !track list
+	Text string `json:"text" mapstructure:"text"`
+	// Names in the expression looked up through ESI when it was added, keyed by field:name in lower case,
+	// so the expression compiles again after a restart without asking ESI
+	IDs map[string][]int32 `json:"ids,omitempty" mapstructure:"ids"`
+
+	// Compiled once, on first use after being loaded from the store
+	once    sync.Once
+	program *filterProgram
+	err     error
+}
+
+// parseFilterExpression parses and validates a filter expression, looking up the names it compares to through ESI
+func (bot *ZKillBot) parseFilterExpression(text string) (*filterExpression, error) {
+	text = strings.TrimSpace(text)
+	program, err := parseFilter(text)
+	if err != nil {
+		return nil, err
+	}
+	filter := &filterExpression{Text: text}
+
+	if len(program.lookups) > 0 {
+		var names []string
+		for _, compare := range program.lookups {
+			names = append(names, compare.lookup)
+		}
+		results, err := bot.universe.IDs(bot.ctx, names)
+		if err != nil {
+			return nil, fmt.Errorf("EVE ESI error, unable to look up names: %v", err)
+		}
+
+		// Only the results of the kind the field compares to
+		filter.IDs = make(map[string][]int32)
+		for _, compare := range program.lookups {
+			var IDs []int32
+			add := func(ID int32, name string) {
+				if strings.EqualFold(name, compare.lookup) {
+					IDs = append(IDs, ID)
+				}
+			}
+			switch compare.field.Lookup {
+			case locationRegion:
+				for _, result := range results.Regions {
+					add(result.Id, result.Name)
+				}
+			case locationConstellation:
+				for _, result := range results.Constellations {
+					add(result.Id, result.Name)
+				}
+			case locationSystem:
+				for _, result := range results.Systems {
+					add(result.Id, result.Name)
+				}
+			default:
+				for _, result := range results.InventoryTypes {
+					add(result.Id, result.Name)
+				}
+			}
+			if len(IDs) == 0 {
+				return nil, fmt.Errorf("Unknown %v %q", compare.field.Lookup, compare.lookup)
+			}
+			filter.IDs[compare.key()] = IDs
+		}
+	}
+
+	err = program.bind(filter.IDs)
+	if err != nil {
+		return nil, err
+	}
+	filter.once.Do(func() {
+		filter.program = program
+	})
+	return filter, nil
+}
+
+// compiled returns the compiled expression, compiling it on first use
+func (filter *filterExpression) compiled() (*filterProgram, error) {
+	filter.once.Do(func() {
+		program, err := parseFilter(filter.Text)
+		if err == nil {
+			err = program.bind(filter.IDs)
+		}
+		filter.program, filter.err = program, err
+	})
+	return filter.program, filter.err
+}
+
+// passes returns true if the kill matches the expression, or whether it matches depends on a field not known for the kill
+func (filter *filterExpression) passes(facts *killFacts) bool {
+	program, err := filter.compiled()
+	if err != nil {
+		// Validated when it was added, rather deliver than drop kills if the stored expression was changed since
+		return true
+	}
+	return program.root.eval(facts) != filterFalse
+}
+
+// Token kinds of filter expressions
+const (
+	tokenEnd = iota
+	tokenIdent
+	tokenNumber
+	tokenString
+	tokenOp
+)
+
+// filterToken is a token of a filter expression, Pos is the 1-based character position shown in errors
+type filterToken struct {
+	Kind int
+	Text string
+	Pos  int
+}
+
+// describe returns how the token is shown in errors
+func (token filterToken) describe() string {
+	if token.Kind == tokenEnd {
+		return "end of filter"
+	}
+	return fmt.Sprintf("%q at position %v", token.Text, token.Pos)
+}
+
+// filterOps are the operators of filter expressions, longest first
+var filterOps = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")"}
+
+// filterQuotes maps opening quotes to closing quotes, discord clients may replace straight quotes with curly ones
+var filterQuotes = map[rune]rune{'"': '"', '\'': '\'', '“': '”', '‘': '’'}
+
+// tokenizeFilter splits a filter expression into tokens
+func tokenizeFilter(text string) ([]filterToken, error) {
+	runes := []rune(text)
+	var tokens []filterToken
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		start := i
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			continue
+
+		case unicode.IsLetter(r) || r == '_':
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, filterToken{Kind: tokenIdent, Text: string(runes[start:i]), Pos: start + 1})
+			continue
+
+		// Numbers may be negative, e.g. security < -0.5, there is no subtraction to confuse it with
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(runes) && (unicode.IsDigit(runes[i+1]) || runes[i+1] == '.')):
+			i++
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '.' || runes[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, filterToken{Kind: tokenNumber, Text: string(runes[start:i]), Pos: start + 1})
+			continue
+		}
+
+		if closing, ok := filterQuotes[r]; ok {
+			end := i + 1
+			for end < len(runes) && runes[end] != closing && runes[end] != r {
+				end++
+			}
+			if end == len(runes) {
+				return nil, fmt.Errorf("Missing closing quote for the name at position %v", start+1)
+			}
+			tokens = append(tokens, filterToken{Kind: tokenString, Text: string(runes[start+1 : end]), Pos: start + 1})
+			i = end + 1
+			continue
+		}
+
+		found := false
+		for _, op := range filterOps {
+			if strings.HasPrefix(string(runes[i:]), op) {
+				tokens = append(tokens, filterToken{Kind: tokenOp, Text: op, Pos: start + 1})
+				i += len([]rune(op))
+				found = true
+				break
+			}
+		}
+		if !found {
+			hint := ""
+			switch r {
+			case '=':
+				hint = ", use == to compare"
+			case '&', '|':
+				hint = fmt.Sprintf(", use %v%v", string(r), string(r))
+			}
+			return nil, fmt.Errorf("Unexpected %q at position %v%v", string(r), start+1, hint)
+		}
+	}
+
+	return append(tokens, filterToken{Kind: tokenEnd, Pos: len(runes) + 1}), nil
+}
+
+// parseNumber parses a number with an optional k, m, b or t suffix, e.g. 1.5b
+func parseNumber(text string) (float64, error) {
+	multiplier := 1.0
+	switch strings.ToLower(text[len(text)-1:]) {
+	case "k":
+		multiplier = 1e3
+	case "m":
+		multiplier = 1e6
+	case "b":
+		multiplier = 1e9
+	case "t":
+		multiplier = 1e12
+	}
+	if multiplier != 1 {
+		text = text[:len(text)-1]
+	}
+
+	number, err := strconv.ParseFloat(strings.Replace(text, "_", "", -1), 64)
+	if err != nil {
+		return 0, err
+	}
+	return number * multiplier, nil
+}
+
+// filterParser is a recursive descent parser of filter expressions
+//
+//	or         = and { "||" and }
+//	and        = unary { "&&" unary }
+//	unary      = "!" unary | "(" or ")" | comparison
+//	comparison = operand [ ( "==" | "!=" | "<" | "<=" | ">" | ">=" ) operand ]
+//	operand    = field | number | name | "true" | "false"
+type filterParser struct {
+	tokens  []filterToken
+	pos     int
+	program *filterProgram
+}
+
+// parseFilter parses and type checks a filter expression, names compared to are looked up separately
+func parseFilter(text string) (*filterProgram, error) {
+	if len(strings.TrimSpace(text)) == 0 {
+		return nil, fmt.Errorf("No filter given")
+	}
+	if len([]rune(text)) > filterMaxLength {
+		return nil, fmt.Errorf("Filter is longer than %v characters", filterMaxLength)
+	}
+
+	tokens, err := tokenizeFilter(text)
+	if err != nil {
+		return nil, err
+	}
+	parser := &filterParser{tokens: tokens, program: &filterProgram{}}
+
+	root, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if token := parser.peek(); token.Kind != tokenEnd {
+		return nil, fmt.Errorf("Unexpected %v, expected && or ||", token.describe())
+	}
+	parser.program.root = root
+	return parser.program, nil
+}
+
+func (parser *filterParser) peek() filterToken {
+	return parser.tokens[parser.pos]
+}
+
+func (parser *filterParser) next() filterToken {
+	token := parser.tokens[parser.pos]
+	if token.Kind != tokenEnd {
+		parser.pos++
+	}
+	return token
+}
+
+// accept consumes the next token if it is the operator op
+func (parser *filterParser) accept(op string) bool {
+	if token := parser.peek(); token.Kind == tokenOp && token.Text == op {
+		parser.pos++
+		return true
+	}
+	return false
+}
+
+func (parser *filterParser) parseOr() (filterNode, error) {
+	left, err := parser.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for parser.accept("||") {
+		right, err := parser.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &filterOr{left, right}
+	}
+	return left, nil
+}
+
+func (parser *filterParser) parseAnd() (filterNode, error) {
+	left, err := parser.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for parser.accept("&&") {
+		right, err := parser.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &filterAnd{left, right}
+	}
+	return left, nil
+}
+
+func (parser *filterParser) parseUnary() (filterNode, error) {
+	if parser.accept("!") {
+		node, err := parser.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &filterNot{node}, nil
+	}
+
+	if open := parser.peek(); parser.accept("(") {
+		node, err := parser.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !parser.accept(")") {
+			return nil, fmt.Errorf("Unexpected %v, expected ) to close ( at position %v", parser.peek().describe(), open.Pos)
+		}
+		return node, nil
+	}
+
+	return parser.parseComparison()
+}
+
+// parseComparison parses a comparison of a field to a literal, in either order, or a boolean field on its own
+func (parser *filterParser) parseComparison() (filterNode, error) {
+	left := parser.next()
+	if left.Kind == tokenEnd || left.Kind == tokenOp {
+		return nil, fmt.Errorf("Unexpected %v, expected a field", left.describe())
+	}
+
+	op := parser.peek()
+	switch op.Text {
+	case "==", "!=", "<", "<=", ">", ">=":
+		if op.Kind != tokenOp {
+			break
+		}
+		parser.next()
+		right := parser.next()
+		if right.Kind == tokenEnd || right.Kind == tokenOp {
+			return nil, fmt.Errorf("Unexpected %v, expected a value to compare to", right.describe())
+		}
+
+		// Literal first, e.g. 5 >= attackers
+		if !parser.isField(left) && parser.isField(right) {
+			flipped := map[string]string{"<": ">", "<=": ">=", ">": "<", ">=": "<="}
+			if flip, ok := flipped[op.Text]; ok {
+				op.Text = flip
+			}
+			left, right = right, left
+		}
+		return parser.compare(left, op, right)
+	}
+
+	// A boolean field on its own
+	field, err := parser.field(left)
+	if err != nil {
+		return nil, err
+	}
+	if field.Kind != fieldBool {
+		return nil, fmt.Errorf("Field %v at position %v must be compared to a %v", left.Text, left.Pos, field.Kind)
+	}
+	return &filterCompare{name: left.Text, field: field, op: "==", value: filterValue{Bool: true}}, nil
+}
+
+// isField returns true if the token names a field
+func (parser *filterParser) isField(token filterToken) bool {
+	_, ok := filterFields[strings.ToLower(token.Text)]
+	return token.Kind == tokenIdent && ok
+}
+
+// field returns the field the token names
+func (parser *filterParser) field(token filterToken) (*filterField, error) {
+	field, ok := filterFields[strings.ToLower(token.Text)]
+	if token.Kind != tokenIdent || !ok {
+		return nil, fmt.Errorf("Unknown field %v, fields are %v", token.describe(), strings.Join(filterFieldNames(), ", "))
+	}
+
+	parser.program.needsLocation = parser.program.needsLocation || field.NeedsLocation
+	parser.program.needsGroups = parser.program.needsGroups || field.NeedsGroups
+	return field, nil
+}
+
+// compare type checks a comparison of the field to a literal
+func (parser *filterParser) compare(left filterToken, op filterToken, right filterToken) (filterNode, error) {
+	field, err := parser.field(left)
+	if err != nil {
+		return nil, err
+	}
+	node := &filterCompare{name: strings.ToLower(left.Text), field: field, op: op.Text}
+
+	if field.Kind != fieldNumber && op.Text != "==" && op.Text != "!=" {
+		return nil, fmt.Errorf("Field %v at position %v can only be compared with == or !=", left.Text, left.Pos)
+	}
+	expected := fmt.Errorf("Field %v must be compared to a %v, got %v", left.Text, field.Kind, right.describe())
+
+	switch field.Kind {
+	case fieldNumber:
+		if right.Kind != tokenNumber {
+			return nil, expected
+		}
+		node.value.Number, err = parseNumber(right.Text)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid number %v", right.describe())
+		}
+
+	case fieldBool:
+		if right.Kind != tokenIdent || (right.Text != "true" && right.Text != "false") {
+			return nil, expected
+		}
+		node.value.Bool = right.Text == "true"
+
+	case fieldSpace:
+		band, ok := spaceNames[strings.Replace(strings.ToLower(right.Text), "-", "", -1)]
+		if right.Kind != tokenString || !ok {
+			return nil, fmt.Errorf("Field %v must be compared to \"highsec\", \"lowsec\", \"nullsec\", \"wormhole\", \"pochven\" or \"abyssal\", got %v", left.Text, right.describe())
+		}
+		node.value.Space = band
+
+	case fieldName:
+		switch {
+		case right.Kind == tokenNumber:
+			ID, err := strconv.Atoi(right.Text)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid ID %v", right.describe())
+			}
+			node.value.IDs = []int32{int32(ID)}
+		case right.Kind != tokenString || len(strings.TrimSpace(right.Text)) == 0:
+			return nil, fmt.Errorf("Field %v must be compared to a name in quotes or an ID, got %v", left.Text, right.describe())
+		case len(field.Lookup) == 0:
+			// Ship groups are known without ESI
+			groups, ok := lookupShipGroup(right.Text)
+			if !ok {
+				return nil, fmt.Errorf("Unknown ship group %v", right.describe())
+			}
+			node.value.IDs = groups
+		default:
+			node.lookup = strings.TrimSpace(right.Text)
+			parser.program.lookups = append(parser.program.lookups, node)
+		}
+	}
+
+	return node, nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/antihax/goesi/esi"
+)
+
+func TestParseFilter_errors(t *testing.T) {
+	tests := []struct {
+		text  string
+		error string
+	}{
+		{"", "No filter given"},
+		{"value > 1b &&", "end of filter"},
+		{"value = 1b", "use =="},
+		{"value > 1b & !npc", "use &&"},
+		{"regoin == \"Delve\"", "Unknown field \"regoin\" at position 1"},
+		{"region > \"Delve\"", "can only be compared with == or !="},
+		{"region == Delve", "name in quotes"},
+		{"value > \"1b\"", "compared to a number"},
+		{"value > 1x", "Invalid number \"1x\""},
+		{"security < - 0.5", "Unexpected \"-\" at position 12"},
+		{"security < -x", "Unexpected \"-\" at position 12"},
+		{"npc == 1", "compared to a true or false"},
+		{"attackers", "compared to a number"},
+		{"space == \"deep\"", "\"highsec\""},
+		{"ship_group == \"boat\"", "Unknown ship group"},
+		{"(value > 1b || solo", "expected ) to close ( at position 1"},
+		{"system == \"Jita", "Missing closing quote"},
+		{"value > 1b npc", "\"npc\" at position 12, expected && or ||"},
+		{strings.Repeat("npc && ", 100) + "npc", "longer than"},
+	}
+
+	for _, test := range tests {
+		_, err := parseFilter(test.text)
+		if err == nil || !strings.Contains(err.Error(), test.error) {
+			t.Logf("Expected %q to fail with %q, got %v", test.text, test.error, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestFilterExpression_passes(t *testing.T) {
+	bot := testBot()
+	bot.universe = fakeUniverse()
+
+	jita := &killFacts{Value: 2e9, Zkb: true, Killmail: true, VictimShip: 587, Attackers: 3, SolarSystemID: 30000142, ConstellationID: 20000020, RegionID: 10000002, Security: 0.95, Space: spaceHighsec, ShipGroups: map[int32]int32{587: 25}}
+	delve := &killFacts{Value: 5e8, Zkb: true, Killmail: true, VictimShip: 23757, Attackers: 40, SolarSystemID: 30004759, ConstellationID: 20000696, RegionID: 10000060, Security: -0.38, Space: spaceNullsec, ShipGroups: map[int32]int32{23757: 547}, Solo: true}
+	npc := &killFacts{Value: 1e6, Zkb: true, Killmail: true, VictimShip: 587, Attackers: 1, NPC: true}
+	summary := &killFacts{VictimShip: 587}
+
+	tests := []struct {
+		text   string
+		passes []bool // jita, delve, npc, summary
+	}{
+		{"value > 1b", []bool{true, false, false, false}},
+		{"value >= 500m && value < 1.5B", []bool{false, true, false, false}},
+		{"5 >= attackers", []bool{true, false, true, true}},
+		{"!npc && attackers <= 5", []bool{true, false, false, true}},
+		{"npc == false || solo", []bool{true, true, false, true}},
+		{"npc || solo || awox", []bool{false, true, true, true}},
+		{"region == \"Delve\" || system == \"jita\"", []bool{true, true, true, true}},
+		{"region != 10000060", []bool{true, false, true, true}},
+		{"constellation == \"1P-VL2\"", []bool{false, true, true, true}},
+		{"space == \"hs\" || security < 0", []bool{true, true, true, true}},
+		{"security < -0.3 && security >= -.5", []bool{false, true, true, true}},
+		{"-0.5 < security", []bool{true, true, true, true}},
+		{"space == 'nullsec' && ship_group == \"capital\"", []bool{false, true, true, true}},
+		{"ship == “Rifter” && !(value > 1b)", []bool{false, false, true, true}},
+		{"ship_group == \"frigate\" && (region == \"Delve\" || value > 1b)", []bool{true, false, true, true}},
+
+		// Unknown fields give the same result whichever side they are on
+		{"region == \"Delve\" && attackers > 100", []bool{false, false, false, true}},
+		{"attackers > 100 && region == \"Delve\"", []bool{false, false, false, true}},
+		{"region == \"Delve\" || attackers <= 5", []bool{true, true, true, true}},
+		{"attackers <= 5 || region == \"Delve\"", []bool{true, true, true, true}},
+		{"region == \"Delve\" || attackers > 100", []bool{false, true, true, true}},
+		{"attackers > 100 || region == \"Delve\"", []bool{false, true, true, true}},
+		{"!(region == \"Delve\" && attackers > 100)", []bool{true, true, true, true}},
+	}
+
+	// Comparisons of an unknown value are false, like a minimum value
+	for _, text := range []string{"value > 1b", "value < 1b", "value != 0"} {
+		program, err := parseFilter(text)
+		if err != nil {
+			t.Fatalf("Parse of %q failed: %v", text, err)
+		}
+		if result := program.root.eval(summary); result != filterFalse {
+			t.Logf("Expected %q to be false without a value, got %v", text, result)
+			t.Fail()
+		}
+	}
+
+	// Without zkb data or the killmail the flags are unknown rather than false
+	noZkb := &killFacts{VictimShip: 587}
+	for _, text := range []string{"npc", "!npc", "solo", "!solo", "awox", "!awox"} {
+		program, err := parseFilter(text)
+		if err != nil {
+			t.Fatalf("Parse of %q failed: %v", text, err)
+		}
+		if result := program.root.eval(noZkb); result != filterUnknown {
+			t.Logf("Expected %q to be unknown without zkb data, got %v", text, result)
+			t.Fail()
+		}
+	}
+
+	for _, test := range tests {
+		filter, err := bot.parseFilterExpression(test.text)
+		if err != nil {
+			t.Logf("Parse of %q failed: %v", test.text, err)
+			t.Fail()
+			continue
+		}
+		for i, facts := range []*killFacts{jita, delve, npc, summary} {
+			if filter.passes(facts) != test.passes[i] {
+				t.Logf("Expected %q to pass kill %v: %v", test.text, i, test.passes[i])
+				t.Fail()
+			}
+		}
+	}
+
+	// Names are looked up through ESI
+	_, err := bot.parseFilterExpression("region == \"Nowhere\"")
+	if err == nil || err.Error() != "Unknown region \"Nowhere\"" {
+		t.Logf("Expected an unknown region, got %v", err)
+		t.Fail()
+	}
+	_, err = bot.parseFilterExpression("system == \"Delve\"")
+	if err == nil || err.Error() != "Unknown system \"Delve\"" {
+		t.Logf("Expected an unknown system, got %v", err)
+		t.Fail()
+	}
+}
+
+func TestFilterExpression_stored(t *testing.T) {
+	bot := testBot()
+	bot.universe = fakeUniverse()
+
+	// Options after the expression are part of it
+	err := bot.parseTrackFilters("1 --filter value > 1b --ships pod", &subscriptionData{})
+	if err == nil || !strings.HasPrefix(err.Error(), "Invalid --filter: Unexpected \"-\" at position 12") {
+		t.Logf("Expected the expression to fail at --ships, got %v", err)
+		t.Fail()
+	}
+
+	subData := &subscriptionData{EveID: 1}
+	err = bot.parseTrackFilters("1 --no-npc --filter region == \"The Forge\" && value > 1b", subData)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if !subData.NoNPC || subData.Filter == nil || subData.filterText() != "no npc, filter: region == \"The Forge\" && value > 1b" {
+		t.Logf("Unexpected filters %q", subData.filterText())
+		t.Fail()
+	}
+
+	// Loaded from the store the expression compiles again without ESI
+	stored, err := json.Marshal(subData)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	loaded := &subscriptionData{}
+	err = json.Unmarshal(stored, loaded)
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	bot.universe.ids = func(ctx context.Context, names []string) (esi.PostUniverseIdsOk, error) {
+		return esi.PostUniverseIdsOk{}, errors.New("ESI is down")
+	}
+
+	kill := KillSummary{KillID: 1, ShipTypeID: 587, Zkb: ZkbData{TotalValue: 2e9}}
+	enriched := &enrichedKill{SolarSystemID: 30000142}
+	facts := bot.killFacts(kill, enriched, map[string]*killMatch{"chan-a": {Subs: []*subscriptionData{loaded}}})
+	if facts.RegionID != 10000002 {
+		t.Logf("Expected the kill's region to be looked up for the filter, got %+v", facts)
+		t.Fail()
+	}
+	if !loaded.passes(facts) {
+		t.Logf("Expected the kill in The Forge to pass")
+		t.Fail()
+	}
+	facts.Value = 1e9
+	if loaded.passes(facts) {
+		t.Logf("Expected the 1b kill to be filtered out")
+		t.Fail()
+	}
+
+	// Nor is a direction inside the expression
+	subData = &subscriptionData{EveID: 1, Direction: directionBoth}
+	err = bot.parseTrackFilters("1 --filter system == 30000142 || ship == \"x --kills\"", subData)
+	if subData.Direction != directionBoth {
+		t.Logf("Expected the direction inside the expression to be ignored, got %v (%v)", subData.Direction, err)
+		t.Fail()
+	}
+}
+
+func TestFilterExpression_unknownValue(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	bot := testBot()
+	bot.universe = fakeUniverse()
+	bot.viperConfig.Set("zkillboard_api_url", server.URL+"/api/")
+	bot.httpClient = server.Client()
+	bot.seen, _ = NewKillDeduper(time.Hour, 100, "")
+	for channelID, text := range map[string]string{"chan-a": "!npc", "chan-b": "value > 1b"} {
+		subData := &subscriptionData{DiscordChannelID: channelID, EveID: 100}
+		err := bot.parseTrackFilters("100 --filter "+text, subData)
+		if err != nil {
+			t.Fatalf("Parse of %q failed: %v", text, err)
+		}
+		bot.dataStorage.addSubscription(subData)
+	}
+
+	// zKillboard is rate limiting, so the kill's value is unknown
+	deliveries := bot.buildDeliveries(bot.routeKill(KillSummary{KillID: 1, CharacterID: 100, URL: "https://zkillboard.com/kill/1/"}))
+	if len(deliveries) != 1 || deliveries[0].ChannelID != "chan-a" {
+		t.Logf("Expected the kill only for the channel not filtering on value, got %+v", deliveries)
+		t.Fail()
+	}
+}
@@ -0,0 +1,638 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// shipGroups maps ship group names, lower case without spaces, to their group IDs.
+// Some names are shorthands covering several groups.
+var shipGroups = map[string][]int32{
+	"frigate":                  {25},
+	"cruiser":                  {26},
+	"battleship":               {27},
+	"industrial":               {28},
+	"capsule":                  {29},
+	"pod":                      {29},
+	"titan":                    {30},
+	"shuttle":                  {31},
+	"corvette":                 {237},
+	"rookie":                   {237},
+	"assaultfrigate":           {324},
+	"heavyassaultcruiser":      {358},
+	"hac":                      {358},
+	"deepspacetransport":       {380},
+	"battlecruiser":            {419, 1201},
+	"combatbattlecruiser":      {419},
+	"attackbattlecruiser":      {1201},
+	"destroyer":                {420},
+	"miningbarge":              {463},
+	"dreadnought":              {485},
+	"dread":                    {485},
+	"freighter":                {513},
+	"commandship":              {540},
+	"interdictor":              {541},
+	"dictor":                   {541},
+	"exhumer":                  {543},
+	"carrier":                  {547},
+	"supercarrier":             {659},
+	"super":                    {659},
+	"covertops":                {830},
+	"interceptor":              {831},
+	"logistics":                {832},
+	"forcerecon":               {833},
+	"combatrecon":              {906},
+	"recon":                    {833, 906},
+	"stealthbomber":            {834},
+	"bomber":                   {834},
+	"capitalindustrial":        {883},
+	"electronicattackship":     {893},
+	"heavyinterdictioncruiser": {894},
+	"hic":                      {894},
+	"blackops":                 {898},
+	"marauder":                 {900},
+	"jumpfreighter":            {902},
+	"industrialcommandship":    {941},
+	"strategiccruiser":         {963},
+	"t3c":                      {963},
+	"blockaderunner":           {1202},
+	"expeditionfrigate":        {1283},
+	"tacticaldestroyer":        {1305},
+	"t3d":                      {1305},
+	"logisticsfrigate":         {1527},
+	"commanddestroyer":         {1534},
+	"forceauxiliary":           {1538},
+	"fax":                      {1538},
+	"flagcruiser":              {1972},
+	"lancerdreadnought":        {4594},
+	"capital":                  {30, 485, 547, 659, 883, 1538, 4594},
+	"supercapital":             {30, 659},
+}
+
+// lookupShipGroup returns the group IDs of a ship group name, ignoring case, spaces, dashes and a plural s
+func lookupShipGroup(name string) ([]int32, bool) {
+	name = strings.ToLower(name)
+	for _, separator := range []string{" ", "-", "_"} {
+		name = strings.Replace(name, separator, "", -1)
+	}
+
+	if groups, ok := shipGroups[name]; ok {
+		return groups, true
+	}
+	groups, ok := shipGroups[strings.TrimSuffix(name, "s")]
+	return groups, ok
+}
+
+// shipFilter limits a subscription to kills involving certain ships, or drops losses of certain ships
+//
+// A kill passes when the victim's or any attacker's ship is included, or nothing is included,
+// and the victim's ship isn't excluded.
+type shipFilter struct {
+	Types         []int32 `json:"types,omitempty"`
+	Groups        []int32 `json:"groups,omitempty"`
+	ExcludeTypes  []int32 `json:"exclude_types,omitempty"`
+	ExcludeGroups []int32 `json:"exclude_groups,omitempty"`
+
+	// As typed in the track command, shown in !track list
+	Text string `json:"text"`
+}
+
+// parseShipFilter parses a comma separated list of ship groups, ship type names or type IDs, each excluded when prefixed with !.
+// Type names are looked up through ESI, dashes or underscores can be used in place of spaces.
+func (bot *ZKillBot) parseShipFilter(text string) (*shipFilter, error) {
+	filter := &shipFilter{Text: text}
+
+	// Names that aren't ship groups are looked up as types in one request
+	typeNames := make(map[string]bool)
+	var lookupNames []string
+	for _, entry := range strings.Split(text, ",") {
+		entry = strings.TrimSpace(entry)
+		exclude := strings.HasPrefix(entry, "!")
+		entry = strings.TrimSpace(strings.TrimPrefix(entry, "!"))
+		if len(entry) == 0 {
+			continue
+		}
+
+		if groups, ok := lookupShipGroup(entry); ok {
+			if exclude {
+				filter.ExcludeGroups = append(filter.ExcludeGroups, groups...)
+			} else {
+				filter.Groups = append(filter.Groups, groups...)
+			}
+			continue
+		}
+
+		if typeID, err := strconv.Atoi(entry); err == nil {
+			if exclude {
+				filter.ExcludeTypes = append(filter.ExcludeTypes, int32(typeID))
+			} else {
+				filter.Types = append(filter.Types, int32(typeID))
+			}
+			continue
+		}
+
+		name := strings.NewReplacer("-", " ", "_", " ").Replace(entry)
+		typeNames[strings.ToLower(name)] = exclude
+		lookupNames = append(lookupNames, name)
+	}
+
+	if len(lookupNames) > 0 {
+		IDs, err := bot.universe.IDs(bot.ctx, lookupNames)
+		if err != nil {
+			return nil, fmt.Errorf("EVE ESI error, unable to look up ships: %v", err)
+		}
+		for _, itemType := range IDs.InventoryTypes {
+			exclude, ok := typeNames[strings.ToLower(itemType.Name)]
+			if !ok {
+				continue
+			}
+			delete(typeNames, strings.ToLower(itemType.Name))
+			if exclude {
+				filter.ExcludeTypes = append(filter.ExcludeTypes, itemType.Id)
+			} else {
+				filter.Types = append(filter.Types, itemType.Id)
+			}
+		}
+		for _, name := range lookupNames {
+			if _, ok := typeNames[strings.ToLower(name)]; ok {
+				return nil, fmt.Errorf("Unknown ship or ship group: %v", name)
+			}
+		}
+	}
+
+	if len(filter.Types)+len(filter.Groups)+len(filter.ExcludeTypes)+len(filter.ExcludeGroups) == 0 {
+		return nil, fmt.Errorf("No ships given")
+	}
+	return filter, nil
+}
+
+// needsGroups returns true if the filter needs to know the group of each ship
+func (filter *shipFilter) needsGroups() bool {
+	return len(filter.Groups) > 0 || len(filter.ExcludeGroups) > 0
+}
+
+// passes returns true if the kill passes the filter, ships whose group isn't known can't be excluded
+func (filter *shipFilter) passes(facts *killFacts) bool {
+	// Losses of excluded ships
+	if facts.VictimShip != 0 {
+		if containsID(filter.ExcludeTypes, facts.VictimShip) {
+			return false
+		}
+		if group, ok := facts.ShipGroups[facts.VictimShip]; ok && containsID(filter.ExcludeGroups, group) {
+			return false
+		}
+	}
+
+	if len(filter.Types) == 0 && len(filter.Groups) == 0 {
+		return true
+	}
+
+	// Any included ship on either side, attackers are only known with the full killmail
+	unknown := !facts.Killmail
+	for _, ship := range append([]int32{facts.VictimShip}, facts.AttackerShips...) {
+		if ship == 0 {
+			continue
+		}
+		if containsID(filter.Types, ship) {
+			return true
+		}
+		if len(filter.Groups) == 0 {
+			continue
+		}
+		group, ok := facts.ShipGroups[ship]
+		if !ok {
+			unknown = true
+			continue
+		}
+		if containsID(filter.Groups, group) {
+			return true
+		}
+	}
+
+	// Rather deliver than drop a kill that may have matched
+	return unknown
+}
+
+// Eve location IDs are allocated in ranges, e.g. every region ID is 10000000 to 19999999
+const (
+	regionIDMin        = 10000000
+	constellationIDMin = 20000000
+	systemIDMin        = 30000000
+	systemIDMax        = 40000000
+)
+
+// Location kinds of a locationFilter
+const (
+	locationRegion        = "region"
+	locationConstellation = "constellation"
+	locationSystem        = "system"
+)
+
+// locationFilter limits a subscription to kills in certain regions, constellations or solar systems
+type locationFilter struct {
+	Regions        []int32 `json:"regions,omitempty"`
+	Constellations []int32 `json:"constellations,omitempty"`
+	Systems        []int32 `json:"systems,omitempty"`
+
+	// As typed in the track command, shown in !track list
+	Text string `json:"text"`
+}
+
+// parseLocations adds a comma separated list of locations of one kind to the filter, each a name or an ID.
+// Names are looked up through ESI, dashes or underscores can be used in place of spaces.
+func (bot *ZKillBot) parseLocations(filter *locationFilter, kind string, text string) error {
+	// ID range of the kind
+	minID, maxID := int32(regionIDMin), int32(constellationIDMin)
+	IDs := &filter.Regions
+	switch kind {
+	case locationConstellation:
+		minID, maxID = constellationIDMin, systemIDMin
+		IDs = &filter.Constellations
+	case locationSystem:
+		minID, maxID = systemIDMin, systemIDMax
+		IDs = &filter.Systems
+	}
+
+	// Names, some system names contain dashes so both the name as typed and with spaces are looked up
+	names := make(map[string]string)
+	var lookupNames []string
+	for _, entry := range strings.Split(text, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		if ID, err := strconv.Atoi(entry); err == nil {
+			if int32(ID) < minID || int32(ID) >= maxID {
+				return fmt.Errorf("%v is not a %v ID", ID, kind)
+			}
+			*IDs = append(*IDs, int32(ID))
+			continue
+		}
+
+		names[strings.ToLower(entry)] = entry
+		lookupNames = append(lookupNames, entry)
+		if spaced := strings.NewReplacer("-", " ", "_", " ").Replace(entry); spaced != entry {
+			names[strings.ToLower(spaced)] = entry
+			lookupNames = append(lookupNames, spaced)
+		}
+	}
+
+	if len(lookupNames) > 0 {
+		results, err := bot.universe.IDs(bot.ctx, lookupNames)
+		if err != nil {
+			return fmt.Errorf("EVE ESI error, unable to look up locations: %v", err)
+		}
+
+		// Only the results of the kind asked for
+		found := make(map[string]bool)
+		add := func(ID int32, name string) {
+			if entry, ok := names[strings.ToLower(name)]; ok && !found[entry] {
+				found[entry] = true
+				*IDs = append(*IDs, ID)
+			}
+		}
+		switch kind {
+		case locationRegion:
+			for _, result := range results.Regions {
+				add(result.Id, result.Name)
+			}
+		case locationConstellation:
+			for _, result := range results.Constellations {
+				add(result.Id, result.Name)
+			}
+		case locationSystem:
+			for _, result := range results.Systems {
+				add(result.Id, result.Name)
+			}
+		}
+
+		for _, entry := range names {
+			if !found[entry] {
+				return fmt.Errorf("Unknown %v: %v", kind, entry)
+			}
+		}
+	}
+
+	if len(*IDs) == 0 {
+		return fmt.Errorf("No %v given", kind)
+	}
+	if len(filter.Text) > 0 {
+		filter.Text += ", "
+	}
+	filter.Text += kind + ": " + text
+	return nil
+}
+
+// passes returns true if the kill happened in one of the filter's locations, or its location isn't known
+func (filter *locationFilter) passes(facts *killFacts) bool {
+	// The solar system is only known with the full killmail
+	if facts.SolarSystemID == 0 {
+		return true
+	}
+	if containsID(filter.Systems, facts.SolarSystemID) {
+		return true
+	}
+
+	// Constellation and region failed to resolve
+	if facts.RegionID == 0 {
+		return len(filter.Constellations) > 0 || len(filter.Regions) > 0
+	}
+	return containsID(filter.Constellations, facts.ConstellationID) || containsID(filter.Regions, facts.RegionID)
+}
+
+// spaceNames maps the names accepted by --space to security space bands
+var spaceNames = map[string]string{
+	"highsec":  spaceHighsec,
+	"hs":       spaceHighsec,
+	"lowsec":   spaceLowsec,
+	"ls":       spaceLowsec,
+	"nullsec":  spaceNullsec,
+	"ns":       spaceNullsec,
+	"wormhole": spaceWormhole,
+	"wh":       spaceWormhole,
+	"jspace":   spaceWormhole,
+	"pochven":  spacePochven,
+	"abyssal":  spaceAbyssal,
+}
+
+// parseSpace parses a comma separated list of security space bands
+func parseSpace(text string) ([]string, error) {
+	var space []string
+	for _, entry := range strings.Split(text, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if len(entry) == 0 {
+			continue
+		}
+		band, ok := spaceNames[strings.Replace(entry, "-", "", -1)]
+		if !ok {
+			return nil, fmt.Errorf("Unknown space %v, expected highsec, lowsec, nullsec, wormhole, pochven or abyssal", entry)
+		}
+		space = append(space, band)
+	}
+
+	if len(space) == 0 {
+		return nil, fmt.Errorf("No space given")
+	}
+	return space, nil
+}
+
+// passesSpace returns true if the kill happened in one of the security space bands, or its location isn't known
+func passesSpace(space []string, facts *killFacts) bool {
+	if len(facts.Space) == 0 {
+		return true
+	}
+	for _, band := range space {
+		if band == facts.Space {
+			return true
+		}
+	}
+	return false
+}
+
+// spaceText describes the subscription's security space filter, shown in !track list
+func (subData *subscriptionData) spaceText() string {
+	if len(subData.Space) == 0 {
+		return "Any"
+	}
+	return strings.Join(subData.Space, ",")
+}
+
+// attackerPresets are the named attacker count ranges accepted by --attackers
+var attackerPresets = map[string]attackerRange{
+	"solo":      {Min: 1, Max: 1},
+	"small":     {Min: 2, Max: 10},
+	"smallgang": {Min: 2, Max: 10},
+	"fleet":     {Min: 11},
+}
+
+// attackerRange limits a subscription to kills with a number of attackers, Max of 0 has no upper limit
+type attackerRange struct {
+	Min int `json:"min"`
+	Max int `json:"max,omitempty"`
+
+	// As typed in the track command, shown in !track list
+	Text string `json:"text"`
+}
+
+// parseAttackerRange parses solo, small, fleet or a custom range, e.g. 5, 2-10 or 10+
+func parseAttackerRange(text string) (*attackerRange, error) {
+	text = strings.ToLower(strings.TrimSpace(text))
+	if preset, ok := attackerPresets[strings.Replace(text, "-", "", -1)]; ok {
+		preset.Text = text
+		return &preset, nil
+	}
+
+	attackers := &attackerRange{Text: text}
+	var err error
+	switch {
+	case strings.HasSuffix(text, "+"):
+		attackers.Min, err = strconv.Atoi(strings.TrimSuffix(text, "+"))
+	case strings.Contains(text, "-"):
+		bounds := strings.SplitN(text, "-", 2)
+		attackers.Min, err = strconv.Atoi(bounds[0])
+		if err == nil {
+			attackers.Max, err = strconv.Atoi(bounds[1])
+		}
+	default:
+		attackers.Min, err = strconv.Atoi(text)
+		attackers.Max = attackers.Min
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unknown attacker count %v, expected solo, small, fleet or a range like 2-10 or 10+", text)
+	}
+	if attackers.Min < 1 || (attackers.Max != 0 && attackers.Max < attackers.Min) {
+		return nil, fmt.Errorf("Invalid attacker count %v", text)
+	}
+
+	return attackers, nil
+}
+
+// passes returns true if the kill's number of attackers is in the range, or the attackers aren't known
+func (attackers *attackerRange) passes(facts *killFacts) bool {
+	if !facts.Killmail {
+		return true
+	}
+	return facts.Attackers >= attackers.Min && (attackers.Max == 0 || facts.Attackers <= attackers.Max)
+}
+
+// npcOnly returns true if no attacker is a player or belongs to a player corporation, NPC corporation IDs are below 2000000
+func npcOnly(kill *enrichedKill) bool {
+	for _, attacker := range kill.Killmail.Attackers {
+		if attacker.CharacterId != 0 || attacker.CorporationId >= 2000000 {
+			return false
+		}
+	}
+	return len(kill.Killmail.Attackers) > 0
+}
+
+// containsID returns true if ID is in IDs
+func containsID(IDs []int32, ID int32) bool {
+	for _, candidate := range IDs {
+		if candidate == ID {
+			return true
+		}
+	}
+	return false
+}
+
+// killFacts is what subscription filters check a kill against, gathered once per kill.
+// Filters pass kills when what they check isn't known, rather than silently dropping them,
+// except for the value in minimum values and filter expressions, so a failing zKillboard lookup can't flood channels with cheap kills.
+type killFacts struct {
+	// Total isk value, 0 if unknown
+	Value float64
+
+	// Killmail is true when the full killmail was fetched, without it only the victim is known
+	Killmail      bool
+	VictimShip    int32
+	AttackerShips []int32
+	Attackers     int
+	// Zkb is true when zKillboard's data of the kill is known, without it the value, solo and awox flags are unknown
+	Zkb bool
+	// NPC is true when only NPCs were involved, false if unknown
+	NPC bool
+	// zKillboard's solo and awox flags, false if unknown
+	Solo bool
+	Awox bool
+	// Ship type -> group, only looked up when a ship filter needs it
+	ShipGroups map[int32]int32
+
+	// Location of the kill, the constellation, region and security space are only looked up when a filter needs them
+	SolarSystemID   int32
+	ConstellationID int32
+	RegionID        int32
+	Security        float32
+	Space           string
+}
+
+// killFacts gathers what the subscriptions of the matched channels filter on, only asking ESI for what they need
+func (bot *ZKillBot) killFacts(kill KillSummary, enriched *enrichedKill, channels map[string]*killMatch) *killFacts {
+	log := bot.log
+
+	facts := &killFacts{
+		Value:      kill.Zkb.TotalValue,
+		VictimShip: int32(kill.ShipTypeID),
+		Zkb:        len(kill.Zkb.Hash) > 0,
+		NPC:        kill.Zkb.NPC,
+		Solo:       kill.Zkb.Solo,
+		Awox:       kill.Zkb.Awox,
+	}
+	if enriched != nil {
+		facts.Killmail = true
+		facts.VictimShip = enriched.Killmail.Victim.ShipTypeId
+		facts.SolarSystemID = enriched.SolarSystemID
+		facts.Attackers = len(enriched.Killmail.Attackers)
+		facts.NPC = facts.NPC || npcOnly(enriched)
+		for _, attacker := range enriched.Killmail.Attackers {
+			facts.AttackerShips = append(facts.AttackerShips, attacker.ShipTypeId)
+		}
+	}
+
+	// Find what the filters need
+	needGroups, needLocation := false, false
+	for _, match := range channels {
+		for _, subData := range match.Subs {
+			if subData.Ships != nil && subData.Ships.needsGroups() {
+				needGroups = true
+			}
+			if subData.Location != nil || len(subData.Space) > 0 {
+				needLocation = true
+			}
+			if subData.Filter != nil {
+				if program, err := subData.Filter.compiled(); err == nil {
+					needGroups = needGroups || program.needsGroups
+					needLocation = needLocation || program.needsLocation
+				}
+			}
+		}
+	}
+
+	if needGroups {
+		groups, err := bot.universe.TypeGroups(bot.ctx, append([]int32{facts.VictimShip}, facts.AttackerShips...))
+		if err != nil {
+			log.Warnf("Unable to get every ship group of kill %v, unknown ships skip ship group filters: %v", kill.KillID, err)
+		}
+		facts.ShipGroups = groups
+	}
+
+	if needLocation && facts.SolarSystemID != 0 {
+		system, err := bot.universe.System(bot.ctx, facts.SolarSystemID)
+		if err != nil {
+			log.Warnf("Unable to get the location of kill %v, location filters only match its solar system: %v", kill.KillID, err)
+		} else {
+			facts.ConstellationID = system.ConstellationID
+			facts.RegionID = system.RegionID
+			facts.Security = system.Security
+			facts.Space = system.Space
+		}
+	}
+
+	return facts
+}
+
+// passes returns true if the kill passes every filter of the subscription
+func (subData *subscriptionData) passes(facts *killFacts) bool {
+	// An unknown value is 0, below any minimum value
+	if float64(subData.MinVal) > facts.Value {
+		return false
+	}
+	if subData.Ships != nil && !subData.Ships.passes(facts) {
+		return false
+	}
+	if subData.Location != nil && !subData.Location.passes(facts) {
+		return false
+	}
+	if len(subData.Space) > 0 && !passesSpace(subData.Space, facts) {
+		return false
+	}
+	if subData.Attackers != nil && !subData.Attackers.passes(facts) {
+		return false
+	}
+	if subData.NoNPC && facts.NPC {
+		return false
+	}
+	if subData.Filter != nil && !subData.Filter.passes(facts) {
+		return false
+	}
+	return true
+}
+
+// passing returns the match with only the subscriptions the kill passes the filters of, nil if it passes none.
+// A kill is only a loss if a passing subscription tracks the victim.
+func (match *killMatch) passing(facts *killFacts) *killMatch {
+	passing := &killMatch{Lost: make(map[*subscriptionData]bool)}
+	for _, subData := range match.Subs {
+		if subData.passes(facts) {
+			passing.Subs = append(passing.Subs, subData)
+			passing.Lost[subData] = match.Lost[subData]
+			passing.Loss = passing.Loss || match.Lost[subData]
+		}
+	}
+	if len(passing.Subs) == 0 {
+		return nil
+	}
+	return passing
+}
+
+// filterText describes the subscription's filters other than minimum value, direction and space, shown in !track list
+func (subData *subscriptionData) filterText() string {
+	var filters []string
+	if subData.Ships != nil {
+		filters = append(filters, "ships: "+subData.Ships.Text)
+	}
+	if subData.Location != nil {
+		filters = append(filters, subData.Location.Text)
+	}
+	if subData.Attackers != nil {
+		filters = append(filters, "attackers: "+subData.Attackers.Text)
+	}
+	if subData.NoNPC {
+		filters = append(filters, "no npc")
+	}
+	if subData.Filter != nil {
+		filters = append(filters, "filter: "+subData.Filter.Text)
+	}
+	return strings.Join(filters, ", ")
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/antihax/goesi/esi"
+)
+
+// fakeUniverse returns a resolver knowing a few ship types and locations
+func fakeUniverse() *UniverseResolver {
+	types := map[string]int32{"rifter": 587, "federation navy comet": 17841}
+	groups := map[int32]int32{587: 25, 17841: 25, 670: 29, 19720: 485, 23757: 547}
+	regions := map[string]int32{"delve": 10000060, "querious": 10000050, "the forge": 10000002}
+	constellations := map[string]int32{"1p-vl2": 20000696}
+	systems := map[string]int32{"1dq1-a": 30004759, "jita": 30000142}
+	systemConstellations := map[int32]int32{30004759: 20000696, 30000142: 20000020}
+	systemSecurity := map[int32]float32{30004759: -0.38, 30000142: 0.95}
+	constellationRegions := map[int32]int32{20000696: 10000060, 20000020: 10000002}
+
+	resolver := newUniverseResolver()
+	resolver.typeGroup = func(ctx context.Context, typeID int32) (int32, error) {
+		return groups[typeID], nil
+	}
+	resolver.system = func(ctx context.Context, systemID int32) (esi.GetUniverseSystemsSystemIdOk, error) {
+		if constellationID, ok := systemConstellations[systemID]; ok {
+			return esi.GetUniverseSystemsSystemIdOk{SystemId: systemID, ConstellationId: constellationID, SecurityStatus: systemSecurity[systemID]}, nil
+		}
+		return esi.GetUniverseSystemsSystemIdOk{}, errors.New("not found")
+	}
+	resolver.constellationRegion = func(ctx context.Context, constellationID int32) (int32, error) {
+		return constellationRegions[constellationID], nil
+	}
+	resolver.ids = func(ctx context.Context, names []string) (esi.PostUniverseIdsOk, error) {
+		var IDs esi.PostUniverseIdsOk
+		for _, name := range names {
+			if typeID, ok := types[strings.ToLower(name)]; ok {
+				IDs.InventoryTypes = append(IDs.InventoryTypes, esi.PostUniverseIdsInventoryType{Id: typeID, Name: name})
+			}
+			if regionID, ok := regions[strings.ToLower(name)]; ok {
+				IDs.Regions = append(IDs.Regions, esi.PostUniverseIdsRegion{Id: regionID, Name: name})
+			}
+			if constellationID, ok := constellations[strings.ToLower(name)]; ok {
+				IDs.Constellations = append(IDs.Constellations, esi.PostUniverseIdsConstellation{Id: constellationID, Name: name})
+			}
+			if systemID, ok := systems[strings.ToLower(name)]; ok {
+				IDs.Systems = append(IDs.Systems, esi.PostUniverseIdsSystem{Id: systemID, Name: name})
+			}
+		}
+		return IDs, nil
+	}
+	return resolver
+}
+
+func TestZKillBot_parseShipFilter(t *testing.T) {
+	bot := testBot()
+	bot.universe = fakeUniverse()
+
+	filter, err := bot.parseShipFilter("Dreadnoughts, carrier,Federation-Navy-Comet,!pod,!670,23913")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if len(filter.Groups) != 2 || filter.Groups[0] != 485 || filter.Groups[1] != 547 {
+		t.Logf("Expected dreadnought and carrier groups, got %v", filter.Groups)
+		t.Fail()
+	}
+	if len(filter.Types) != 2 || filter.Types[0] != 23913 || filter.Types[1] != 17841 {
+		t.Logf("Expected type IDs 23913 and 17841, got %v", filter.Types)
+		t.Fail()
+	}
+	if len(filter.ExcludeGroups) != 1 || filter.ExcludeGroups[0] != 29 || len(filter.ExcludeTypes) != 1 || filter.ExcludeTypes[0] != 670 {
+		t.Logf("Expected capsules excluded, got %v and %v", filter.ExcludeGroups, filter.ExcludeTypes)
+		t.Fail()
+	}
+
+	// Names that are neither groups nor types
+	_, err = bot.parseShipFilter("capital,Not-A-Ship")
+	if err == nil || !strings.Contains(err.Error(), "Not A Ship") {
+		t.Logf("Expected an unknown ship error, got %v", err)
+		t.Fail()
+	}
+	_, err = bot.parseShipFilter(",")
+	if err == nil {
+		t.Logf("Expected an error without ships")
+		t.Fail()
+	}
+}
+
+func TestShipFilter_passes(t *testing.T) {
+	capitals := &shipFilter{Groups: []int32{485, 547}}
+	noPods := &shipFilter{ExcludeGroups: []int32{29}}
+	rifters := &shipFilter{Types: []int32{587}}
+	groups := map[int32]int32{587: 25, 670: 29, 19720: 485}
+
+	tests := []struct {
+		name   string
+		filter *shipFilter
+		facts  killFacts
+		passes bool
+	}{
+		{"capital victim", capitals, killFacts{Killmail: true, VictimShip: 19720, ShipGroups: groups}, true},
+		{"capital attacker", capitals, killFacts{Killmail: true, VictimShip: 587, AttackerShips: []int32{587, 19720}, ShipGroups: groups}, true},
+		{"no capitals", capitals, killFacts{Killmail: true, VictimShip: 587, AttackerShips: []int32{587, 0}, ShipGroups: groups}, false},
+		{"attackers unknown", capitals, killFacts{VictimShip: 587, ShipGroups: groups}, true},
+		{"group unknown", capitals, killFacts{Killmail: true, VictimShip: 587, AttackerShips: []int32{11567}, ShipGroups: groups}, true},
+		{"pod loss", noPods, killFacts{Killmail: true, VictimShip: 670, ShipGroups: groups}, false},
+		{"pod attacker", noPods, killFacts{Killmail: true, VictimShip: 587, AttackerShips: []int32{670}, ShipGroups: groups}, true},
+		{"rifter attacker", rifters, killFacts{Killmail: true, VictimShip: 670, AttackerShips: []int32{587}}, true},
+		{"no rifter", rifters, killFacts{Killmail: true, VictimShip: 670, AttackerShips: []int32{19720}}, false},
+	}
+
+	for _, test := range tests {
+		if test.filter.passes(&test.facts) != test.passes {
+			t.Logf("%v: expected passes to be %v", test.name, test.passes)
+			t.Fail()
+		}
+	}
+}
+
+func TestZKillBot_killFacts(t *testing.T) {
+	bot := testBot()
+	bot.universe = fakeUniverse()
+
+	kill := KillSummary{KillID: 1, ShipTypeID: 670, Zkb: ZkbData{TotalValue: 10000}}
+	unfiltered := map[string]*killMatch{"chan-a": {Subs: []*subscriptionData{{MinVal: 100}}}}
+	filtered := map[string]*killMatch{"chan-a": {Subs: []*subscriptionData{{Ships: &shipFilter{ExcludeGroups: []int32{29}}}}}}
+
+	// Groups are only looked up for ship group filters
+	facts := bot.killFacts(kill, nil, unfiltered)
+	if facts.Value != 10000 || facts.VictimShip != 670 || facts.ShipGroups != nil {
+		t.Logf("Unexpected facts: %+v", facts)
+		t.Fail()
+	}
+	if _, misses := bot.universe.Stats(); misses != 0 {
+		t.Logf("Expected no group lookups, got %v", misses)
+		t.Fail()
+	}
+
+	facts = bot.killFacts(kill, nil, filtered)
+	if facts.ShipGroups[670] != 29 {
+		t.Logf("Expected the pod's group, got %+v", facts)
+		t.Fail()
+	}
+	if filtered["chan-a"].passing(facts) != nil {
+		t.Logf("Pod loss should be filtered out")
+		t.Fail()
+	}
+}
+
+func TestZKillBot_parseTrackFilters(t *testing.T) {
+	bot := testBot()
+	bot.universe = fakeUniverse()
+
+	subData := &subscriptionData{}
+	err := bot.parseTrackFilters("100 --kills --region Delve, The-Forge --ships !pod --system 1DQ1-A,30000142 --constellation 20000696", subData)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	location := subData.Location
+	if location == nil || len(location.Regions) != 2 || location.Regions[0] != 10000060 || location.Regions[1] != 10000002 {
+		t.Logf("Expected Delve and The Forge, got %+v", location)
+		t.FailNow()
+	}
+	if len(location.Systems) != 2 || !containsID(location.Systems, 30004759) || !containsID(location.Systems, 30000142) {
+		t.Logf("Expected 1DQ1-A and Jita, got %v", location.Systems)
+		t.Fail()
+	}
+	if len(location.Constellations) != 1 || subData.Ships == nil || len(subData.Ships.ExcludeGroups) != 1 {
+		t.Logf("Expected a constellation and the ship filter, got %+v and %+v", location, subData.Ships)
+		t.Fail()
+	}
+	if subData.filterText() != "ships: !pod, region: Delve, The-Forge, system: 1DQ1-A,30000142, constellation: 20000696" {
+		t.Logf("Unexpected filter text %q", subData.filterText())
+		t.Fail()
+	}
+
+	// Unknown names and IDs of the wrong kind are errors
+	for _, args := range []string{"100 --region Delve,Nowhere", "100 --system 10000060", "100 --constellation Delve"} {
+		err = bot.parseTrackFilters(args, &subscriptionData{})
+		if err == nil {
+			t.Logf("Expected %q to fail", args)
+			t.Fail()
+		}
+	}
+}
+
+func TestLocationFilter_passes(t *testing.T) {
+	delve := &locationFilter{Regions: []int32{10000060}}
+	jita := &locationFilter{Systems: []int32{30000142}}
+
+	tests := []struct {
+		name   string
+		filter *locationFilter
+		facts  killFacts
+		passes bool
+	}{
+		{"in region", delve, killFacts{SolarSystemID: 30004759, ConstellationID: 20000696, RegionID: 10000060}, true},
+		{"other region", delve, killFacts{SolarSystemID: 30000142, ConstellationID: 20000020, RegionID: 10000002}, false},
+		{"system unknown", delve, killFacts{}, true},
+		{"region unknown", delve, killFacts{SolarSystemID: 30000142}, true},
+		{"in system", jita, killFacts{SolarSystemID: 30000142}, true},
+		{"other system", jita, killFacts{SolarSystemID: 30004759}, false},
+	}
+
+	for _, test := range tests {
+		if test.filter.passes(&test.facts) != test.passes {
+			t.Logf("%v: expected passes to be %v", test.name, test.passes)
+			t.Fail()
+		}
+	}
+}
+
+func TestSpaceFilter(t *testing.T) {
+	bot := testBot()
+	bot.universe = fakeUniverse()
+
+	subData := &subscriptionData{}
+	err := bot.parseTrackFilters("100 --space LS, nullsec", subData)
+	if err != nil || len(subData.Space) != 2 || subData.spaceText() != "lowsec,nullsec" {
+		t.Logf("Expected lowsec and nullsec, got %v: %v", subData.Space, err)
+		t.Fail()
+	}
+	if err = bot.parseTrackFilters("100 --space nowhere", &subscriptionData{}); err == nil {
+		t.Logf("Expected unknown space to fail")
+		t.Fail()
+	}
+
+	// Space is looked up from the killmail's solar system
+	channels := map[string]*killMatch{"chan-a": {Subs: []*subscriptionData{subData}}}
+	jita := &enrichedKill{SolarSystemID: 30000142}
+	facts := bot.killFacts(KillSummary{KillID: 1}, jita, channels)
+	if facts.Space != spaceHighsec || channels["chan-a"].passing(facts) != nil {
+		t.Logf("Highsec kill should be filtered out, got %+v", facts)
+		t.Fail()
+	}
+	delve := &enrichedKill{SolarSystemID: 30004759}
+	facts = bot.killFacts(KillSummary{KillID: 2}, delve, channels)
+	if facts.Space != spaceNullsec || channels["chan-a"].passing(facts) == nil {
+		t.Logf("Nullsec kill should pass, got %+v", facts)
+		t.Fail()
+	}
+
+	// Unknown locations pass
+	if channels["chan-a"].passing(&killFacts{}) == nil {
+		t.Logf("Kill without a known location should pass")
+		t.Fail()
+	}
+}
+
+func TestParseAttackerRange(t *testing.T) {
+	tests := []struct {
+		text string
+		min  int
+		max  int
+	}{
+		{"solo", 1, 1},
+		{"Small", 2, 10},
+		{"small-gang", 2, 10},
+		{"fleet", 11, 0},
+		{"5", 5, 5},
+		{"2-10", 2, 10},
+		{"10+", 10, 0},
+	}
+	for _, test := range tests {
+		attackers, err := parseAttackerRange(test.text)
+		if err != nil || attackers.Min != test.min || attackers.Max != test.max {
+			t.Logf("Expected %v to be %v-%v, got %+v: %v", test.text, test.min, test.max, attackers, err)
+			t.Fail()
+		}
+	}
+
+	for _, text := range []string{"blob", "0", "10-2", "-5", "a+"} {
+		if _, err := parseAttackerRange(text); err == nil {
+			t.Logf("Expected %v to fail", text)
+			t.Fail()
+		}
+	}
+}
+
+func TestAttackerFilters(t *testing.T) {
+	bot := testBot()
+	bot.universe = fakeUniverse()
+
+	subData := &subscriptionData{}
+	err := bot.parseTrackFilters("100 --attackers small --no-npc", subData)
+	if err != nil || subData.Attackers == nil || !subData.NoNPC || subData.filterText() != "attackers: small, no npc" {
+		t.Fatalf("Unexpected filters %+v: %v", subData, err)
+	}
+	subData.DiscordChannelID, subData.EveID = "chan-a", 100
+	bot.dataStorage.addSubscription(subData)
+
+	// Kills of the tracked victim
+	attackers := func(IDs ...int32) *enrichedKill {
+		kill := &enrichedKill{}
+		kill.Killmail.Victim.CharacterId = 100
+		for _, ID := range IDs {
+			kill.Killmail.Attackers = append(kill.Killmail.Attackers, esi.GetKillmailsKillmailIdKillmailHashAttacker{CharacterId: ID, CorporationId: 98000001})
+		}
+		return kill
+	}
+
+	tests := []struct {
+		name     string
+		kill     KillSummary
+		killmail *enrichedKill
+		passes   bool
+	}{
+		{"solo", KillSummary{}, attackers(90000001), false},
+		{"small gang", KillSummary{}, attackers(90000001, 90000002, 90000003), true},
+		{"attackers unknown", KillSummary{CharacterID: 100}, nil, true},
+		{"npc flagged by zkillboard", KillSummary{CharacterID: 100, Zkb: ZkbData{NPC: true}}, nil, false},
+		{"npc only", KillSummary{}, &enrichedKill{Killmail: esi.GetKillmailsKillmailIdKillmailHashOk{Victim: esi.GetKillmailsKillmailIdKillmailHashVictim{CharacterId: 100}, Attackers: []esi.GetKillmailsKillmailIdKillmailHashAttacker{{CorporationId: 1000125, ShipTypeId: 34495}, {FactionId: 500021}}}}, false},
+	}
+	for _, test := range tests {
+		if (routedMatch(bot, test.kill, test.killmail, "chan-a") != nil) != test.passes {
+			t.Logf("%v: expected passes to be %v", test.name, test.passes)
+			t.Fail()
+		}
+	}
+}
+
+// routedMatch matches and filters a kill the way the kill workers do, returning what's delivered to the channel, nil if nothing is
+func routedMatch(bot *ZKillBot, kill KillSummary, enriched *enrichedKill, channelID string) *killMatch {
+	routed := bot.matchKill(kill, enriched)
+	match, ok := routed.Channels[channelID]
+	if !ok {
+		return nil
+	}
+	return match.passing(bot.killFacts(kill, enriched, routed.Channels))
+}
+
+func TestKillMatch_passingLoss(t *testing.T) {
+	victim := &subscriptionData{DiscordChannelID: "chan-a", EveID: 100, MinVal: 1000000000}
+	attacker := &subscriptionData{DiscordChannelID: "chan-a", EveID: 200}
+	dataStorage := DataStorage{
+		SubMap: map[int]map[string]*subscriptionData{
+			100: {"chan-a": victim},
+			200: {"chan-a": attacker},
+		},
+	}
+	match := dataStorage.subscriptionsForKill([]int{100}, []int{200})["chan-a"]
+
+	// The victim's subscription filters out the cheap kill, so the channel gets it as a kill of its attacker
+	passing := match.passing(&killFacts{Value: 10000000})
+	if passing == nil || passing.Loss || len(passing.Subs) != 1 {
+		t.Logf("Expected a kill for the attacker only, got %+v", passing)
+		t.Fail()
+	}
+	passing = match.passing(&killFacts{Value: 2000000000})
+	if passing == nil || !passing.Loss || len(passing.Subs) != 2 {
+		t.Logf("Expected a loss for both subscriptions, got %+v", passing)
+		t.Fail()
+	}
+}
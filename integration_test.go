@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// fakeZKillboard is an in-process zKillboard, the websocket is served at /websocket/ and the API at /api/.
+//
+// Every sub and unsub is sent on actions, connected is signalled once a connection subscribes to public.
+type fakeZKillboard struct {
+	server *httptest.Server
+
+	actions   chan map[string]string
+	connected chan struct{}
+
+	mux  sync.Mutex
+	conn *websocket.Conn
+	// Kill values returned by the API, kills without a value are unknown
+	values map[int]float64
+}
+
+func newFakeZKillboard(t *testing.T) *fakeZKillboard {
+	zkill := &fakeZKillboard{
+		actions:   make(chan map[string]string, 100),
+		connected: make(chan struct{}, 10),
+		values:    make(map[int]float64),
+	}
+	upgrader := websocket.Upgrader{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/websocket/", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Logf("Upgrade failed: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		zkill.mux.Lock()
+		zkill.conn = conn
+		zkill.mux.Unlock()
+
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			action := map[string]string{}
+			json.Unmarshal(message, &action)
+			if action["channel"] == "public" {
+				zkill.connected <- struct{}{}
+				continue
+			}
+			zkill.actions <- action
+		}
+	})
+	mux.HandleFunc("/api/killID/", func(w http.ResponseWriter, r *http.Request) {
+		var killID int
+		fmt.Sscanf(strings.TrimPrefix(r.URL.Path, "/api/killID/"), "%d/", &killID)
+
+		zkill.mux.Lock()
+		value, ok := zkill.values[killID]
+		zkill.mux.Unlock()
+		if !ok {
+			w.Write([]byte(`[]`))
+			return
+		}
+		// No hash, so the bot doesn't ask ESI for the full killmail
+		fmt.Fprintf(w, `[{"killmail_id":%v,"zkb":{"totalValue":%v}}]`, killID, value)
+	})
+	zkill.server = httptest.NewServer(mux)
+
+	return zkill
+}
+
+// url returns the websocket url
+func (zkill *fakeZKillboard) url() string {
+	return "ws" + strings.TrimPrefix(zkill.server.URL, "http") + "/websocket/"
+}
+
+// kill sends a littlekill for a victim character on the current connection, valued at value by the API
+func (zkill *fakeZKillboard) kill(t *testing.T, killID int, characterID int, value float64) {
+	zkill.mux.Lock()
+	defer zkill.mux.Unlock()
+
+	zkill.values[killID] = value
+	payload := fmt.Sprintf(`{"action":"littlekill","killID":%v,"character_id":%v,"url":"https://zkillboard.com/kill/%v/"}`, killID, characterID, killID)
+	err := zkill.conn.WriteMessage(websocket.TextMessage, []byte(payload))
+	if err != nil {
+		t.Fatalf("Failed to send kill %v: %v", killID, err)
+	}
+}
+
+// drop closes the current connection without a close handshake
+func (zkill *fakeZKillboard) drop() {
+	zkill.mux.Lock()
+	defer zkill.mux.Unlock()
+
+	zkill.conn.Close()
+}
+
+// waitConnected waits for a connection to subscribe to public
+func (zkill *fakeZKillboard) waitConnected(t *testing.T) {
+	select {
+	case <-zkill.connected:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the kill feed to connect")
+	}
+}
+
+// waitAction waits for the next sub or unsub
+func (zkill *fakeZKillboard) waitAction(t *testing.T, action string, channel string) {
+	select {
+	case got := <-zkill.actions:
+		if got["action"] != action || got["channel"] != channel {
+			t.Logf("Expected %v to %v, got %v", action, channel, got)
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for %v to %v", action, channel)
+	}
+}
+
+// testHarness runs a bot from a temp dir against a fakeDiscord and a fakeZKillboard.
+// stop shuts the bot down, waits for it and removes the temp dir, it must be deferred and can be called early.
+func testHarness(t *testing.T) (bot *ZKillBot, discord *fakeDiscord, zkill *fakeZKillboard, stop func()) {
+	cleanup := inTempDir(t)
+	zkill = newFakeZKillboard(t)
+	discord = newFakeDiscord()
+	names := &fakeNameLookup{}
+
+	bot = testBot()
+	bot.discord = testSession("bot")
+	bot.sender = discord
+	bot.viperConfig.Set("zkillboard_api_url", zkill.server.URL+"/api/")
+	bot.httpClient = zkill.server.Client()
+	bot.names = newNameResolver(names.lookup, time.Hour, "names.json")
+	bot.universe = fakeUniverse()
+	bot.seen, _ = NewKillDeduper(time.Hour, 100, "")
+	bot.kills = NewWebsocketSource(zkill.url(), log.StandardLogger())
+	bot.outbox = NewOutbox(bot.discordSend, 10, 1, 0, log.StandardLogger())
+	bot.pool = NewKillPool(2, bot.routeKill, bot.buildDeliveries, bot.sendKill, log.StandardLogger())
+	bot.commands = NewCommandRouter("!", nil, log.StandardLogger())
+	bot.registerCommands()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sourceDone := make(chan struct{})
+	bot.goRun(func() {
+		defer close(sourceDone)
+		bot.kills.Start(ctx)
+	})
+	bot.commands.Start(ctx, &bot.wg)
+	bot.pool.Start(ctx, bot.kills.Kills(), sourceDone, &bot.wg)
+	zkill.waitConnected(t)
+
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			cancel()
+			err := bot.Shutdown(5 * time.Second)
+			if err != nil {
+				t.Logf("Shutdown failed: %v", err)
+				t.Fail()
+			}
+			zkill.server.Close()
+			cleanup()
+		})
+	}
+
+	return bot, discord, zkill, stop
+}
+
+// sendCommand sends a text command to a channel as if typed by a guild member
+func sendCommand(bot *ZKillBot, channelID string, content string) {
+	bot.discordReceive(bot.discord, &discordgo.MessageCreate{Message: &discordgo.Message{
+		GuildID:   "guild",
+		ChannelID: channelID,
+		Content:   content,
+		Author:    &discordgo.User{ID: "user"},
+		Member:    &discordgo.Member{},
+	}})
+}
+
+// expectReply waits for the next discord message and checks it went to channelID and contains text
+func expectReply(t *testing.T, discord *fakeDiscord, channelID string, text string) {
+	message := discord.next(t)
+	if message.ChannelID != channelID || !strings.Contains(message.Content, text) {
+		t.Logf("Expected %q in channel %v, got %q in channel %v", text, channelID, message.Content, message.ChannelID)
+		t.Fail()
+	}
+}
+
+func TestIntegration_TrackAndRoute(t *testing.T) {
+	bot, discord, zkill, stop := testHarness(t)
+	defer stop()
+	discord.permissions = discordgo.PermissionManageChannels
+
+	// Two channels track the same character, one with a minimum value
+	sendCommand(bot, "chan-a", "!track 100")
+	zkill.waitAction(t, "sub", "character:100")
+	expectReply(t, discord, "chan-a", "Eve ID: 100 (character: Name) added")
+	sendCommand(bot, "chan-b", "!track 100 1000000000")
+	expectReply(t, discord, "chan-b", "Eve ID: 100 (character: Name) added")
+	sendCommand(bot, "chan-c", "!track 200")
+	zkill.waitAction(t, "sub", "character:200")
+	expectReply(t, discord, "chan-c", "Eve ID: 200 (character: Name) added")
+
+	// Messages from the bot itself are ignored
+	bot.discordReceive(bot.discord, &discordgo.MessageCreate{Message: &discordgo.Message{
+		ChannelID: "chan-a",
+		Content:   "!track 300",
+		Author:    &discordgo.User{ID: "bot"},
+	}})
+
+	// Cheap kill of 100, an untracked kill, then an expensive kill of 100
+	zkill.kill(t, 1, 100, 5000000)
+	zkill.kill(t, 2, 999, 5000000000)
+	zkill.kill(t, 3, 100, 5000000000)
+	// The same kill again, e.g. after a resubscribe
+	zkill.kill(t, 3, 100, 5000000000)
+	for i := 0; i < 3; i++ {
+		discord.next(t)
+	}
+	stop()
+
+	expected := map[string][]string{
+		"chan-a": {"https://zkillboard.com/kill/1/", "https://zkillboard.com/kill/3/"},
+		"chan-b": {"https://zkillboard.com/kill/3/"},
+		"chan-c": nil,
+	}
+	for channelID, kills := range expected {
+		// Skip the reply to !track
+		got := discord.channelMessages(channelID)[1:]
+		if strings.Join(got, " ") != strings.Join(kills, " ") {
+			t.Logf("Expected %v in channel %v, got %v", kills, channelID, got)
+			t.Fail()
+		}
+	}
+}
+
+func TestIntegration_TrackDenied(t *testing.T) {
+	bot, discord, _, stop := testHarness(t)
+	defer stop()
+
+	// No manage channels permission
+	sendCommand(bot, "chan-a", "!track 100")
+	expectReply(t, discord, "chan-a", "permission")
+
+	// Listing stays open to everyone
+	sendCommand(bot, "chan-a", "!track list")
+	discord.next(t)
+	stop()
+
+	if len(bot.dataStorage.SubMap) != 0 {
+		t.Logf("Denied track should not add a subscription, got %v", bot.dataStorage.SubMap)
+		t.Fail()
+	}
+}
+
+func TestIntegration_Reconnect(t *testing.T) {
+	bot, discord, zkill, stop := testHarness(t)
+	defer stop()
+	discord.permissions = discordgo.PermissionManageChannels
+
+	sendCommand(bot, "chan-a", "!track 100")
+	zkill.waitAction(t, "sub", "character:100")
+	expectReply(t, discord, "chan-a", "added")
+
+	zkill.kill(t, 1, 100, 5000000)
+	expectReply(t, discord, "chan-a", "https://zkillboard.com/kill/1/")
+
+	// Subscriptions are replayed on the new connection
+	zkill.drop()
+	zkill.waitAction(t, "sub", "character:100")
+	zkill.waitConnected(t)
+
+	// Kills already sent before the drop aren't sent again
+	zkill.kill(t, 1, 100, 5000000)
+	zkill.kill(t, 2, 100, 5000000)
+	expectReply(t, discord, "chan-a", "https://zkillboard.com/kill/2/")
+
+	// Removing the last channel unsubscribes
+	sendCommand(bot, "chan-a", "!track remove 100")
+	zkill.waitAction(t, "unsub", "character:100")
+	expectReply(t, discord, "chan-a", "100")
+}
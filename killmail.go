@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/antihax/goesi/esi"
+	"github.com/bwmarrin/discordgo"
+)
+
+// enrichedKill is a kill from the zkillboard websocket combined with the full killmail from ESI and the names of everything involved
+type enrichedKill struct {
+	Summary  KillSummary
+	Killmail esi.GetKillmailsKillmailIdKillmailHashOk
+
+	// Location of the kill
+	SolarSystemID   int32
+	ConstellationID int32
+	RegionID        int32
+
+	// Final blow attacker, nil if ESI did not flag one
+	FinalBlow *esi.GetKillmailsKillmailIdKillmailHashAttacker
+
+	// ID -> Name for every ID above
+	Names map[int32]string
+}
+
+// fetchKillmail fetches the full killmail from ESI
+//
+// kill.Zkb.Hash must be set, it's required by ESI to fetch the killmail
+func (bot *ZKillBot) fetchKillmail(kill KillSummary) (*enrichedKill, error) {
+	esiClient := bot.esiClient
+
+	killmail, response, err := esiClient.ESI.KillmailsApi.GetKillmailsKillmailIdKillmailHash(bot.ctx, kill.Zkb.Hash, int32(kill.KillID), nil)
+	if err != nil {
+		return nil, fmt.Errorf("killmail request failed: %v", err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("killmail request failed code: %v", response.StatusCode)
+	}
+
+	enriched := &enrichedKill{
+		Summary:       kill,
+		Killmail:      killmail,
+		SolarSystemID: killmail.SolarSystemId,
+		Names:         make(map[int32]string),
+	}
+
+	// Find the final blow
+	for i := range killmail.Attackers {
+		if killmail.Attackers[i].FinalBlow {
+			enriched.FinalBlow = &killmail.Attackers[i]
+			break
+		}
+	}
+
+	return enriched, nil
+}
+
+// resolveKillNames resolves the location and the names of the victim, final blow attacker, ship and location
+func (bot *ZKillBot) resolveKillNames(kill *enrichedKill) error {
+	// Walk up from solar system to region
+	system, err := bot.universe.System(bot.ctx, kill.SolarSystemID)
+	if err != nil {
+		return fmt.Errorf("location request failed: %v", err)
+	}
+	kill.ConstellationID = system.ConstellationID
+	kill.RegionID = system.RegionID
+
+	// Resolve every name in one request
+	victim := kill.Killmail.Victim
+	IDs := []int32{victim.CharacterId, victim.CorporationId, victim.AllianceId, victim.ShipTypeId, kill.SolarSystemID, kill.RegionID}
+	if kill.FinalBlow != nil {
+		IDs = append(IDs, kill.FinalBlow.CharacterId, kill.FinalBlow.CorporationId, kill.FinalBlow.ShipTypeId)
+	}
+	names, err := bot.names.Resolve(bot.ctx, IDs)
+	if err != nil {
+		return fmt.Errorf("name request failed: %v", err)
+	}
+	for ID, name := range names {
+		kill.Names[ID] = name.Name
+	}
+
+	return nil
+}
+
+// participants returns the character, corporation, alliance and ship IDs of the victim and of all attackers
+func (kill *enrichedKill) participants() (victimIDs []int, attackerIDs []int) {
+	victim := kill.Killmail.Victim
+	victimIDs = []int{int(victim.CharacterId), int(victim.CorporationId), int(victim.AllianceId), int(victim.ShipTypeId)}
+
+	for _, attacker := range kill.Killmail.Attackers {
+		attackerIDs = append(attackerIDs, int(attacker.CharacterId), int(attacker.CorporationId), int(attacker.AllianceId), int(attacker.ShipTypeId))
+	}
+
+	return victimIDs, attackerIDs
+}
+
+// uniqueIDs removes zero and duplicate IDs, ESI rejects both
+func uniqueIDs(IDs []int32) []int32 {
+	var unique []int32
+	seen := make(map[int32]bool)
+	for _, ID := range IDs {
+		if ID != 0 && !seen[ID] {
+			seen[ID] = true
+			unique = append(unique, ID)
+		}
+	}
+	return unique
+}
+
+// name returns the resolved name for an ID, falling back to the ID itself
+func (kill *enrichedKill) name(ID int32) string {
+	if name, ok := kill.Names[ID]; ok {
+		return name
+	}
+	return fmt.Sprintf("%v", ID)
+}
+
+// killEmbed builds the discord message embed for a kill
+//
+// loss colors the embed red when the channel's tracked entity was the victim, otherwise green
+func killEmbed(kill *enrichedKill, loss bool) *discordgo.MessageEmbed {
+	victim := kill.Killmail.Victim
+
+	// Victim with corp and optionally alliance
+	victimLines := []string{
+		fmt.Sprintf("[%v](https://zkillboard.com/corporation/%v/)", kill.name(victim.CorporationId), victim.CorporationId),
+	}
+	if victim.CharacterId != 0 {
+		victimLines = append([]string{fmt.Sprintf("[%v](https://zkillboard.com/character/%v/)", kill.name(victim.CharacterId), victim.CharacterId)}, victimLines...)
+	}
+	if victim.AllianceId != 0 {
+		victimLines = append(victimLines, fmt.Sprintf("[%v](https://zkillboard.com/alliance/%v/)", kill.name(victim.AllianceId), victim.AllianceId))
+	}
+
+	// Final blow, may be an NPC without a character
+	finalBlow := "Unknown"
+	if kill.FinalBlow != nil {
+		if kill.FinalBlow.CharacterId != 0 {
+			finalBlow = fmt.Sprintf("[%v](https://zkillboard.com/character/%v/) (%v)\n%v", kill.name(kill.FinalBlow.CharacterId), kill.FinalBlow.CharacterId, kill.name(kill.FinalBlow.CorporationId), kill.name(kill.FinalBlow.ShipTypeId))
+		} else {
+			finalBlow = kill.name(kill.FinalBlow.ShipTypeId)
+		}
+	}
+
+	// Structures and deployables have no pilot
+	victimName := kill.name(victim.CorporationId)
+	if victim.CharacterId != 0 {
+		victimName = kill.name(victim.CharacterId)
+	}
+
+	url := kill.Summary.URL
+	if len(url) == 0 {
+		url = fmt.Sprintf("https://zkillboard.com/kill/%v/", kill.Summary.KillID)
+	}
+
+	embed := &discordgo.MessageEmbed{
+		Title:     fmt.Sprintf("%v lost a %v", victimName, kill.name(victim.ShipTypeId)),
+		URL:       url,
+		Color:     0x6AA84F,
+		Timestamp: kill.Killmail.KillmailTime.Format(time.RFC3339),
+		Thumbnail: &discordgo.MessageEmbedThumbnail{
+			URL: fmt.Sprintf("https://images.evetech.net/types/%v/render?size=128", victim.ShipTypeId),
+		},
+		Fields: []*discordgo.MessageEmbedField{
+			{
+				Name:   "Victim",
+				Value:  strings.Join(victimLines, "\n"),
+				Inline: true,
+			},
+			{
+				Name:   "Ship",
+				Value:  kill.name(victim.ShipTypeId),
+				Inline: true,
+			},
+			{
+				Name:   "Location",
+				Value:  fmt.Sprintf("%v (%v)", kill.name(kill.SolarSystemID), kill.name(kill.RegionID)),
+				Inline: true,
+			},
+			{
+				Name:   "Value",
+				Value:  formatISK(kill.Summary.Zkb.TotalValue),
+				Inline: true,
+			},
+			{
+				Name:   "Final Blow",
+				Value:  finalBlow,
+				Inline: true,
+			},
+			{
+				Name:   "Attackers",
+				Value:  fmt.Sprintf("%v", len(kill.Killmail.Attackers)),
+				Inline: true,
+			},
+		},
+	}
+
+	if loss {
+		embed.Color = 0xCC0000
+	}
+
+	if kill.Summary.Backfilled {
+		embed.Footer = &discordgo.MessageEmbedFooter{Text: "Backfilled, missed while the kill feed was down"}
+	}
+
+	// Portrait of the victim if there is one
+	if victim.CharacterId != 0 {
+		embed.Author = &discordgo.MessageEmbedAuthor{
+			Name:    victimName,
+			URL:     fmt.Sprintf("https://zkillboard.com/character/%v/", victim.CharacterId),
+			IconURL: fmt.Sprintf("https://images.evetech.net/characters/%v/portrait?size=64", victim.CharacterId),
+		}
+	}
+
+	return embed
+}
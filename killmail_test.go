@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/antihax/goesi/esi"
+)
+
+func testEnrichedKill() *enrichedKill {
+	return &enrichedKill{
+		Summary: KillSummary{
+			KillID: 72223640,
+			URL:    "https://zkillboard.com/kill/72223640/",
+			Zkb:    ZkbData{TotalValue: 1500000000},
+		},
+		Killmail: esi.GetKillmailsKillmailIdKillmailHashOk{
+			KillmailId:    72223640,
+			KillmailTime:  time.Date(2018, 9, 1, 12, 0, 0, 0, time.UTC),
+			SolarSystemId: 30004759,
+			Victim: esi.GetKillmailsKillmailIdKillmailHashVictim{
+				CharacterId:   90000001,
+				CorporationId: 98000001,
+				ShipTypeId:    17738,
+			},
+			Attackers: []esi.GetKillmailsKillmailIdKillmailHashAttacker{
+				{CharacterId: 90000002, CorporationId: 98000002, ShipTypeId: 11978},
+				{CharacterId: 90000003, CorporationId: 98000002, ShipTypeId: 11978, FinalBlow: true},
+			},
+		},
+		SolarSystemID: 30004759,
+		RegionID:      10000060,
+		Names: map[int32]string{
+			90000001: "Victim Pilot",
+			98000001: "Victim Corp",
+			17738:    "Machariel",
+			90000003: "Final Blow Pilot",
+			98000002: "Attacker Corp",
+			11978:    "Scimitar",
+			30004759: "1DQ1-A",
+			10000060: "Delve",
+		},
+	}
+}
+
+func TestKillEmbed(t *testing.T) {
+	kill := testEnrichedKill()
+	kill.FinalBlow = &kill.Killmail.Attackers[1]
+
+	embed := killEmbed(kill, true)
+
+	if embed.Title != "Victim Pilot lost a Machariel" {
+		t.Logf("Unexpected embed title: %v", embed.Title)
+		t.Fail()
+	}
+	if embed.Color != 0xCC0000 {
+		t.Logf("Loss embed should be red, but was %x", embed.Color)
+		t.Fail()
+	}
+	if killEmbed(kill, false).Color != 0x6AA84F {
+		t.Logf("Kill embed should be green")
+		t.Fail()
+	}
+	if embed.Timestamp != "2018-09-01T12:00:00Z" {
+		t.Logf("Unexpected embed timestamp: %v", embed.Timestamp)
+		t.Fail()
+	}
+	if embed.Thumbnail == nil || !strings.Contains(embed.Thumbnail.URL, "17738") {
+		t.Logf("Embed thumbnail should be the victim's ship render")
+		t.Fail()
+	}
+
+	// Collect fields by name
+	fields := make(map[string]string)
+	for _, field := range embed.Fields {
+		fields[field.Name] = field.Value
+	}
+	if fields["Location"] != "1DQ1-A (Delve)" {
+		t.Logf("Unexpected location field: %v", fields["Location"])
+		t.Fail()
+	}
+	if fields["Value"] != "1.50b ISK" {
+		t.Logf("Unexpected value field: %v", fields["Value"])
+		t.Fail()
+	}
+	if fields["Attackers"] != "2" {
+		t.Logf("Unexpected attackers field: %v", fields["Attackers"])
+		t.Fail()
+	}
+	if !strings.Contains(fields["Final Blow"], "Final Blow Pilot") {
+		t.Logf("Unexpected final blow field: %v", fields["Final Blow"])
+		t.Fail()
+	}
+}
+
+func TestEnrichedKill_participants(t *testing.T) {
+	victimIDs, attackerIDs := testEnrichedKill().participants()
+
+	if victimIDs[0] != 90000001 || victimIDs[3] != 17738 {
+		t.Logf("Unexpected victim IDs: %v", victimIDs)
+		t.Fail()
+	}
+	if len(attackerIDs) != 8 {
+		t.Logf("Expected 4 IDs for each of the 2 attackers, but got %v", attackerIDs)
+		t.Fail()
+	}
+}
+
+func TestUniqueIDs(t *testing.T) {
+	IDs := uniqueIDs([]int32{1, 0, 2, 1, 0, 3})
+
+	if len(IDs) != 3 {
+		t.Logf("Expected 3 unique non-zero IDs, but got %v", IDs)
+		t.Fail()
+	}
+}
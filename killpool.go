@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// killPoolQueueSize is how many kills may be in the pool, from being received to being sent, before receiving blocks
+const killPoolQueueSize = 100
+
+// killPoolRouteWait is how long later kills wait for an earlier kill to be routed, normally a few ESI and zKillboard
+// requests, before they are released to their channels without it
+const killPoolRouteWait = 2 * time.Second
+
+// killSourceBufferSize is how many kills a kill source holds while the pool is full.
+// The pool does the queueing, this only keeps a short burst from stalling reads of the websocket or RedisQ.
+const killSourceBufferSize = 10
+
+// KillPool processes kills on a bounded number of workers so a slow ESI call only holds up its own kill.
+//
+// Processing is split in two: route finds the discord channels a kill goes to, build makes the deliveries for them.
+// Kills are routed in parallel but released to their channels in the order they arrived, and each channel sends
+// its kills in that order, each as soon as it is built. A kill slow to route holds back the deliveries of later kills,
+// as any channel may be involved in it, but only for routeWait, after that it takes its place in its channels once routed.
+// A kill slow to build only holds back later kills of its own channels.
+//
+// When the context is cancelled workers finish the kills already received and channels send every queued delivery before stopping.
+type KillPool struct {
+	workers   int
+	routeWait time.Duration
+	log       *logrus.Logger
+
+	route func(kill KillSummary) *routedKill
+	build func(routed *routedKill) []killDelivery
+	send  func(delivery killDelivery)
+
+	jobs chan *killJob
+	// Holds a token for every kill in the pool
+	inflight chan struct{}
+
+	mux sync.Mutex
+	// Kills received but not yet released to their channels, in arrival order
+	arrived []*killJob
+	// Kills released to each channel but not yet sent, in arrival order
+	channels map[string][]*killJob
+	stopped  bool
+
+	// Done once every kill in the pool was sent
+	pending sync.WaitGroup
+	// Closed once the pool stopped
+	done chan struct{}
+}
+
+// killJob is a kill on its way through a KillPool
+type killJob struct {
+	kill KillSummary
+
+	// Set once routed, the channels the kill is released to
+	routed   bool
+	channels []string
+	// Stops holding back later kills once routeWait passed, overdue is set when it did
+	timer   *time.Timer
+	overdue bool
+	// Taken out of the arrival order while overdue, it is released as soon as it is routed
+	skipped bool
+	// Channels the kill still has to be sent to
+	remaining int
+
+	// Closed once built, deliveries are keyed by channel and missing for channels that filtered the kill out
+	built      chan struct{}
+	deliveries map[string]killDelivery
+}
+
+// NewKillPool creates a KillPool routing and building kills on workers goroutines, deliveries are passed to send
+func NewKillPool(workers int, route func(kill KillSummary) *routedKill, build func(routed *routedKill) []killDelivery, send func(delivery killDelivery), log *logrus.Logger) *KillPool {
+	if workers < 1 {
+		workers = 1
+	}
+
+	return &KillPool{
+		workers:   workers,
+		routeWait: killPoolRouteWait,
+		log:       log,
+		route:     route,
+		build:     build,
+		send:      send,
+		jobs:      make(chan *killJob, workers),
+		inflight:  make(chan struct{}, killPoolQueueSize),
+		channels:  make(map[string][]*killJob),
+		done:      make(chan struct{}),
+	}
+}
+
+// Start receives kills and runs the workers until the context is cancelled and the pool has drained, wg is done once it stopped.
+// Kills are received until sourceDone is closed, so none the source sends while stopping are lost.
+func (pool *KillPool) Start(cContext context.Context, kills <-chan KillSummary, sourceDone <-chan struct{}, wg *sync.WaitGroup) {
+	log := pool.log
+
+	log.Debugf("Starting %v kill workers", pool.workers)
+	var workers sync.WaitGroup
+	for i := 0; i < pool.workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for job := range pool.jobs {
+				pool.process(job)
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		pool.receive(cContext, kills, sourceDone)
+		close(pool.jobs)
+		workers.Wait()
+
+		// Every kill is released to its channels once the workers stopped, wait for them to be sent
+		pool.mux.Lock()
+		pool.stopped = true
+		pool.mux.Unlock()
+		pool.pending.Wait()
+		close(pool.done)
+		log.Debugf("Exited kill pool threads")
+	}()
+}
+
+// receive hands kills to the workers until the context is cancelled, then until the source stopped
+func (pool *KillPool) receive(cContext context.Context, kills <-chan KillSummary, sourceDone <-chan struct{}) {
+	for {
+		select {
+		// cancel cleanly
+		case <-cContext.Done():
+			receiveKills(kills, sourceDone, pool.add)
+			return
+		case kill := <-kills:
+			pool.add(kill)
+		}
+	}
+}
+
+// add queues a received kill for the workers, its place in the arrival order is taken here
+func (pool *KillPool) add(kill KillSummary) {
+	pool.inflight <- struct{}{}
+
+	job := &killJob{kill: kill, built: make(chan struct{})}
+	pool.mux.Lock()
+	pool.pending.Add(1)
+	pool.arrived = append(pool.arrived, job)
+	job.timer = time.AfterFunc(pool.routeWait, func() { pool.expire(job) })
+	pool.mux.Unlock()
+
+	pool.jobs <- job
+}
+
+// process routes and builds a kill
+func (pool *KillPool) process(job *killJob) {
+	routed := pool.route(job.kill)
+	var channels []string
+	for channelID := range routed.Channels {
+		channels = append(channels, channelID)
+	}
+	pool.release(job, channels)
+
+	job.deliveries = make(map[string]killDelivery)
+	if len(channels) > 0 {
+		for _, delivery := range pool.build(routed) {
+			job.deliveries[delivery.ChannelID] = delivery
+		}
+	}
+	close(job.built)
+}
+
+// Deliver queues deliveries built outside the pool after every kill already received, blocking while the pool is full.
+// Deliveries are dropped once the pool has stopped, it returns false if they were.
+func (pool *KillPool) Deliver(deliveries []killDelivery) bool {
+	if len(deliveries) == 0 {
+		return true
+	}
+
+	job := &killJob{built: make(chan struct{}), deliveries: make(map[string]killDelivery)}
+	var channels []string
+	for _, delivery := range deliveries {
+		job.deliveries[delivery.ChannelID] = delivery
+		channels = append(channels, delivery.ChannelID)
+	}
+	close(job.built)
+
+	select {
+	case pool.inflight <- struct{}{}:
+	case <-pool.done:
+		pool.log.Warnf("Dropped %v deliveries of kill %v, shutting down", len(deliveries), deliveries[0].KillID)
+		return false
+	}
+
+	pool.mux.Lock()
+	if pool.stopped {
+		pool.mux.Unlock()
+		<-pool.inflight
+		pool.log.Warnf("Dropped %v deliveries of kill %v, shutting down", len(deliveries), deliveries[0].KillID)
+		return false
+	}
+	pool.pending.Add(1)
+	pool.arrived = append(pool.arrived, job)
+	pool.mux.Unlock()
+
+	pool.release(job, channels)
+	return true
+}
+
+// release marks the kill as routed to the channels, then releases every routed kill at the front of the arrival order to its channels
+func (pool *KillPool) release(job *killJob, channels []string) {
+	pool.mux.Lock()
+	defer pool.mux.Unlock()
+
+	if job.timer != nil {
+		job.timer.Stop()
+	}
+	job.routed = true
+	job.channels = channels
+	if job.skipped {
+		pool.log.Infof("Kill %v routed after %v, releasing it behind later kills", job.kill.KillID, pool.routeWait)
+		pool.enqueue(job)
+	}
+	pool.releaseArrived()
+}
+
+// expire stops a kill still routing after routeWait from holding back later kills
+func (pool *KillPool) expire(job *killJob) {
+	pool.mux.Lock()
+	defer pool.mux.Unlock()
+
+	job.overdue = true
+	pool.releaseArrived()
+}
+
+// releaseArrived releases the kills at the front of the arrival order to their channels, skipping overdue kills still routing.
+// Called with the lock held.
+func (pool *KillPool) releaseArrived() {
+	for len(pool.arrived) > 0 && (pool.arrived[0].routed || pool.arrived[0].overdue) {
+		next := pool.arrived[0]
+		pool.arrived = pool.arrived[1:]
+
+		if !next.routed {
+			pool.log.Warnf("Kill %v still routing after %v, no longer holding back later kills", next.kill.KillID, pool.routeWait)
+			next.skipped = true
+			continue
+		}
+		pool.enqueue(next)
+	}
+}
+
+// enqueue adds a routed kill to the back of its channels' queues, called with the lock held
+func (pool *KillPool) enqueue(job *killJob) {
+	if len(job.channels) == 0 {
+		pool.finish(job)
+		return
+	}
+	job.remaining = len(job.channels)
+	for _, channelID := range job.channels {
+		queue := pool.channels[channelID]
+		pool.channels[channelID] = append(queue, job)
+		// A channel only has a sending thread while it has kills queued
+		if len(queue) == 0 {
+			go pool.sendChannel(channelID)
+		}
+	}
+}
+
+// sendChannel sends a channel's kills in order, each once it is built, until the channel has none left
+func (pool *KillPool) sendChannel(channelID string) {
+	for {
+		pool.mux.Lock()
+		job := pool.channels[channelID][0]
+		pool.mux.Unlock()
+
+		<-job.built
+		if delivery, ok := job.deliveries[channelID]; ok {
+			pool.send(delivery)
+		}
+
+		pool.mux.Lock()
+		queue := pool.channels[channelID][1:]
+		if len(queue) == 0 {
+			delete(pool.channels, channelID)
+		} else {
+			pool.channels[channelID] = queue
+		}
+		job.remaining--
+		if job.remaining == 0 {
+			pool.finish(job)
+		}
+		pool.mux.Unlock()
+
+		if len(queue) == 0 {
+			return
+		}
+	}
+}
+
+// finish takes a kill that was sent to all its channels out of the pool, called with the lock held
+func (pool *KillPool) finish(job *killJob) {
+	<-pool.inflight
+	pool.pending.Done()
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// testRoute routes each kill to the channels listed for it
+func testRoute(channels map[int][]string) func(kill KillSummary) *routedKill {
+	return func(kill KillSummary) *routedKill {
+		routed := &routedKill{Kill: kill, Channels: make(map[string]*killMatch)}
+		for _, channelID := range channels[kill.KillID] {
+			routed.Channels[channelID] = &killMatch{}
+		}
+		return routed
+	}
+}
+
+// stoppedSource is closed, the kill source of a pool that is only fed by the test
+func stoppedSource() <-chan struct{} {
+	sourceDone := make(chan struct{})
+	close(sourceDone)
+	return sourceDone
+}
+
+// testBuild builds a delivery for every routed channel
+func testBuild(routed *routedKill) []killDelivery {
+	var deliveries []killDelivery
+	for channelID := range routed.Channels {
+		deliveries = append(deliveries, killDelivery{ChannelID: channelID, KillID: routed.Kill.KillID})
+	}
+	return deliveries
+}
+
+func TestKillPool_SlowKill(t *testing.T) {
+	release := make(chan struct{})
+	sent := make(chan killDelivery, 10)
+
+	// Kill 1 is stuck on a slow lookup
+	route := testRoute(map[int][]string{1: {"chan-a"}, 2: {"chan-b"}})
+	build := func(routed *routedKill) []killDelivery {
+		if routed.Kill.KillID == 1 {
+			<-release
+		}
+		return testBuild(routed)
+	}
+	pool := NewKillPool(2, route, build, func(delivery killDelivery) { sent <- delivery }, log.StandardLogger())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	kills := make(chan KillSummary)
+	pool.Start(ctx, kills, stoppedSource(), &sync.WaitGroup{})
+
+	kills <- KillSummary{KillID: 1}
+	kills <- KillSummary{KillID: 2}
+
+	// Kill 2 isn't held up by kill 1 in another channel
+	select {
+	case delivery := <-sent:
+		if delivery.KillID != 2 {
+			t.Logf("Expected kill 2 first, got %v", delivery.KillID)
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for kill 2")
+	}
+
+	close(release)
+	select {
+	case delivery := <-sent:
+		if delivery.KillID != 1 {
+			t.Logf("Expected kill 1, got %v", delivery.KillID)
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for kill 1")
+	}
+}
+
+func TestKillPool_SlowRoute(t *testing.T) {
+	release := make(chan struct{})
+	sent := make(chan killDelivery, 10)
+
+	// Kill 1 is stuck fetching its killmail
+	routes := testRoute(map[int][]string{1: {"chan-a"}, 2: {"chan-b"}})
+	route := func(kill KillSummary) *routedKill {
+		if kill.KillID == 1 {
+			<-release
+		}
+		return routes(kill)
+	}
+	pool := NewKillPool(2, route, testBuild, func(delivery killDelivery) { sent <- delivery }, log.StandardLogger())
+	pool.routeWait = 50 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	kills := make(chan KillSummary)
+	pool.Start(ctx, kills, stoppedSource(), &sync.WaitGroup{})
+
+	kills <- KillSummary{KillID: 1}
+	kills <- KillSummary{KillID: 2}
+
+	// Kill 2 in another channel only waits routeWait for kill 1
+	select {
+	case delivery := <-sent:
+		if delivery.KillID != 2 {
+			t.Logf("Expected kill 2 first, got %v", delivery.KillID)
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for kill 2")
+	}
+
+	// Kill 1 is still delivered once routed
+	close(release)
+	select {
+	case delivery := <-sent:
+		if delivery.KillID != 1 {
+			t.Logf("Expected kill 1, got %v", delivery.KillID)
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for kill 1")
+	}
+}
+
+func TestKillPool_ChannelOrder(t *testing.T) {
+	var mux sync.Mutex
+	sent := make(map[string][]int)
+	done := make(chan struct{}, 100)
+
+	// Every kill goes to chan-a, even kills to chan-b and odd kills to chan-c
+	routes := make(map[int][]string)
+	for killID := 1; killID <= 30; killID++ {
+		routes[killID] = []string{"chan-a"}
+		if killID%2 == 0 {
+			routes[killID] = append(routes[killID], "chan-b")
+		} else {
+			routes[killID] = append(routes[killID], "chan-c")
+		}
+	}
+	expected := map[string][]int{}
+	for killID := 1; killID <= 30; killID++ {
+		for _, channelID := range routes[killID] {
+			expected[channelID] = append(expected[channelID], killID)
+		}
+	}
+
+	// Processing takes longer for earlier kills, so later kills finish first on the other workers
+	delay := func(killID int) time.Duration {
+		return time.Duration((30-killID)%7) * time.Millisecond
+	}
+	route := testRoute(routes)
+	pool := NewKillPool(4, func(kill KillSummary) *routedKill {
+		time.Sleep(delay(kill.KillID))
+		return route(kill)
+	}, func(routed *routedKill) []killDelivery {
+		time.Sleep(2 * delay(routed.Kill.KillID))
+		return testBuild(routed)
+	}, func(delivery killDelivery) {
+		mux.Lock()
+		sent[delivery.ChannelID] = append(sent[delivery.ChannelID], delivery.KillID)
+		mux.Unlock()
+		done <- struct{}{}
+	}, log.StandardLogger())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	kills := make(chan KillSummary)
+	pool.Start(ctx, kills, stoppedSource(), &sync.WaitGroup{})
+
+	for killID := 1; killID <= 30; killID++ {
+		kills <- KillSummary{KillID: killID}
+	}
+
+	for i := 0; i < 60; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for deliveries")
+		}
+	}
+
+	mux.Lock()
+	defer mux.Unlock()
+	for channelID, killIDs := range expected {
+		if !reflect.DeepEqual(sent[channelID], killIDs) {
+			t.Logf("Channel %v received kills out of order: %v", channelID, sent[channelID])
+			t.Fail()
+		}
+	}
+}
+
+func TestKillPool_Drain(t *testing.T) {
+	var mux sync.Mutex
+	var sent []int
+	send := func(delivery killDelivery) {
+		mux.Lock()
+		sent = append(sent, delivery.KillID)
+		mux.Unlock()
+	}
+	routes := make(map[int][]string)
+	for killID := 1; killID <= 6; killID++ {
+		routes[killID] = []string{"chan-a"}
+	}
+	pool := NewKillPool(2, testRoute(routes), testBuild, send, log.StandardLogger())
+
+	// Kills buffered before cancelling are still delivered
+	kills := make(chan KillSummary, 5)
+	for killID := 1; killID <= 5; killID++ {
+		kills <- KillSummary{KillID: killID}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var wg sync.WaitGroup
+	sourceDone := make(chan struct{})
+	pool.Start(ctx, kills, sourceDone, &wg)
+
+	// Kills the source sends while stopping are delivered too
+	kills <- KillSummary{KillID: 6}
+	close(sourceDone)
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the pool to stop")
+	}
+
+	mux.Lock()
+	defer mux.Unlock()
+	if !reflect.DeepEqual(sent, []int{1, 2, 3, 4, 5, 6}) {
+		t.Logf("Expected 6 kills delivered in order while draining, got %v", sent)
+		t.Fail()
+	}
+
+	// Deliveries after stopping don't block, and are dropped
+	if pool.Deliver([]killDelivery{{ChannelID: "chan-a", KillID: 7}}) {
+		t.Logf("Expected deliveries after stopping to be dropped")
+		t.Fail()
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// KillSourceState is the connection state of a KillSource
+type KillSourceState int
+
+const (
+	// KillSourceStopped is before Start or after its context is cancelled
+	KillSourceStopped KillSourceState = iota
+	// KillSourceConnecting is while the first connection attempt is made
+	KillSourceConnecting
+	// KillSourceConnected is while kills are being received
+	KillSourceConnected
+	// KillSourceBackoff is while waiting to retry a failed connection
+	KillSourceBackoff
+)
+
+// String returns the state name shown in logs and discord
+func (state KillSourceState) String() string {
+	switch state {
+	case KillSourceStopped:
+		return "stopped"
+	case KillSourceConnecting:
+		return "connecting"
+	case KillSourceConnected:
+		return "connected"
+	case KillSourceBackoff:
+		return "backoff"
+	}
+	return fmt.Sprintf("unknown (%d)", int(state))
+}
+
+// ErrKillSourceQueued is returned by Subscribe while disconnected, the subscription is sent once connected
+var ErrKillSourceQueued = errors.New("kill feed is disconnected, subscription will be sent once it reconnects")
+
+// KillSource is a feed of kills from zKillboard.
+//
+// Subscribe and Unsubscribe may be called before Start or while disconnected,
+// a source keeps the set of subscriptions and sends them once connected.
+type KillSource interface {
+	// Start connects and keeps the feed running until ctx is cancelled
+	Start(ctx context.Context)
+	// Subscribe asks the feed for kills involving an eve ID, category is alliance, corporation or character
+	Subscribe(category string, eveID int) error
+	// Unsubscribe stops kills involving an eve ID
+	Unsubscribe(category string, eveID int) error
+	// Kills delivers every kill received, kills read while stopping are still sent so it must be received from until Start returned
+	Kills() <-chan KillSummary
+	// State returns the current connection state
+	State() KillSourceState
+	// LastMessage returns when anything, kill or not, was last received from the feed
+	LastMessage() time.Time
+	// Stats returns connection counters for status reporting
+	Stats() KillSourceStats
+}
+
+// KillSourceStats are the connection counters of a KillSource
+type KillSourceStats struct {
+	// Connected is when the current connection was made, zero while disconnected
+	Connected time.Time
+	// Reconnects counts the connections made after the first
+	Reconnects int
+	// Replayed is how many subscriptions were sent on the last connect
+	Replayed int
+	// MaxBackoff is set while retries wait as long as the backoff allows
+	MaxBackoff bool
+}
+
+// receiveKills passes kills to handle until stopped is closed, then passes on any still buffered.
+// A source stopping may still send the kills it read, stopped is closed once it can't send any more.
+func receiveKills(kills <-chan KillSummary, stopped <-chan struct{}, handle func(kill KillSummary)) {
+	for {
+		select {
+		case kill := <-kills:
+			handle(kill)
+		case <-stopped:
+			for {
+				select {
+				case kill := <-kills:
+					handle(kill)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// killSourceChannel is the zKillboard channel name of a subscription, e.g. alliance:99005338
+func killSourceChannel(category string, eveID int) string {
+	return fmt.Sprintf("%v:%v", category, eveID)
+}
+
+// newKillSource creates the KillSource chosen by kill_source in the config
+//
+// websocket uses the zKillboard websocket, falling back to RedisQ while it is down if redisq_fallback is set.
+// redisq only uses RedisQ.
+func newKillSource(config *viper.Viper, log *logrus.Logger) (KillSource, error) {
+	kind := config.GetString("kill_source")
+	if kind != "websocket" && kind != "redisq" {
+		return nil, fmt.Errorf("unknown kill_source %q, expected websocket or redisq", kind)
+	}
+
+	websocketSource := NewWebsocketSource(config.GetString("zkillboard_ws_url"), log)
+	if kind == "websocket" && !config.GetBool("redisq_fallback") {
+		return websocketSource, nil
+	}
+
+	// RedisQ keeps kills for a queue ID while the bot is offline, so it's reused across restarts.
+	// One set in the config is used as is, otherwise it's generated and kept in a state file.
+	queueID := config.GetString("redisq_queue_id")
+	if len(queueID) == 0 {
+		var err error
+		queueID, err = redisQQueueID(config.GetString("redisq_queue_path"), log)
+		if err != nil {
+			return nil, err
+		}
+	}
+	redisQSource := NewRedisQSource(config.GetString("zkillboard_redisq_url"), queueID, log)
+
+	if kind == "redisq" {
+		return redisQSource, nil
+	}
+	return NewFallbackSource(websocketSource, redisQSource, log), nil
+}
+
+// redisQState is the RedisQ state kept on disk between restarts
+type redisQState struct {
+	QueueID string `json:"queue_id"`
+}
+
+// redisQQueueID returns the RedisQ queue ID saved at path, generating and saving one if there is none.
+// An empty path, or failing to save, generates a new queue ID every start.
+func redisQQueueID(path string, log *logrus.Logger) (string, error) {
+	var state redisQState
+	if len(path) > 0 {
+		data, err := ioutil.ReadFile(path)
+		switch {
+		case err == nil:
+			err = json.Unmarshal(data, &state)
+			if err != nil {
+				return "", fmt.Errorf("failed to read RedisQ queue ID from %v: %v", path, err)
+			}
+			if len(state.QueueID) > 0 {
+				return state.QueueID, nil
+			}
+		case !os.IsNotExist(err):
+			return "", fmt.Errorf("failed to read RedisQ queue ID from %v: %v", path, err)
+		}
+	}
+
+	random := make([]byte, 8)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate a RedisQ queue ID: %v", err)
+	}
+	state.QueueID = "zkillbot-" + hex.EncodeToString(random)
+
+	if len(path) > 0 {
+		data, err := json.Marshal(state)
+		if err != nil {
+			return "", err
+		}
+		err = writeFileAtomic(path, data)
+		if err != nil {
+			log.Warnf("Failed to save RedisQ queue ID %v to %v: %v", state.QueueID, path, err)
+		}
+	}
+	return state.QueueID, nil
+}
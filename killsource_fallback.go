@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// FallbackSource is a KillSource reading from primary, and from fallback while primary is in backoff
+//
+// Both sources are subscribed at all times so the fallback can take over straight away.
+// Kills received by both while switching over are passed on twice.
+type FallbackSource struct {
+	primary  KillSource
+	fallback KillSource
+	log      *logrus.Logger
+	// How often primary's state is checked
+	interval time.Duration
+
+	mux sync.Mutex
+	// Closed once the running fallback has stopped, nil while not running
+	fallbackDone chan struct{}
+
+	kills chan KillSummary
+}
+
+// NewFallbackSource creates a FallbackSource
+func NewFallbackSource(primary KillSource, fallback KillSource, log *logrus.Logger) *FallbackSource {
+	return &FallbackSource{
+		primary:  primary,
+		fallback: fallback,
+		log:      log,
+		interval: time.Second,
+		kills:    make(chan KillSummary, killSourceBufferSize),
+	}
+}
+
+// Kills delivers kills from both sources
+func (source *FallbackSource) Kills() <-chan KillSummary {
+	return source.kills
+}
+
+// State is connected while either source is connected, otherwise the state of primary
+func (source *FallbackSource) State() KillSourceState {
+	state := source.primary.State()
+	if state != KillSourceConnected && source.fallbackRunning() && source.fallback.State() == KillSourceConnected {
+		return KillSourceConnected
+	}
+	return state
+}
+
+// LastMessage returns the latest message received by either source
+func (source *FallbackSource) LastMessage() time.Time {
+	last := source.primary.LastMessage()
+	if fallbackLast := source.fallback.LastMessage(); fallbackLast.After(last) {
+		last = fallbackLast
+	}
+	return last
+}
+
+// Stats returns the counters of primary, while the fallback is receiving kills its connection time is used
+func (source *FallbackSource) Stats() KillSourceStats {
+	stats := source.primary.Stats()
+	if stats.Connected.IsZero() && source.fallbackRunning() {
+		stats.Connected = source.fallback.Stats().Connected
+	}
+	return stats
+}
+
+// fallbackRunning reports if the fallback source has been started
+func (source *FallbackSource) fallbackRunning() bool {
+	source.mux.Lock()
+	defer source.mux.Unlock()
+
+	return source.fallbackDone != nil
+}
+
+// Subscribe subscribes both sources, succeeding if either is receiving kills for the subscription
+func (source *FallbackSource) Subscribe(category string, eveID int) error {
+	fallbackErr := source.fallback.Subscribe(category, eveID)
+	err := source.primary.Subscribe(category, eveID)
+	if err == ErrKillSourceQueued && fallbackErr == nil && source.fallbackRunning() && source.fallback.State() == KillSourceConnected {
+		return nil
+	}
+	return err
+}
+
+// Unsubscribe unsubscribes both sources
+func (source *FallbackSource) Unsubscribe(category string, eveID int) error {
+	source.fallback.Unsubscribe(category, eveID)
+	return source.primary.Unsubscribe(category, eveID)
+}
+
+// Start runs primary until ctx is cancelled, starting and stopping fallback as primary goes in and out of backoff
+func (source *FallbackSource) Start(ctx context.Context) {
+	log := source.log
+
+	// Only return once everything started here has stopped
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	// Kills are forwarded until each source stopped for good
+	primaryDone := make(chan struct{})
+	fallbackStopped := make(chan struct{})
+	for _, run := range []func(){
+		func() {
+			defer close(primaryDone)
+			source.primary.Start(ctx)
+		},
+		func() { source.forward(source.primary.Kills(), primaryDone) },
+		func() { source.forward(source.fallback.Kills(), fallbackStopped) },
+	} {
+		wg.Add(1)
+		go func(run func()) {
+			defer wg.Done()
+			run()
+		}(run)
+	}
+
+	ticker := time.NewTicker(source.interval)
+	defer ticker.Stop()
+
+	var stopFallback context.CancelFunc
+	for {
+		select {
+		case <-ctx.Done():
+			if stopFallback != nil {
+				stopFallback()
+				source.mux.Lock()
+				done := source.fallbackDone
+				source.mux.Unlock()
+				<-done
+			}
+			close(fallbackStopped)
+			return
+		case <-ticker.C:
+		}
+
+		switch source.primary.State() {
+		case KillSourceBackoff:
+			if stopFallback != nil {
+				break
+			}
+			log.Warn("zKillboard websocket unavailable, falling back to RedisQ")
+
+			var fallbackCtx context.Context
+			fallbackCtx, stopFallback = context.WithCancel(ctx)
+			done := make(chan struct{})
+			source.mux.Lock()
+			source.fallbackDone = done
+			source.mux.Unlock()
+
+			go func() {
+				defer close(done)
+				source.fallback.Start(fallbackCtx)
+			}()
+
+		case KillSourceConnected:
+			if stopFallback == nil {
+				break
+			}
+			log.Info("zKillboard websocket reconnected, stopping RedisQ")
+
+			stopFallback()
+			stopFallback = nil
+			source.mux.Lock()
+			done := source.fallbackDone
+			source.fallbackDone = nil
+			source.mux.Unlock()
+			// Start must not be called again until the previous run returned
+			<-done
+		}
+	}
+}
+
+// forward passes kills on to the combined kills channel until the source they come from has stopped
+func (source *FallbackSource) forward(kills <-chan KillSummary, stopped <-chan struct{}) {
+	receiveKills(kills, stopped, func(kill KillSummary) {
+		source.kills <- kill
+	})
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// fakeKillSource is a KillSource with a settable state that records subscriptions
+type fakeKillSource struct {
+	mux         sync.Mutex
+	state       KillSourceState
+	lastMessage time.Time
+	stats       KillSourceStats
+	channels    map[string]bool
+	starts      int
+
+	kills chan KillSummary
+}
+
+func newFakeKillSource() *fakeKillSource {
+	return &fakeKillSource{
+		channels: make(map[string]bool),
+		kills:    make(chan KillSummary, 5),
+	}
+}
+
+func (source *fakeKillSource) Start(ctx context.Context) {
+	source.mux.Lock()
+	source.starts++
+	source.mux.Unlock()
+
+	<-ctx.Done()
+}
+
+func (source *fakeKillSource) Subscribe(category string, eveID int) error {
+	source.mux.Lock()
+	defer source.mux.Unlock()
+
+	source.channels[killSourceChannel(category, eveID)] = true
+	return nil
+}
+
+func (source *fakeKillSource) Unsubscribe(category string, eveID int) error {
+	source.mux.Lock()
+	defer source.mux.Unlock()
+
+	delete(source.channels, killSourceChannel(category, eveID))
+	return nil
+}
+
+func (source *fakeKillSource) Kills() <-chan KillSummary {
+	return source.kills
+}
+
+func (source *fakeKillSource) State() KillSourceState {
+	source.mux.Lock()
+	defer source.mux.Unlock()
+
+	return source.state
+}
+
+func (source *fakeKillSource) LastMessage() time.Time {
+	source.mux.Lock()
+	defer source.mux.Unlock()
+
+	return source.lastMessage
+}
+
+func (source *fakeKillSource) Stats() KillSourceStats {
+	source.mux.Lock()
+	defer source.mux.Unlock()
+
+	return source.stats
+}
+
+func (source *fakeKillSource) setState(state KillSourceState) {
+	source.mux.Lock()
+	defer source.mux.Unlock()
+
+	source.state = state
+}
+
+func TestFallbackSource(t *testing.T) {
+	primary := newFakeKillSource()
+	fallback := newFakeKillSource()
+	source := NewFallbackSource(primary, fallback, log.StandardLogger())
+	source.interval = 10 * time.Millisecond
+
+	// Subscriptions go to both
+	source.Subscribe("alliance", 99005338)
+	if !primary.channels["alliance:99005338"] || !fallback.channels["alliance:99005338"] {
+		t.Logf("Expected both sources to be subscribed")
+		t.Fail()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	primary.setState(KillSourceConnected)
+	go source.Start(ctx)
+
+	// Kills from the primary are forwarded
+	primary.kills <- KillSummary{KillID: 1}
+	select {
+	case kill := <-source.Kills():
+		if kill.KillID != 1 {
+			t.Logf("Unexpected kill: %+v", kill)
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for primary kill")
+	}
+
+	// Fallback only runs while the primary is in backoff
+	waitFor := func(description string, condition func() bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !condition() && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !condition() {
+			t.Logf("Timed out waiting for %v", description)
+			t.Fail()
+		}
+	}
+	primary.setState(KillSourceBackoff)
+	fallback.setState(KillSourceConnected)
+	waitFor("fallback to start", source.fallbackRunning)
+	if source.State() != KillSourceConnected {
+		t.Logf("Expected connected through the fallback, got %v", source.State())
+		t.Fail()
+	}
+
+	fallback.kills <- KillSummary{KillID: 2}
+	select {
+	case kill := <-source.Kills():
+		if kill.KillID != 2 {
+			t.Logf("Unexpected kill: %+v", kill)
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for fallback kill")
+	}
+
+	primary.setState(KillSourceConnected)
+	waitFor("fallback to stop", func() bool { return !source.fallbackRunning() })
+	if fallback.starts != 1 {
+		t.Logf("Expected fallback to be started once, got %v", fallback.starts)
+		t.Fail()
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RedisQSource is a KillSource long-polling zKillboard's RedisQ.
+//
+// RedisQ sends every kill, only the ones involving a subscribed ID are passed on.
+type RedisQSource struct {
+	url     string
+	queueID string
+	client  *http.Client
+	log     *logrus.Logger
+
+	mux         sync.Mutex
+	state       KillSourceState
+	lastMessage time.Time
+	stats       KillSourceStats
+	connects    int
+	// Subscribed eve IDs, categories don't matter as ID ranges don't overlap
+	eveIDs map[int]bool
+
+	kills chan KillSummary
+}
+
+// redisQWait is how long RedisQ holds a poll open waiting for a kill
+const redisQWait = 10 * time.Second
+
+// redisQPackage is the kill returned by a RedisQ poll
+type redisQPackage struct {
+	KillID   int `json:"killID"`
+	Killmail struct {
+		Victim    redisQParticipant   `json:"victim"`
+		Attackers []redisQParticipant `json:"attackers"`
+	} `json:"killmail"`
+	Zkb ZkbData `json:"zkb"`
+}
+
+// redisQParticipant is the victim or an attacker of a killmail
+type redisQParticipant struct {
+	CharacterID   int `json:"character_id"`
+	CorporationID int `json:"corporation_id"`
+	AllianceID    int `json:"alliance_id"`
+	ShipTypeID    int `json:"ship_type_id"`
+}
+
+// NewRedisQSource creates a RedisQSource polling url, e.g. https://zkillredisq.stream/listen.php
+//
+// queueID identifies the bot to RedisQ, it must be unique and stay the same across restarts to not miss kills
+func NewRedisQSource(url string, queueID string, log *logrus.Logger) *RedisQSource {
+	return &RedisQSource{
+		url:     url,
+		queueID: queueID,
+		client: &http.Client{
+			Timeout: redisQWait + 20*time.Second,
+		},
+		log:    log,
+		state:  KillSourceStopped,
+		eveIDs: make(map[int]bool),
+		kills:  make(chan KillSummary, killSourceBufferSize),
+	}
+}
+
+// Kills delivers every kill involving a subscribed ID
+func (source *RedisQSource) Kills() <-chan KillSummary {
+	return source.kills
+}
+
+// State returns the current connection state
+func (source *RedisQSource) State() KillSourceState {
+	source.mux.Lock()
+	defer source.mux.Unlock()
+
+	return source.state
+}
+
+// LastMessage returns when RedisQ last answered a poll
+func (source *RedisQSource) LastMessage() time.Time {
+	source.mux.Lock()
+	defer source.mux.Unlock()
+
+	return source.lastMessage
+}
+
+// Stats returns the connection counters, a connection lasts from the first successful poll until one fails
+func (source *RedisQSource) Stats() KillSourceStats {
+	source.mux.Lock()
+	defer source.mux.Unlock()
+
+	return source.stats
+}
+
+// setState changes the connection state
+func (source *RedisQSource) setState(state KillSourceState) {
+	source.mux.Lock()
+	defer source.mux.Unlock()
+
+	source.state = state
+}
+
+// Subscribe passes on kills involving eveID
+func (source *RedisQSource) Subscribe(category string, eveID int) error {
+	source.mux.Lock()
+	defer source.mux.Unlock()
+
+	source.eveIDs[eveID] = true
+	return nil
+}
+
+// Unsubscribe stops passing on kills involving eveID
+func (source *RedisQSource) Unsubscribe(category string, eveID int) error {
+	source.mux.Lock()
+	defer source.mux.Unlock()
+
+	delete(source.eveIDs, eveID)
+	return nil
+}
+
+// Start polls RedisQ until ctx is cancelled, backing off on errors
+func (source *RedisQSource) Start(ctx context.Context) {
+	log := source.log
+	boff := Backoff{
+		Min:    500 * time.Millisecond,
+		Max:    5 * time.Minute,
+		Factor: 2,
+		Jitter: true,
+	}
+
+	source.setState(KillSourceConnecting)
+	defer source.setState(KillSourceStopped)
+
+	for {
+		pkg, err := source.poll(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			dur := boff.Duration()
+			log.Warnf("RedisQ poll %d failed: %s", boff.Attempts(), err)
+			log.Warnln(" -> retrying in", dur)
+			source.mux.Lock()
+			source.state = KillSourceBackoff
+			source.stats.Connected = time.Time{}
+			source.stats.MaxBackoff = dur == boff.Max
+			source.mux.Unlock()
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(dur):
+			}
+			continue
+		}
+		boff.Reset()
+		source.mux.Lock()
+		source.state = KillSourceConnected
+		source.lastMessage = time.Now()
+		if source.stats.Connected.IsZero() {
+			if source.connects > 0 {
+				source.stats.Reconnects++
+			}
+			source.connects++
+			source.stats.Connected = source.lastMessage
+			source.stats.Replayed = len(source.eveIDs)
+			source.stats.MaxBackoff = false
+		}
+		source.mux.Unlock()
+
+		// RedisQ never hands out a package twice, so one received while shutting down is still sent
+		if pkg != nil && source.matches(pkg) {
+			source.kills <- pkg.summary()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// poll waits for the next kill, returning nil if there was none
+func (source *RedisQSource) poll(ctx context.Context) (*redisQPackage, error) {
+	query := url.Values{}
+	query.Set("queueID", source.queueID)
+	query.Set("ttw", fmt.Sprintf("%d", int(redisQWait/time.Second)))
+
+	request, err := newZKillboardRequest(ctx, source.url+"?"+query.Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := source.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("RedisQ request failed code: %v", response.StatusCode)
+	}
+
+	var body struct {
+		Package *redisQPackage `json:"package"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode RedisQ response: %v", err)
+	}
+
+	return body.Package, nil
+}
+
+// matches reports if a subscribed ID is the victim or one of the attackers
+func (source *RedisQSource) matches(pkg *redisQPackage) bool {
+	source.mux.Lock()
+	defer source.mux.Unlock()
+
+	participants := append([]redisQParticipant{pkg.Killmail.Victim}, pkg.Killmail.Attackers...)
+	for _, participant := range participants {
+		for _, ID := range []int{participant.CharacterID, participant.CorporationID, participant.AllianceID, participant.ShipTypeID} {
+			if ID != 0 && source.eveIDs[ID] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// summary converts the package into the KillSummary sent by the websocket
+func (pkg *redisQPackage) summary() KillSummary {
+	victim := pkg.Killmail.Victim
+
+	return KillSummary{
+		Action:        "littlekill",
+		KillID:        pkg.KillID,
+		CharacterID:   victim.CharacterID,
+		CorporationID: victim.CorporationID,
+		AllianceID:    victim.AllianceID,
+		ShipTypeID:    victim.ShipTypeID,
+		URL:           fmt.Sprintf("https://zkillboard.com/kill/%d/", pkg.KillID),
+		Zkb:           pkg.Zkb,
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestRedisQSource(t *testing.T) {
+	responses := []string{
+		`{"package":null}`,
+		// untracked kill
+		`{"package":{"killID":1,"killmail":{"victim":{"character_id":900},"attackers":[{"character_id":901}]},"zkb":{"hash":"a","totalValue":1000}}}`,
+		// tracked attacker
+		`{"package":{"killID":2,"killmail":{"victim":{"character_id":900,"corporation_id":910,"ship_type_id":670},"attackers":[{"character_id":901},{"corporation_id":300}]},"zkb":{"hash":"b","totalValue":2000}}}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("queueID") != "test-queue" {
+			t.Logf("Unexpected queueID %v", r.URL.Query().Get("queueID"))
+			t.Fail()
+		}
+		if len(responses) == 0 {
+			w.Write([]byte(`{"package":null}`))
+			return
+		}
+		w.Write([]byte(responses[0]))
+		responses = responses[1:]
+	}))
+	defer server.Close()
+
+	source := NewRedisQSource(server.URL, "test-queue", log.StandardLogger())
+	source.Subscribe("corporation", 300)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go source.Start(ctx)
+
+	select {
+	case kill := <-source.Kills():
+		if kill.KillID != 2 || kill.CharacterID != 900 || kill.CorporationID != 910 || kill.ShipTypeID != 670 {
+			t.Logf("Unexpected kill: %+v", kill)
+			t.Fail()
+		}
+		if kill.Zkb.Hash != "b" || kill.Zkb.TotalValue != 2000 || kill.URL != "https://zkillboard.com/kill/2/" {
+			t.Logf("Unexpected kill zkb or url: %+v", kill)
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for kill")
+	}
+	if source.State() != KillSourceConnected {
+		t.Logf("Expected state connected, got %v", source.State())
+		t.Fail()
+	}
+}
+
+func TestRedisQSource_Stopping(t *testing.T) {
+	var mux sync.Mutex
+	handedOut := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		handedOut++
+		killID := handedOut
+		mux.Unlock()
+		fmt.Fprintf(w, `{"package":{"killID":%v,"killmail":{"victim":{"character_id":100}},"zkb":{"hash":"a"}}}`, killID)
+	}))
+	defer server.Close()
+
+	source := NewRedisQSource(server.URL, "test-queue", log.StandardLogger())
+	source.Subscribe("character", 100)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		source.Start(ctx)
+	}()
+
+	// Nothing receives until the buffer is full and a package is waiting to be sent
+	deadline := time.Now().Add(5 * time.Second)
+	for len(source.kills) < cap(source.kills) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	// Every package handed out is still sent
+	var kills []int
+	receiveKills(source.Kills(), stopped, func(kill KillSummary) {
+		kills = append(kills, kill.KillID)
+	})
+	mux.Lock()
+	defer mux.Unlock()
+	if len(kills) != handedOut || kills[len(kills)-1] != handedOut {
+		t.Logf("Expected all %v kills handed out, got %v", handedOut, kills)
+		t.Fail()
+	}
+}
+
+func TestRedisQSource_Backoff(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	source := NewRedisQSource(server.URL, "test-queue", log.StandardLogger())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go source.Start(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for source.State() != KillSourceBackoff && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if source.State() != KillSourceBackoff {
+		t.Logf("Expected state backoff, got %v", source.State())
+		t.Fail()
+	}
+	cancel()
+}
+
+func TestRedisQQueueID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zkillbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "redisq.json")
+
+	queueID, err := redisQQueueID(path, log.StandardLogger())
+	if err != nil || !strings.HasPrefix(queueID, "zkillbot-") {
+		t.Fatalf("Expected a generated queue ID, got %q %v", queueID, err)
+	}
+
+	// The same queue ID is used after a restart
+	loaded, err := redisQQueueID(path, log.StandardLogger())
+	if err != nil || loaded != queueID {
+		t.Logf("Expected queue ID %v after loading, got %q %v", queueID, loaded, err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+// websocketWriteTimeout is how long a single write may take before the connection is treated as dead
+const websocketWriteTimeout = 10 * time.Second
+
+// websocketRequest asks the writer to send a sub or unsub action, the outcome is sent on result
+type websocketRequest struct {
+	action  string
+	channel string
+	result  chan error
+}
+
+// WebsocketSource is a KillSource reading the zKillboard websocket
+//
+// gorilla/websocket allows one concurrent writer, so only the writer goroutine of the current connection writes to it.
+// Subscribe and Unsubscribe queue requests for the writer and wait for the outcome.
+type WebsocketSource struct {
+	url string
+	log *logrus.Logger
+
+	mux         sync.Mutex
+	state       KillSourceState
+	lastMessage time.Time
+	stats       KillSourceStats
+	connects    int
+	// zKillboard channels to subscribe on every connect
+	channels map[string]bool
+	// Closed when the writer of the current connection stops, nil while disconnected
+	writerDone chan struct{}
+
+	requests chan websocketRequest
+	kills    chan KillSummary
+}
+
+// NewWebsocketSource creates a WebsocketSource for the websocket at url, e.g. wss://zkillboard.com:2096
+func NewWebsocketSource(url string, log *logrus.Logger) *WebsocketSource {
+	return &WebsocketSource{
+		url:      url,
+		log:      log,
+		state:    KillSourceStopped,
+		channels: make(map[string]bool),
+		requests: make(chan websocketRequest),
+		kills:    make(chan KillSummary, killSourceBufferSize),
+	}
+}
+
+// Kills delivers every kill received on the websocket
+func (source *WebsocketSource) Kills() <-chan KillSummary {
+	return source.kills
+}
+
+// State returns the current connection state
+func (source *WebsocketSource) State() KillSourceState {
+	source.mux.Lock()
+	defer source.mux.Unlock()
+
+	return source.state
+}
+
+// LastMessage returns when a message was last read from the websocket
+func (source *WebsocketSource) LastMessage() time.Time {
+	source.mux.Lock()
+	defer source.mux.Unlock()
+
+	return source.lastMessage
+}
+
+// Stats returns the connection counters
+func (source *WebsocketSource) Stats() KillSourceStats {
+	source.mux.Lock()
+	defer source.mux.Unlock()
+
+	return source.stats
+}
+
+// setState changes the connection state
+func (source *WebsocketSource) setState(state KillSourceState) {
+	source.mux.Lock()
+	defer source.mux.Unlock()
+
+	source.state = state
+}
+
+// Subscribe adds a subscription and waits for it to be sent.
+// While disconnected ErrKillSourceQueued is returned, the subscription is sent once connected.
+func (source *WebsocketSource) Subscribe(category string, eveID int) error {
+	channel := killSourceChannel(category, eveID)
+
+	source.mux.Lock()
+	source.channels[channel] = true
+	source.mux.Unlock()
+
+	return source.request("sub", channel)
+}
+
+// Unsubscribe removes a subscription and waits for it to be sent if connected
+func (source *WebsocketSource) Unsubscribe(category string, eveID int) error {
+	channel := killSourceChannel(category, eveID)
+
+	source.mux.Lock()
+	delete(source.channels, channel)
+	source.mux.Unlock()
+
+	err := source.request("unsub", channel)
+	if err == ErrKillSourceQueued {
+		// Nothing to undo, it won't be subscribed on reconnect
+		return nil
+	}
+	return err
+}
+
+// request queues an action for the writer of the current connection and waits for the outcome
+func (source *WebsocketSource) request(action string, channel string) error {
+	source.mux.Lock()
+	writerDone := source.writerDone
+	source.mux.Unlock()
+
+	if writerDone == nil {
+		return ErrKillSourceQueued
+	}
+
+	request := websocketRequest{
+		action:  action,
+		channel: channel,
+		result:  make(chan error, 1),
+	}
+	select {
+	case source.requests <- request:
+	case <-writerDone:
+		return ErrKillSourceQueued
+	}
+
+	select {
+	case err := <-request.result:
+		return err
+	case <-writerDone:
+		return ErrKillSourceQueued
+	}
+}
+
+// Start keeps the websocket connected until ctx is cancelled, reconnecting with a backoff
+func (source *WebsocketSource) Start(ctx context.Context) {
+	log := source.log
+	boff := Backoff{
+		Min:    500 * time.Millisecond,
+		Max:    5 * time.Minute,
+		Factor: 2,
+		Jitter: true,
+	}
+
+	source.setState(KillSourceConnecting)
+	defer source.setState(KillSourceStopped)
+
+	// Forever keep the connection alive
+	for {
+		conn, _, err := websocket.DefaultDialer.DialContext(ctx, source.url, nil)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			dur := boff.Duration()
+			log.Warnf("zkill reconnection %d failed: %s", boff.Attempts(), err)
+			log.Warnln(" -> reconnecting in", dur)
+			source.mux.Lock()
+			source.state = KillSourceBackoff
+			source.stats.MaxBackoff = dur == boff.Max
+			source.mux.Unlock()
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(dur):
+			}
+			continue
+		}
+		log.Info("Connected to zKillboard Websocket")
+
+		// reset backoff once successfully reconnected
+		boff.Reset()
+
+		source.serve(ctx, conn)
+
+		if ctx.Err() != nil {
+			return
+		}
+		source.setState(KillSourceConnecting)
+	}
+}
+
+// serve runs the reader and writer of a connection until either fails or ctx is cancelled
+func (source *WebsocketSource) serve(ctx context.Context, conn *websocket.Conn) {
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		source.read(ctx, conn)
+	}()
+
+	// Requests are accepted while replaying, the writer sends them once the connection is up
+	writerDone := make(chan struct{})
+	source.mux.Lock()
+	source.writerDone = writerDone
+	source.mux.Unlock()
+
+	source.writer(ctx, conn, readerDone)
+
+	// Stop accepting requests before closing
+	source.mux.Lock()
+	source.writerDone = nil
+	source.stats.Connected = time.Time{}
+	source.mux.Unlock()
+	close(writerDone)
+
+	// Closing unblocks the reader
+	conn.Close()
+	<-readerDone
+}
+
+// writer replays every subscription then sends requests until a write fails, the reader stops or ctx is cancelled
+func (source *WebsocketSource) writer(ctx context.Context, conn *websocket.Conn, readerDone <-chan struct{}) {
+	log := source.log
+
+	// Automatically connect to any saved subscriptions
+	source.mux.Lock()
+	channels := make([]string, 0, len(source.channels))
+	for channel := range source.channels {
+		channels = append(channels, channel)
+	}
+	source.mux.Unlock()
+
+	for _, channel := range channels {
+		err := source.write(conn, "sub", channel)
+		if err != nil {
+			log.Errorf("Failed to subscribe to killstream, reconnecting: %v", err)
+			return
+		}
+		log.Debugf("subscribed to killstream channel: %v", channel)
+	}
+	log.Infof("Subscribed to %v killstream channels", len(channels))
+
+	// subscribe to zkillboard's public channel since they don't response to websocket PINGs
+	err := source.write(conn, "sub", "public")
+	if err != nil {
+		log.Errorf("Failed to sub to public status, reconnecting: %v", err)
+		return
+	}
+
+	// Only connected once the subscriptions are live, the status watcher backfills as soon as it sees the state
+	source.mux.Lock()
+	source.state = KillSourceConnected
+	if source.connects > 0 {
+		source.stats.Reconnects++
+	}
+	source.connects++
+	source.stats.Connected = time.Now()
+	source.stats.Replayed = len(channels)
+	source.stats.MaxBackoff = false
+	source.mux.Unlock()
+
+	for {
+		select {
+		case <-ctx.Done():
+			source.close(conn, readerDone)
+			return
+		case <-readerDone:
+			return
+		case request := <-source.requests:
+			err := source.write(conn, request.action, request.channel)
+			request.result <- err
+			if err != nil {
+				log.Errorf("Failed to write to WS, reconnecting: %v", err)
+				return
+			}
+		}
+	}
+}
+
+// close sends a close frame and waits for zKillboard to close its side, which stops the reader
+func (source *WebsocketSource) close(conn *websocket.Conn, readerDone <-chan struct{}) {
+	log := source.log
+
+	message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	err := conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(websocketWriteTimeout))
+	if err != nil {
+		log.Warnf("Failed to send WS close: %v", err)
+		return
+	}
+
+	select {
+	case <-readerDone:
+		log.Debugf("Closed zKillboard Websocket")
+	case <-time.After(websocketWriteTimeout):
+		log.Warnf("Timed out waiting for WS close")
+	}
+}
+
+// write sends a sub or unsub action, only called by the writer
+func (source *WebsocketSource) write(conn *websocket.Conn, action string, channel string) error {
+	payload, _ := json.Marshal(map[string]string{"action": action, "channel": channel})
+
+	conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+	err := conn.WriteMessage(websocket.TextMessage, payload)
+	if err != nil {
+		return fmt.Errorf("failed to %v %v: %v", action, channel, err)
+	}
+	return nil
+}
+
+// read passes kills from conn to the kills channel until the connection fails or is closed
+func (source *WebsocketSource) read(ctx context.Context, conn *websocket.Conn) {
+	log := source.log
+
+	// Listen for messages
+	for {
+		// set a deadline so ReadMessage will timeout eventually
+		// normally the public channel will send a message every 15 seconds, if not there's a good chance the connection is dead
+		conn.SetReadDeadline(time.Now().Add(time.Second * 30))
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			if ctx.Err() == nil {
+				// log error and exit for, this will trigger a new connection
+				log.Errorf("Error while reading from WS, reconnecting: %v", err)
+			}
+			return
+		}
+
+		source.mux.Lock()
+		source.lastMessage = time.Now()
+		source.mux.Unlock()
+
+		// TODO handle public info and store for later use
+		kill := KillSummary{}
+		err = json.Unmarshal(message, &kill)
+		if err != nil || kill.KillID == 0 {
+			// not a kill, most likely the public channel's status message
+			continue
+		}
+
+		// Kills are still received while shutting down, until the close handshake finishes and Start returns
+		source.kills <- kill
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// fakeWebsocketServer records the actions sent to it, and a normal close as the close action, replying with payloads once subscribed to public
+func fakeWebsocketServer(t *testing.T, payloads ...string) (*httptest.Server, chan map[string]string) {
+	actions := make(chan map[string]string, 10)
+	upgrader := websocket.Upgrader{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Logf("Upgrade failed: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		for {
+			_, message, err := conn.ReadMessage()
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				actions <- map[string]string{"action": "close"}
+				return
+			}
+			if err != nil {
+				return
+			}
+			action := map[string]string{}
+			json.Unmarshal(message, &action)
+			actions <- action
+
+			if action["channel"] == "public" {
+				for _, payload := range payloads {
+					conn.WriteMessage(websocket.TextMessage, []byte(payload))
+				}
+			}
+		}
+	}))
+
+	return server, actions
+}
+
+func TestWebsocketSource(t *testing.T) {
+	server, actions := fakeWebsocketServer(t,
+		`{"action":"tqStatus","tqStatus":"ONLINE","tqCount":"20,000","kills":1000}`,
+		`{"action":"littlekill","killID":123,"character_id":100,"url":"https://zkillboard.com/kill/123/"}`,
+	)
+	defer server.Close()
+
+	source := NewWebsocketSource("ws"+strings.TrimPrefix(server.URL, "http"), log.StandardLogger())
+
+	// Subscribing before connecting is queued until connected
+	err := source.Subscribe("character", 100)
+	if err != ErrKillSourceQueued {
+		t.Logf("Expected subscribe before Start to be queued, got %v", err)
+		t.Fail()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go source.Start(ctx)
+
+	// Saved subscriptions are sent on connect, followed by public
+	for _, expected := range []string{"character:100", "public"} {
+		select {
+		case action := <-actions:
+			if action["action"] != "sub" || action["channel"] != expected {
+				t.Logf("Expected sub to %v, got %v", expected, action)
+				t.Fail()
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for sub to %v", expected)
+		}
+	}
+
+	// Only kills are delivered
+	select {
+	case kill := <-source.Kills():
+		if kill.KillID != 123 || kill.CharacterID != 100 {
+			t.Logf("Unexpected kill: %+v", kill)
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for kill")
+	}
+	// Connected once public is subscribed, with the replayed subscriptions counted
+	deadline := time.Now().Add(5 * time.Second)
+	for source.State() != KillSourceConnected && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if source.State() != KillSourceConnected || source.Stats().Replayed != 1 {
+		t.Logf("Expected state connected with 1 subscription replayed, got %v and %+v", source.State(), source.Stats())
+		t.Fail()
+	}
+
+	// Requests are acknowledged once written while connected
+	err = source.Subscribe("alliance", 200)
+	if err != nil {
+		t.Logf("Subscribe while connected failed: %v", err)
+		t.Fail()
+	}
+	err = source.Unsubscribe("character", 100)
+	if err != nil {
+		t.Logf("Unsubscribe while connected failed: %v", err)
+		t.Fail()
+	}
+	for _, expected := range []map[string]string{{"action": "sub", "channel": "alliance:200"}, {"action": "unsub", "channel": "character:100"}} {
+		select {
+		case action := <-actions:
+			if action["action"] != expected["action"] || action["channel"] != expected["channel"] {
+				t.Logf("Expected %v, got %v", expected, action)
+				t.Fail()
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %v", expected)
+		}
+	}
+
+	// Cancelling closes the websocket cleanly and stops the source
+	cancel()
+	select {
+	case action := <-actions:
+		if action["action"] != "close" {
+			t.Logf("Expected close, got %v", action)
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for close")
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for source.State() != KillSourceStopped && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if source.State() != KillSourceStopped {
+		t.Logf("Expected state stopped, got %v", source.State())
+		t.Fail()
+	}
+}
+
+func TestWebsocketSource_Reconnect(t *testing.T) {
+	connections := make(chan []string, 5)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		// Drop every connection once public is subscribed, recording what was subscribed
+		defer conn.Close()
+
+		var channels []string
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			action := map[string]string{}
+			json.Unmarshal(message, &action)
+			channels = append(channels, action["channel"])
+			if action["channel"] == "public" {
+				connections <- channels
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	source := NewWebsocketSource("ws"+strings.TrimPrefix(server.URL, "http"), log.StandardLogger())
+	source.Subscribe("character", 100)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go source.Start(ctx)
+
+	// Every connection replays the subscriptions
+	for i := 0; i < 2; i++ {
+		select {
+		case channels := <-connections:
+			if len(channels) != 2 || channels[0] != "character:100" || channels[1] != "public" {
+				t.Logf("Connection %v expected character:100 and public, got %v", i, channels)
+				t.Fail()
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for connection %v", i)
+		}
+	}
+}
@@ -5,9 +5,16 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
+
+	"github.com/spf13/pflag"
 )
 
 func main() {
+	// Command line flags
+	pflag.Bool("verbose", false, "Print logs to command line")
+	pflag.Parse()
+
 	// Init bot
 	bot := NewZKillBot()
 
@@ -16,12 +23,18 @@ func main() {
 
 	// Connect to Discord and zKillboard
 	bot.connectDiscord()
-	go bot.connectzKillboardWS()
+	sourceDone := make(chan struct{})
+	bot.goRun(func() {
+		defer close(sourceDone)
+		bot.kills.Start(cContext)
+	})
 
 	// Runner Threads
-	go bot.eveIDLookupCmd(cContext)
-	go bot.zKillboardReceive(cContext)
-	go bot.zKillboardTrack(cContext)
+	bot.commands.Start(cContext, &bot.wg)
+	bot.pool.Start(cContext, bot.kills.Kills(), sourceDone, &bot.wg)
+	bot.goRun(func() { bot.watchKillSource(cContext) })
+	bot.goRun(func() { bot.saveNamesEvery(cContext, 10*time.Minute) })
+	bot.goRun(func() { bot.saveSeenEvery(cContext, time.Minute) })
 
 	// Run forever unless we sig close
 	sc := make(chan os.Signal, 1)
@@ -29,9 +42,13 @@ func main() {
 	<-sc
 
 	// Trigger thread cancels
+	bot.log.Info("Shutting down")
 	cSignal()
 
-	// Cleanly exit
-	bot.discord.Close()
-	bot.zKillboard.Close()
+	// Wait for pending kills to be sent then save state
+	err := bot.Shutdown(bot.viperConfig.GetDuration("shutdown_timeout"))
+	if err != nil {
+		bot.log.Errorf("Shutdown failed: %v", err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// discordMaxEmbeds is the most embeds discord accepts in a single message
+	discordMaxEmbeds = 10
+	// discordMaxContent is the most characters discord accepts in a message's content
+	discordMaxContent = 2000
+	// discordMaxEmbedLength is the most characters discord accepts across all embeds of a message
+	discordMaxEmbedLength = 6000
+
+	// outboxIdle is how long a channel's queue waits for messages before its goroutine stops
+	outboxIdle = time.Minute
+	// outboxDelayed is how long a message may wait before it counts as delayed
+	outboxDelayed = 5 * time.Second
+)
+
+// outboundMessage is a message waiting to be sent to a discord channel
+type outboundMessage struct {
+	Content string
+	Embeds  []*discordgo.MessageEmbed
+
+	// When the oldest message in a batch was queued, and how many messages were batched together
+	queued time.Time
+	count  int
+
+	// Dropped is called if the message is dropped instead of sent
+	Dropped func()
+	// Dropped of every message batched into this one
+	dropped []func()
+	// The messages batched into this one, set once batched
+	batch []outboundMessage
+}
+
+// OutboxStats are the delivery counters of an Outbox, each counts messages before batching
+type OutboxStats struct {
+	Sent    uint64
+	Batched uint64
+	Retried uint64
+	Delayed uint64
+	Dropped uint64
+	Queued  int
+}
+
+// Outbox sends messages to discord channels, through a bounded queue per channel.
+//
+// Each channel's queue is sent one message at a time, retrying on rate limits and discord server errors.
+// When messages back up they are batched, several embeds or lines of content in a single message.
+// Messages are dropped when a channel's queue is full or retries run out.
+type Outbox struct {
+	send func(channelID string, message outboundMessage) error
+	log  *logrus.Logger
+
+	queueSize  int
+	batchSize  int
+	maxRetries int
+	retryMin   time.Duration
+
+	mux    sync.Mutex
+	queues map[string]chan outboundMessage
+	closed bool
+	wg     sync.WaitGroup
+
+	// Reported by Stats, the channel senders update them with sync/atomic
+	sent    uint64
+	batched uint64
+	retried uint64
+	delayed uint64
+	dropped uint64
+}
+
+// NewOutbox creates an Outbox sending with send.
+// batchSize is the most messages combined into one, 1 disables batching.
+func NewOutbox(send func(channelID string, message outboundMessage) error, queueSize int, batchSize int, maxRetries int, log *logrus.Logger) *Outbox {
+	if queueSize < 1 {
+		queueSize = 1
+	}
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	return &Outbox{
+		send:       send,
+		log:        log,
+		queueSize:  queueSize,
+		batchSize:  batchSize,
+		maxRetries: maxRetries,
+		retryMin:   time.Second,
+		queues:     make(map[string]chan outboundMessage),
+	}
+}
+
+// Send queues a message for a channel, dropping it if the channel's queue is full or the Outbox is closed
+func (outbox *Outbox) Send(channelID string, message outboundMessage) {
+	log := outbox.log
+
+	message.queued = time.Now()
+	message.count = 1
+	if message.Dropped != nil {
+		message.dropped = []func(){message.Dropped}
+		message.Dropped = nil
+	}
+
+	outbox.mux.Lock()
+	defer outbox.mux.Unlock()
+
+	if outbox.closed {
+		atomic.AddUint64(&outbox.dropped, 1)
+		log.Warnf("Dropped message to channel %v, shutting down", channelID)
+		message.drop()
+		return
+	}
+
+	// Start the channel's goroutine on its first message
+	queue, ok := outbox.queues[channelID]
+	if !ok {
+		queue = make(chan outboundMessage, outbox.queueSize)
+		outbox.queues[channelID] = queue
+		outbox.wg.Add(1)
+		go outbox.run(channelID, queue)
+	}
+
+	select {
+	case queue <- message:
+	default:
+		atomic.AddUint64(&outbox.dropped, 1)
+		log.Warnf("Dropped message to channel %v, %v messages already queued", channelID, outbox.queueSize)
+		message.drop()
+	}
+}
+
+// Close stops accepting messages, Wait returns once everything already queued was sent or dropped
+func (outbox *Outbox) Close() {
+	outbox.mux.Lock()
+	defer outbox.mux.Unlock()
+
+	if outbox.closed {
+		return
+	}
+	outbox.closed = true
+	for _, queue := range outbox.queues {
+		close(queue)
+	}
+}
+
+// Wait blocks until every channel's queue has stopped, after Close
+func (outbox *Outbox) Wait() {
+	outbox.wg.Wait()
+}
+
+// Stats returns the delivery counters
+func (outbox *Outbox) Stats() OutboxStats {
+	outbox.mux.Lock()
+	queued := 0
+	for _, queue := range outbox.queues {
+		queued += len(queue)
+	}
+	outbox.mux.Unlock()
+
+	return OutboxStats{
+		Sent:    atomic.LoadUint64(&outbox.sent),
+		Batched: atomic.LoadUint64(&outbox.batched),
+		Retried: atomic.LoadUint64(&outbox.retried),
+		Delayed: atomic.LoadUint64(&outbox.delayed),
+		Dropped: atomic.LoadUint64(&outbox.dropped),
+		Queued:  queued,
+	}
+}
+
+// run sends a channel's queue until it is closed, or stops once idle
+func (outbox *Outbox) run(channelID string, queue chan outboundMessage) {
+	defer outbox.wg.Done()
+
+	idle := time.NewTimer(outboxIdle)
+	defer idle.Stop()
+
+	// A message taken off the queue that couldn't be batched, sent next
+	var pending *outboundMessage
+	for {
+		var message outboundMessage
+		if pending != nil {
+			message, pending = *pending, nil
+		} else {
+			select {
+			case next, ok := <-queue:
+				if !ok {
+					return
+				}
+				message = next
+			case <-idle.C:
+				// Only stop if nothing was queued in the meantime, Send holds mux while queueing
+				outbox.mux.Lock()
+				if len(queue) == 0 && !outbox.closed {
+					delete(outbox.queues, channelID)
+					outbox.mux.Unlock()
+					return
+				}
+				outbox.mux.Unlock()
+				idle.Reset(outboxIdle)
+				continue
+			}
+		}
+
+		// Combine whatever else is already waiting
+		for message.count < outbox.batchSize && len(queue) > 0 {
+			next, ok := <-queue
+			if !ok {
+				break
+			}
+			if !batchMessages(&message, next) {
+				pending = &next
+				break
+			}
+		}
+
+		outbox.deliver(channelID, message)
+
+		if !idle.Stop() {
+			select {
+			case <-idle.C:
+			default:
+			}
+		}
+		idle.Reset(outboxIdle)
+	}
+}
+
+// batchMessages adds next to message if both are only embeds or only content and the result fits in one discord message
+func batchMessages(message *outboundMessage, next outboundMessage) bool {
+	first := *message
+
+	switch {
+	case len(message.Content) == 0 && len(next.Content) == 0:
+		if len(message.Embeds)+len(next.Embeds) > discordMaxEmbeds {
+			return false
+		}
+		if embedsLength(message.Embeds)+embedsLength(next.Embeds) > discordMaxEmbedLength {
+			return false
+		}
+		message.Embeds = append(message.Embeds, next.Embeds...)
+
+	case len(message.Embeds) == 0 && len(next.Embeds) == 0:
+		if len(message.Content)+1+len(next.Content) > discordMaxContent {
+			return false
+		}
+		message.Content += "\n" + next.Content
+
+	default:
+		return false
+	}
+
+	if message.batch == nil {
+		message.batch = []outboundMessage{first}
+	}
+	message.batch = append(message.batch, next)
+	message.count += next.count
+	message.dropped = append(message.dropped, next.dropped...)
+	return true
+}
+
+// embedsLength returns the characters of embeds counted towards discordMaxEmbedLength
+func embedsLength(embeds []*discordgo.MessageEmbed) int {
+	length := 0
+	for _, embed := range embeds {
+		length += len(embed.Title) + len(embed.Description)
+		if embed.Author != nil {
+			length += len(embed.Author.Name)
+		}
+		if embed.Footer != nil {
+			length += len(embed.Footer.Text)
+		}
+		for _, field := range embed.Fields {
+			length += len(field.Name) + len(field.Value)
+		}
+	}
+	return length
+}
+
+// drop tells everyone waiting on the message, or the messages batched into it, that it won't be sent
+func (message *outboundMessage) drop() {
+	for _, dropped := range message.dropped {
+		dropped()
+	}
+}
+
+// deliver sends a message, retrying rate limits, discord server errors and network errors
+func (outbox *Outbox) deliver(channelID string, message outboundMessage) {
+	log := outbox.log
+	count := uint64(message.count)
+
+	if message.count > 1 {
+		atomic.AddUint64(&outbox.batched, count)
+		log.Debugf("Batched %v messages to channel %v", message.count, channelID)
+	}
+
+	boff := Backoff{
+		Min:    outbox.retryMin,
+		Max:    time.Minute,
+		Factor: 2,
+		Jitter: true,
+	}
+	for attempt := 0; ; attempt++ {
+		err := outbox.send(channelID, message)
+		if err == nil {
+			atomic.AddUint64(&outbox.sent, count)
+			if waited := time.Since(message.queued); waited > outboxDelayed {
+				atomic.AddUint64(&outbox.delayed, count)
+				log.Debugf("Message to channel %v delayed by %v", channelID, waited.Round(time.Second))
+			}
+			return
+		}
+
+		// Discord may refuse a batch for a limit not checked when batching, its messages can still be sent one at a time
+		if len(message.batch) > 0 && discordBadRequest(err) {
+			log.Warnf("Discord refused %v batched messages to channel %v, sending them one at a time: %v", message.count, channelID, err)
+			for _, single := range message.batch {
+				outbox.deliver(channelID, single)
+			}
+			return
+		}
+
+		wait, retry := discordRetryAfter(err, &boff)
+		if !retry || attempt >= outbox.maxRetries {
+			atomic.AddUint64(&outbox.dropped, count)
+			log.Errorf("Dropped message to channel %v after %v attempts: %v", channelID, attempt+1, err)
+			message.drop()
+			return
+		}
+
+		atomic.AddUint64(&outbox.retried, count)
+		log.Warnf("Failed to send message to channel %v, retrying in %v: %v", channelID, wait, err)
+		time.Sleep(wait)
+	}
+}
+
+// discordRetryAfter returns how long to wait before retrying a failed request, or false if it shouldn't be retried
+func discordRetryAfter(err error, boff *Backoff) (time.Duration, bool) {
+	switch err := err.(type) {
+	case *discordgo.RateLimitError:
+		return err.RetryAfter, true
+
+	case *discordgo.RESTError:
+		// Other client errors, e.g. missing permissions, fail the same way every time
+		if err.Response == nil || (err.Response.StatusCode != http.StatusTooManyRequests && err.Response.StatusCode < http.StatusInternalServerError) {
+			return 0, false
+		}
+		if retryAfter := err.Response.Header.Get("Retry-After"); len(retryAfter) > 0 {
+			seconds, parseErr := time.ParseDuration(strings.TrimSpace(retryAfter) + "s")
+			if parseErr == nil {
+				return seconds, true
+			}
+		}
+		return boff.Duration(), true
+	}
+
+	// Network errors
+	return boff.Duration(), true
+}
+
+// discordBadRequest returns true if discord refused a request as invalid
+func discordBadRequest(err error) bool {
+	restErr, ok := err.(*discordgo.RESTError)
+	return ok && restErr.Response != nil && restErr.Response.StatusCode == http.StatusBadRequest
+}
+
+// discordSend sends a message with the discord session, leaving rate limit retries to the Outbox
+func (bot *ZKillBot) discordSend(channelID string, message outboundMessage) error {
+	_, err := bot.sender.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+		Content: message.Content,
+		Embeds:  message.Embeds,
+	}, discordgo.WithRetryOnRatelimit(false))
+	return err
+}
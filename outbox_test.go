@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// recordingSend records messages sent through an Outbox, failing with errs in order first
+type recordingSend struct {
+	mux      sync.Mutex
+	messages map[string][]outboundMessage
+	errs     []error
+	attempts int
+
+	// When set, sends wait for release after signalling sending
+	sending chan struct{}
+	release chan struct{}
+}
+
+func (send *recordingSend) send(channelID string, message outboundMessage) error {
+	if send.release != nil {
+		send.sending <- struct{}{}
+		<-send.release
+	}
+
+	send.mux.Lock()
+	defer send.mux.Unlock()
+
+	send.attempts++
+	if len(send.errs) > 0 {
+		err := send.errs[0]
+		send.errs = send.errs[1:]
+		return err
+	}
+	if send.messages == nil {
+		send.messages = make(map[string][]outboundMessage)
+	}
+	send.messages[channelID] = append(send.messages[channelID], message)
+	return nil
+}
+
+func restError(status int) error {
+	return &discordgo.RESTError{Response: &http.Response{StatusCode: status, Header: http.Header{}}}
+}
+
+func TestOutbox_Retry(t *testing.T) {
+	send := &recordingSend{errs: []error{restError(http.StatusTooManyRequests), restError(http.StatusBadGateway), errors.New("connection reset")}}
+	outbox := NewOutbox(send.send, 10, 1, 5, log.StandardLogger())
+	outbox.retryMin = time.Millisecond
+
+	outbox.Send("chan-a", outboundMessage{Content: "kill"})
+	outbox.Close()
+	outbox.Wait()
+
+	if len(send.messages["chan-a"]) != 1 || send.attempts != 4 {
+		t.Logf("Expected 1 message after 4 attempts, got %v after %v", len(send.messages["chan-a"]), send.attempts)
+		t.Fail()
+	}
+	stats := outbox.Stats()
+	if stats.Sent != 1 || stats.Retried != 3 || stats.Dropped != 0 {
+		t.Logf("Unexpected stats %+v", stats)
+		t.Fail()
+	}
+}
+
+func TestOutbox_Drop(t *testing.T) {
+	// Missing permissions aren't retried
+	send := &recordingSend{errs: []error{restError(http.StatusForbidden)}}
+	outbox := NewOutbox(send.send, 10, 1, 5, log.StandardLogger())
+	outbox.retryMin = time.Millisecond
+
+	outbox.Send("chan-a", outboundMessage{Content: "kill"})
+	outbox.Close()
+	outbox.Wait()
+
+	if send.attempts != 1 || outbox.Stats().Dropped != 1 {
+		t.Logf("Expected 1 attempt and 1 drop, got %v attempts and %+v", send.attempts, outbox.Stats())
+		t.Fail()
+	}
+
+	// Retries run out
+	send = &recordingSend{errs: []error{restError(http.StatusInternalServerError), restError(http.StatusInternalServerError), restError(http.StatusInternalServerError)}}
+	outbox = NewOutbox(send.send, 10, 1, 2, log.StandardLogger())
+	outbox.retryMin = time.Millisecond
+
+	dropped := 0
+	outbox.Send("chan-a", outboundMessage{Content: "kill", Dropped: func() { dropped++ }})
+	outbox.Close()
+	outbox.Wait()
+
+	if send.attempts != 3 || outbox.Stats().Dropped != 1 {
+		t.Logf("Expected 3 attempts and 1 drop, got %v attempts and %+v", send.attempts, outbox.Stats())
+		t.Fail()
+	}
+	if dropped != 1 {
+		t.Logf("Expected the sender to be told about the drop once, got %v", dropped)
+		t.Fail()
+	}
+
+	// Also when dropped while closed
+	outbox.Send("chan-a", outboundMessage{Content: "kill", Dropped: func() { dropped++ }})
+	if dropped != 2 {
+		t.Logf("Expected the sender to be told about the drop after closing, got %v", dropped)
+		t.Fail()
+	}
+}
+
+func TestOutbox_Full(t *testing.T) {
+	send := &recordingSend{sending: make(chan struct{}), release: make(chan struct{})}
+	outbox := NewOutbox(send.send, 2, 1, 0, log.StandardLogger())
+
+	// The first message is stuck sending, two more fill the queue
+	outbox.Send("chan-a", outboundMessage{Content: "1"})
+	<-send.sending
+	for i := 2; i <= 5; i++ {
+		outbox.Send("chan-a", outboundMessage{Content: "more"})
+	}
+
+	// Other channels have their own queue
+	outbox.Send("chan-b", outboundMessage{Content: "1"})
+
+	go func() {
+		for range send.sending {
+		}
+	}()
+	close(send.release)
+	outbox.Close()
+	outbox.Wait()
+	close(send.sending)
+
+	stats := outbox.Stats()
+	if stats.Sent != 4 || stats.Dropped != 2 {
+		t.Logf("Expected 4 sent and 2 dropped, got %+v", stats)
+		t.Fail()
+	}
+}
+
+func TestOutbox_Batch(t *testing.T) {
+	send := &recordingSend{sending: make(chan struct{}), release: make(chan struct{})}
+	outbox := NewOutbox(send.send, 50, 5, 0, log.StandardLogger())
+
+	embed := func(title string) outboundMessage {
+		return outboundMessage{Embeds: []*discordgo.MessageEmbed{{Title: title}}}
+	}
+
+	// Queue up behind a stuck first message
+	outbox.Send("chan-a", embed("1"))
+	<-send.sending
+	for _, title := range []string{"2", "3", "4", "5", "6", "7"} {
+		outbox.Send("chan-a", embed(title))
+	}
+	outbox.Send("chan-a", outboundMessage{Content: "a"})
+	outbox.Send("chan-a", outboundMessage{Content: "b"})
+
+	go func() {
+		for range send.sending {
+		}
+	}()
+	close(send.release)
+	outbox.Close()
+	outbox.Wait()
+	close(send.sending)
+
+	// Embeds and content are batched separately, in order
+	var got [][]string
+	for _, message := range send.messages["chan-a"] {
+		var parts []string
+		for _, embed := range message.Embeds {
+			parts = append(parts, embed.Title)
+		}
+		if len(message.Content) > 0 {
+			parts = append(parts, message.Content)
+		}
+		got = append(got, parts)
+	}
+	expected := [][]string{{"1"}, {"2", "3", "4", "5", "6"}, {"7"}, {"a\nb"}}
+	if len(got) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+	for i := range expected {
+		if len(got[i]) != len(expected[i]) {
+			t.Fatalf("Expected %v, got %v", expected, got)
+		}
+		for j := range expected[i] {
+			if got[i][j] != expected[i][j] {
+				t.Logf("Expected %v, got %v", expected, got)
+				t.Fail()
+			}
+		}
+	}
+	if stats := outbox.Stats(); stats.Sent != 9 || stats.Batched != 7 {
+		t.Logf("Expected 9 sent and 7 batched, got %+v", stats)
+		t.Fail()
+	}
+}
+
+func TestOutbox_Closed(t *testing.T) {
+	send := &recordingSend{}
+	outbox := NewOutbox(send.send, 10, 1, 0, log.StandardLogger())
+	outbox.Close()
+
+	outbox.Send("chan-a", outboundMessage{Content: "kill"})
+	outbox.Wait()
+
+	if send.attempts != 0 || outbox.Stats().Dropped != 1 {
+		t.Logf("Expected the message to be dropped, got %v attempts and %+v", send.attempts, outbox.Stats())
+		t.Fail()
+	}
+}
+
+func TestOutbox_BatchLength(t *testing.T) {
+	send := &recordingSend{sending: make(chan struct{}), release: make(chan struct{})}
+	outbox := NewOutbox(send.send, 50, 10, 0, log.StandardLogger())
+
+	// Three embeds of 2500 characters don't fit in one message
+	long := strings.Repeat("x", 2500)
+	outbox.Send("chan-a", outboundMessage{Content: "first"})
+	<-send.sending
+	for i := 0; i < 3; i++ {
+		outbox.Send("chan-a", outboundMessage{Embeds: []*discordgo.MessageEmbed{{Description: long}}})
+	}
+
+	go func() {
+		for range send.sending {
+		}
+	}()
+	close(send.release)
+	outbox.Close()
+	outbox.Wait()
+	close(send.sending)
+
+	var got []int
+	for _, message := range send.messages["chan-a"][1:] {
+		got = append(got, len(message.Embeds))
+	}
+	if len(got) != 2 || got[0] != 2 || got[1] != 1 {
+		t.Logf("Expected batches of 2 and 1 embeds, got %v", got)
+		t.Fail()
+	}
+}
+
+func TestOutbox_BatchRefused(t *testing.T) {
+	record := &recordingSend{sending: make(chan struct{}), release: make(chan struct{})}
+	// Discord refuses every message with more than one embed
+	send := func(channelID string, message outboundMessage) error {
+		if len(message.Embeds) > 1 {
+			return restError(http.StatusBadRequest)
+		}
+		return record.send(channelID, message)
+	}
+	outbox := NewOutbox(send, 50, 5, 0, log.StandardLogger())
+
+	var mux sync.Mutex
+	dropped := 0
+	outbox.Send("chan-a", outboundMessage{Content: "first"})
+	<-record.sending
+	for _, title := range []string{"1", "2", "3"} {
+		outbox.Send("chan-a", outboundMessage{
+			Embeds: []*discordgo.MessageEmbed{{Title: title}},
+			Dropped: func() {
+				mux.Lock()
+				dropped++
+				mux.Unlock()
+			},
+		})
+	}
+
+	go func() {
+		for range record.sending {
+		}
+	}()
+	close(record.release)
+	outbox.Close()
+	outbox.Wait()
+	close(record.sending)
+
+	// The refused batch is sent one embed at a time, in order
+	var got []string
+	for _, message := range record.messages["chan-a"][1:] {
+		for _, embed := range message.Embeds {
+			got = append(got, embed.Title)
+		}
+	}
+	if strings.Join(got, ",") != "1,2,3" {
+		t.Logf("Expected embeds 1,2,3 sent separately, got %v", got)
+		t.Fail()
+	}
+	if stats := outbox.Stats(); stats.Sent != 4 || stats.Dropped != 0 || dropped != 0 {
+		t.Logf("Expected 4 sent and none dropped, got %+v and %v dropped", stats, dropped)
+		t.Fail()
+	}
+}
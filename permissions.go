@@ -0,0 +1,86 @@
+package main
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"github.com/sirupsen/logrus"
+)
+
+// permissionRule decides who may add, remove or edit subscriptions in a guild
+type permissionRule struct {
+	// Anyone who can type in the channel, the behaviour of older versions
+	Everyone bool `mapstructure:"everyone"`
+	// Members with the Manage Channels permission on the channel
+	ManageChannels bool `mapstructure:"manage_channels"`
+	// Members with any of these role IDs
+	Roles []string `mapstructure:"roles"`
+}
+
+// defaultPermissionRule applies to guilds without a rule in the config
+var defaultPermissionRule = permissionRule{ManageChannels: true}
+
+// Permissions holds the per guild rules for managing subscriptions
+type Permissions struct {
+	rules map[string]permissionRule
+	log   *logrus.Logger
+}
+
+// NewPermissions creates Permissions from guild ID -> rule, guilds not in rules use defaultPermissionRule
+func NewPermissions(rules map[string]permissionRule, log *logrus.Logger) *Permissions {
+	if rules == nil {
+		rules = make(map[string]permissionRule)
+	}
+
+	return &Permissions{
+		rules: rules,
+		log:   log,
+	}
+}
+
+// rule returns the rule for a guild
+func (permissions *Permissions) rule(guildID string) permissionRule {
+	if rule, ok := permissions.rules[guildID]; ok {
+		return rule
+	}
+	return defaultPermissionRule
+}
+
+// CanManage reports if the author of message may change the subscriptions of its channel
+func (permissions *Permissions) CanManage(message discordCommand) bool {
+	// Direct messages only affect the author
+	if len(message.GuildID) == 0 {
+		return true
+	}
+
+	rule := permissions.rule(message.GuildID)
+	if rule.Everyone {
+		return true
+	}
+
+	if message.Permissions&discordgo.PermissionAdministrator != 0 {
+		return true
+	}
+	if rule.ManageChannels && message.Permissions&discordgo.PermissionManageChannels != 0 {
+		return true
+	}
+
+	for _, role := range message.Roles {
+		for _, allowed := range rule.Roles {
+			if role == allowed {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// RequireManage replies to and logs denied attempts, returning false when the command should not run
+func (permissions *Permissions) RequireManage(message discordCommand) bool {
+	if permissions.CanManage(message) {
+		return true
+	}
+
+	permissions.log.Warnf("Denied %v%v %v for user %v in guild %v channel %v", message.Prefix, message.Command, message.Args, message.AuthorID, message.GuildID, message.ChannelID)
+	message.ReplyError("You do not have permission to change what is tracked in this channel, ask someone with Manage Channels or a permitted role")
+	return false
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestPermissions_CanManage(t *testing.T) {
+	permissions := NewPermissions(map[string]permissionRule{
+		"roles-only": {Roles: []string{"officer"}},
+		"open":       {Everyone: true},
+	}, log.StandardLogger())
+
+	tests := []struct {
+		name    string
+		message discordCommand
+		allowed bool
+	}{
+		{"direct message", discordCommand{}, true},
+		{"default rule without permission", discordCommand{GuildID: "other", Roles: []string{"officer"}}, false},
+		{"default rule manage channels", discordCommand{GuildID: "other", Permissions: discordgo.PermissionManageChannels}, true},
+		{"administrator", discordCommand{GuildID: "roles-only", Permissions: discordgo.PermissionAdministrator}, true},
+		{"roles rule ignores manage channels", discordCommand{GuildID: "roles-only", Permissions: discordgo.PermissionManageChannels}, false},
+		{"roles rule with role", discordCommand{GuildID: "roles-only", Roles: []string{"member", "officer"}}, true},
+		{"everyone rule", discordCommand{GuildID: "open"}, true},
+	}
+
+	for _, test := range tests {
+		if permissions.CanManage(test.message) != test.allowed {
+			t.Logf("%v: expected allowed to be %v", test.name, test.allowed)
+			t.Fail()
+		}
+	}
+}
+
+func TestPermissions_RequireManage(t *testing.T) {
+	permissions := NewPermissions(nil, log.StandardLogger())
+
+	responder := &fakeResponder{}
+	allowed := permissions.RequireManage(discordCommand{GuildID: "guild", AuthorID: "user", commandResponder: responder})
+	if allowed || len(responder.errors) != 1 {
+		t.Logf("Expected a denied reply, got allowed %v, errors %v", allowed, responder.errors)
+		t.Fail()
+	}
+
+	responder = &fakeResponder{}
+	allowed = permissions.RequireManage(discordCommand{GuildID: "guild", Permissions: discordgo.PermissionManageChannels, commandResponder: responder})
+	if !allowed || len(responder.errors) != 0 {
+		t.Logf("Expected allowed without reply, got allowed %v, errors %v", allowed, responder.errors)
+		t.Fail()
+	}
+}
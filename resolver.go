@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/antihax/goesi"
+	"github.com/antihax/goesi/esi"
+)
+
+// esiMaxNameIDs is the most IDs ESI accepts in a single universe/names request
+const esiMaxNameIDs = 1000
+
+// resolvedName is the name and category of an eve ID
+type resolvedName struct {
+	Name     string    `json:"name"`
+	Category string    `json:"category"`
+	Expires  time.Time `json:"expires"`
+}
+
+// NameResolver sits in front of ESI's universe/names endpoint, caching ID -> name lookups
+//
+// Cached names expire after the TTL and the cache can be saved to disk so it survives restarts.
+type NameResolver struct {
+	mux     sync.Mutex
+	entries map[int32]resolvedName
+
+	// lookup performs the ESI request, replaced in tests
+	lookup func(ctx context.Context, IDs []int32) ([]esi.PostUniverseNames200Ok, error)
+
+	ttl  time.Duration
+	path string
+
+	// Names served from the cache and requested from ESI, added to with sync/atomic outside of mux
+	hits   uint64
+	misses uint64
+}
+
+// NewNameResolver creates a NameResolver using the esiClient, loading any cache previously saved at path
+func NewNameResolver(esiClient *goesi.APIClient, ttl time.Duration, path string) (*NameResolver, error) {
+	resolver := newNameResolver(func(ctx context.Context, IDs []int32) ([]esi.PostUniverseNames200Ok, error) {
+		names, response, err := esiClient.ESI.UniverseApi.PostUniverseNames(ctx, IDs, nil)
+		if err != nil {
+			return nil, err
+		}
+		if response.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("EVE ESI request failed code: %v", response.StatusCode)
+		}
+		return names, nil
+	}, ttl, path)
+
+	return resolver, resolver.load()
+}
+
+// newNameResolver creates an empty NameResolver around a lookup function
+func newNameResolver(lookup func(ctx context.Context, IDs []int32) ([]esi.PostUniverseNames200Ok, error), ttl time.Duration, path string) *NameResolver {
+	return &NameResolver{
+		entries: make(map[int32]resolvedName),
+		lookup:  lookup,
+		ttl:     ttl,
+		path:    path,
+	}
+}
+
+// Resolve returns the names of the IDs, only IDs missing from the cache or expired are requested from ESI.
+// Zero and duplicate IDs are ignored.
+func (resolver *NameResolver) Resolve(ctx context.Context, IDs []int32) (map[int32]resolvedName, error) {
+	names := make(map[int32]resolvedName)
+	var missing []int32
+
+	// Check cache
+	now := time.Now()
+	resolver.mux.Lock()
+	for _, ID := range uniqueIDs(IDs) {
+		if entry, ok := resolver.entries[ID]; ok && now.Before(entry.Expires) {
+			names[ID] = entry
+		} else {
+			missing = append(missing, ID)
+		}
+	}
+	resolver.mux.Unlock()
+	atomic.AddUint64(&resolver.hits, uint64(len(names)))
+	atomic.AddUint64(&resolver.misses, uint64(len(missing)))
+
+	// Request the rest in batches
+	for start := 0; start < len(missing); start += esiMaxNameIDs {
+		end := start + esiMaxNameIDs
+		if end > len(missing) {
+			end = len(missing)
+		}
+
+		results, err := resolver.lookup(ctx, missing[start:end])
+		if err != nil {
+			return nil, err
+		}
+
+		expires := time.Now().Add(resolver.ttl)
+		resolver.mux.Lock()
+		for _, result := range results {
+			entry := resolvedName{
+				Name:     result.Name,
+				Category: result.Category,
+				Expires:  expires,
+			}
+			resolver.entries[result.Id] = entry
+			names[result.Id] = entry
+		}
+		resolver.mux.Unlock()
+	}
+
+	return names, nil
+}
+
+// Stats returns the number of IDs served from the cache and the number requested from ESI
+func (resolver *NameResolver) Stats() (hits uint64, misses uint64) {
+	return atomic.LoadUint64(&resolver.hits), atomic.LoadUint64(&resolver.misses)
+}
+
+// load reads a previously saved cache, a missing file is not an error
+func (resolver *NameResolver) load() error {
+	if len(resolver.path) == 0 {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(resolver.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	resolver.mux.Lock()
+	defer resolver.mux.Unlock()
+	return json.Unmarshal(data, &resolver.entries)
+}
+
+// Save writes the unexpired cache entries to disk, nothing is saved without a path
+func (resolver *NameResolver) Save() error {
+	if len(resolver.path) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+
+	resolver.mux.Lock()
+	entries := make(map[int32]resolvedName, len(resolver.entries))
+	for ID, entry := range resolver.entries {
+		if now.Before(entry.Expires) {
+			entries[ID] = entry
+		}
+	}
+	resolver.mux.Unlock()
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(resolver.path, data)
+}
+
+// saveNamesEvery periodically saves the name cache until the context is cancelled
+func (bot *ZKillBot) saveNamesEvery(cContext context.Context, interval time.Duration) {
+	log := bot.log
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cContext.Done():
+			log.Debugf("Exited saveNamesEvery thread")
+			return
+		case <-ticker.C:
+			err := bot.names.Save()
+			if err != nil {
+				log.Errorf("Failed to save name cache: %v", err)
+				break
+			}
+			hits, misses := bot.names.Stats()
+			log.Debugf("Saved name cache, hits: %v, misses: %v", hits, misses)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/antihax/goesi/esi"
+)
+
+// fakeNameLookup answers every ID with a generated name and records the requests
+type fakeNameLookup struct {
+	requests [][]int32
+}
+
+func (fake *fakeNameLookup) lookup(ctx context.Context, IDs []int32) ([]esi.PostUniverseNames200Ok, error) {
+	fake.requests = append(fake.requests, IDs)
+
+	var names []esi.PostUniverseNames200Ok
+	for _, ID := range IDs {
+		names = append(names, esi.PostUniverseNames200Ok{Id: ID, Name: "Name", Category: "character"})
+	}
+	return names, nil
+}
+
+func TestNameResolver_Resolve(t *testing.T) {
+	fake := &fakeNameLookup{}
+	resolver := newNameResolver(fake.lookup, time.Hour, "")
+
+	// First request misses, zero and duplicate IDs are dropped
+	names, err := resolver.Resolve(context.Background(), []int32{1, 2, 2, 0})
+	if err != nil || len(names) != 2 {
+		t.Logf("Expected 2 names, but got %v, %v", names, err)
+		t.FailNow()
+	}
+
+	// Second request only asks ESI for the new ID
+	names, _ = resolver.Resolve(context.Background(), []int32{1, 2, 3})
+	if len(names) != 3 || len(fake.requests) != 2 || len(fake.requests[1]) != 1 {
+		t.Logf("Expected only the uncached ID to be requested, but got %v", fake.requests)
+		t.Fail()
+	}
+
+	hits, misses := resolver.Stats()
+	if hits != 2 || misses != 3 {
+		t.Logf("Expected 2 hits and 3 misses, but got %v and %v", hits, misses)
+		t.Fail()
+	}
+}
+
+func TestNameResolver_ResolveExpired(t *testing.T) {
+	fake := &fakeNameLookup{}
+	resolver := newNameResolver(fake.lookup, -time.Second, "")
+
+	// Entries expire immediately so each resolve goes to ESI
+	resolver.Resolve(context.Background(), []int32{1})
+	resolver.Resolve(context.Background(), []int32{1})
+
+	if len(fake.requests) != 2 {
+		t.Logf("Expected expired entries to be requested again, but got %v", fake.requests)
+		t.Fail()
+	}
+}
+
+func TestNameResolver_ResolveBatches(t *testing.T) {
+	fake := &fakeNameLookup{}
+	resolver := newNameResolver(fake.lookup, time.Hour, "")
+
+	var IDs []int32
+	for ID := int32(1); ID <= esiMaxNameIDs+1; ID++ {
+		IDs = append(IDs, ID)
+	}
+	resolver.Resolve(context.Background(), IDs)
+
+	if len(fake.requests) != 2 || len(fake.requests[0]) != esiMaxNameIDs {
+		t.Logf("Expected IDs to be split into 2 ESI requests, but got %v", len(fake.requests))
+		t.Fail()
+	}
+}
+
+func TestNameResolver_SaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zkillbot")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "names.json")
+
+	fake := &fakeNameLookup{}
+	resolver := newNameResolver(fake.lookup, time.Hour, path)
+	resolver.Resolve(context.Background(), []int32{1, 2})
+	err = resolver.Save()
+	if err != nil {
+		t.Logf("Failed to save name cache: %v", err)
+		t.FailNow()
+	}
+
+	// A new resolver using the same file should not need ESI
+	fake = &fakeNameLookup{}
+	resolver = newNameResolver(fake.lookup, time.Hour, path)
+	err = resolver.load()
+	if err != nil {
+		t.Logf("Failed to load name cache: %v", err)
+		t.FailNow()
+	}
+	names, _ := resolver.Resolve(context.Background(), []int32{1, 2})
+	if len(names) != 2 || len(fake.requests) != 0 {
+		t.Logf("Expected names to be loaded from disk, but ESI was asked for %v", fake.requests)
+		t.Fail()
+	}
+}
+
+func TestNameResolver_NoPath(t *testing.T) {
+	resolver := newNameResolver((&fakeNameLookup{}).lookup, time.Hour, "")
+
+	// Without a path the cache only lives in memory
+	if err := resolver.load(); err != nil {
+		t.Logf("Expected nothing to load, got %v", err)
+		t.Fail()
+	}
+	if err := resolver.Save(); err != nil {
+		t.Logf("Expected nothing to save, got %v", err)
+		t.Fail()
+	}
+}
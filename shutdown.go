@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// goRun runs f on a goroutine that Shutdown waits for
+func (bot *ZKillBot) goRun(f func()) {
+	bot.wg.Add(1)
+	go func() {
+		defer bot.wg.Done()
+		f()
+	}()
+}
+
+// Shutdown waits up to timeout for every goroutine to stop, then closes discord and saves state.
+// The context the goroutines were started with must already be cancelled.
+//
+// An error is returned if the goroutines or the outbox did not stop in time, state is then left as it is
+// rather than closed under threads still using it.
+func (bot *ZKillBot) Shutdown(timeout time.Duration) error {
+	log := bot.log
+
+	done := make(chan struct{})
+	go func() {
+		bot.wg.Wait()
+		close(done)
+	}()
+
+	var shutdownErr error
+	deadline := time.After(timeout)
+	select {
+	case <-done:
+		log.Debugf("All threads exited")
+	case <-deadline:
+		shutdownErr = fmt.Errorf("timed out after %v waiting for pending work", timeout)
+	}
+
+	// Send what's left in the outbox, within the same timeout
+	if bot.outbox != nil && shutdownErr == nil {
+		bot.outbox.Close()
+		sent := make(chan struct{})
+		go func() {
+			bot.outbox.Wait()
+			close(sent)
+		}()
+		select {
+		case <-sent:
+			log.Debugf("Outbox drained")
+		case <-deadline:
+			shutdownErr = fmt.Errorf("timed out after %v sending queued discord messages", timeout)
+		}
+	}
+
+	// Cleanly exit
+	if bot.discord != nil {
+		err := bot.discord.Close()
+		if err != nil {
+			log.Errorf("Failed to close discord session: %v", err)
+		}
+	}
+
+	// Threads still running may be using the store, and kills still queued would be saved as sent
+	if shutdownErr != nil {
+		log.Warnf("Not closing the subscription database or saving the name cache and seen kills, %v, state may be incomplete", shutdownErr)
+		return shutdownErr
+	}
+	if bot.store != nil {
+		err := bot.store.Close()
+		if err != nil {
+			log.Errorf("Failed to close subscription database: %v", err)
+		}
+	}
+	if bot.names != nil {
+		err := bot.names.Save()
+		if err != nil {
+			log.Errorf("Failed to save name cache: %v", err)
+		}
+	}
+	if bot.seen != nil {
+		err := bot.seen.Save()
+		if err != nil {
+			log.Errorf("Failed to save seen kills: %v", err)
+		}
+	}
+
+	return shutdownErr
+}
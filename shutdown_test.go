@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestZKillBot_Shutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zkillbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "seen.json")
+
+	seen, _ := NewKillDeduper(time.Hour, 100, path)
+	bot := &ZKillBot{
+		log:   log.StandardLogger(),
+		store: NewMemoryStore(),
+		seen:  seen,
+	}
+
+	stop := make(chan struct{})
+	bot.goRun(func() { <-stop })
+
+	// Still running goroutines time out
+	err = bot.Shutdown(10 * time.Millisecond)
+	if err == nil {
+		t.Logf("Expected shutdown to time out")
+		t.Fail()
+	}
+	if _, statErr := os.Stat(path); !os.IsNotExist(statErr) {
+		t.Logf("Expected seen kills not to be saved after timing out, got %v", statErr)
+		t.Fail()
+	}
+
+	close(stop)
+	err = bot.Shutdown(time.Second)
+	if err != nil {
+		t.Logf("Expected shutdown to succeed, got %v", err)
+		t.Fail()
+	}
+	if _, statErr := os.Stat(path); statErr != nil {
+		t.Logf("Expected seen kills to be saved, got %v", statErr)
+		t.Fail()
+	}
+}
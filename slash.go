@@ -0,0 +1,470 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// slashPrefix is used as the prefix of commands arriving as slash commands
+const slashPrefix = "/"
+
+// slashMinValue is the lowest min_value accepted by discord for /track add
+var slashMinValue = float64(0)
+
+// slashCommands are the application commands registered with discord, each maps onto a text command
+var slashCommands = []*discordgo.ApplicationCommand{
+	{
+		Name:        "lookup",
+		Description: "Search for alliance, corporation and character IDs by name",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "search",
+				Description: "Name to search for, at least 3 characters",
+				Required:    true,
+			},
+		},
+	},
+	{
+		Name:        "track",
+		Description: "Manage the eve IDs tracked in this channel",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "add",
+				Description: "Add a eve ID to tracking",
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:         discordgo.ApplicationCommandOptionString,
+						Name:         "id",
+						Description:  "Eve ID, or start typing a name to search",
+						Required:     true,
+						Autocomplete: true,
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionInteger,
+						Name:        "min_value",
+						Description: "Minimum isk value of kills",
+						MinValue:    &slashMinValue,
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "direction",
+						Description: "Track kills, losses or both",
+						Choices: []*discordgo.ApplicationCommandOptionChoice{
+							{Name: "Both", Value: directionBoth},
+							{Name: "Kills", Value: directionKills},
+							{Name: "Losses", Value: directionLosses},
+						},
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "ships",
+						Description: "Ship groups or types, comma separated, prefix with ! to exclude losses of them",
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "region",
+						Description: "Only kills in these regions, comma separated",
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "constellation",
+						Description: "Only kills in these constellations, comma separated",
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "system",
+						Description: "Only kills in these solar systems, comma separated",
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "space",
+						Description: "Only kills in highsec, lowsec, nullsec, wormhole or pochven space, comma separated",
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "attackers",
+						Description: "Number of attackers: solo, small (2-10), fleet (11+) or a range like 2-10 or 10+",
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionBoolean,
+						Name:        "no_npc",
+						Description: "Ignore kills made only by NPCs",
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "filter",
+						Description: "Filter expression, e.g. value > 1b && region == \"Delve\" && !npc",
+					},
+				},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "remove",
+				Description: "Remove a eve ID from tracking, every ID is removed if none is given",
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:         discordgo.ApplicationCommandOptionString,
+						Name:         "id",
+						Description:  "Tracked eve ID",
+						Autocomplete: true,
+					},
+				},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "list",
+				Description: "List all tracked IDs and their names/types",
+			},
+		},
+	},
+	{
+		Name:        "status",
+		Description: "Show the kill feed's connection status",
+	},
+}
+
+// registerSlashCommands registers slashCommands with discord.
+// Failure is not fatal, text commands keep working for servers without the application commands scope.
+func (bot *ZKillBot) registerSlashCommands() {
+	log := bot.log
+
+	_, err := bot.sender.ApplicationCommandBulkOverwrite(bot.discord.State.User.ID, "", slashCommands)
+	if err != nil {
+		log.Warnf("Failed to register slash commands, only text commands are available: %v", err)
+		return
+	}
+	log.Infof("Registered %v slash commands", len(slashCommands))
+}
+
+// discordInteraction is a callback function that executes whenever a slash command is used or autocompleted
+func (bot *ZKillBot) discordInteraction(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	log := bot.log
+
+	switch i.Type {
+	case discordgo.InteractionApplicationCommand:
+		data := i.ApplicationCommandData()
+		subCommand, options := slashOptions(data)
+		args := slashCommandArgs(data)
+
+		// Acknowledge now, commands that call ESI can take longer than discord waits for a response
+		err := bot.sender.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		})
+		if err != nil {
+			log.Errorf("Failed to acknowledge slash command %v: %v", data.Name, err)
+			return
+		}
+
+		message := discordCommand{
+			GuildID:   i.GuildID,
+			ChannelID: i.ChannelID,
+			Message:   strings.TrimSpace(slashPrefix + data.Name + " " + args),
+			Prefix:    slashPrefix,
+			Command:   data.Name,
+			Args:      args,
+
+			SubCommand: subCommand,
+			Options:    options,
+
+			commandResponder: &interactionResponder{
+				discord:     bot.sender,
+				interaction: i.Interaction,
+			},
+		}
+		// Member is only set for commands used in a guild, with permissions already resolved for the channel
+		if i.Member != nil {
+			message.Roles = i.Member.Roles
+			message.Permissions = i.Member.Permissions
+			if i.Member.User != nil {
+				message.AuthorID = i.Member.User.ID
+			}
+		} else if i.User != nil {
+			message.AuthorID = i.User.ID
+		}
+		if !bot.commands.Queue(message) {
+			message.ReplyError(fmt.Sprintf("Unknown command %v", data.Name))
+		}
+
+	case discordgo.InteractionApplicationCommandAutocomplete:
+		choices := bot.slashAutocomplete(i.ChannelID, i.ApplicationCommandData())
+		err := bot.sender.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionApplicationCommandAutocompleteResult,
+			Data: &discordgo.InteractionResponseData{
+				Choices: choices,
+			},
+		})
+		if err != nil {
+			log.Errorf("Failed to send autocomplete choices: %v", err)
+		}
+	}
+}
+
+// slashOptions returns the sub-command used, if any, and the options given to the command or its sub-command by name
+func slashOptions(data discordgo.ApplicationCommandInteractionData) (subCommand string, options map[string]*discordgo.ApplicationCommandInteractionDataOption) {
+	given := data.Options
+	if len(given) == 1 && given[0].Type == discordgo.ApplicationCommandOptionSubCommand {
+		subCommand = given[0].Name
+		given = given[0].Options
+	}
+
+	options = make(map[string]*discordgo.ApplicationCommandInteractionDataOption)
+	for _, option := range given {
+		options[option.Name] = option
+	}
+	return subCommand, options
+}
+
+// slashCommandArgs joins the sub-command and option values of a slash command into the arguments of the matching text command.
+// Commands without sub-commands, e.g. lookup, are handled from these arguments, sub-commands use the typed options.
+func slashCommandArgs(data discordgo.ApplicationCommandInteractionData) string {
+	options := data.Options
+
+	var parts []string
+	if len(options) == 1 && options[0].Type == discordgo.ApplicationCommandOptionSubCommand {
+		parts = append(parts, options[0].Name)
+		options = options[0].Options
+	}
+	for _, option := range options {
+		switch option.Type {
+		case discordgo.ApplicationCommandOptionInteger:
+			parts = append(parts, strconv.FormatInt(option.IntValue(), 10))
+		case discordgo.ApplicationCommandOptionBoolean:
+			parts = append(parts, option.Name+"="+strconv.FormatBool(option.BoolValue()))
+		default:
+			parts = append(parts, strings.TrimSpace(option.StringValue()))
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// slashTrackFilters are the options of /track add setting a filter, in the order they are parsed
+var slashTrackFilters = []string{"ships", locationRegion, locationConstellation, locationSystem, "space", "attackers", "filter"}
+
+// slashTrack handles /track, each sub-command goes straight to its handler with the typed options
+func (bot *ZKillBot) slashTrack(message discordCommand) {
+	log := bot.log
+	options := message.Options
+
+	switch message.SubCommand {
+	case "add":
+		log.Info("Add ID slash sub-command")
+		if !bot.permissions.RequireManage(message) {
+			return
+		}
+
+		// Names are picked from autocomplete which fills in the ID, anything else typed is rejected
+		id, err := slashEveID(options["id"])
+		if err != nil {
+			message.ReplyError("ID to add must be numeric, pick a name from the suggestions to use its ID")
+			return
+		}
+		subData := &subscriptionData{
+			EveID:     id,
+			Direction: directionBoth,
+		}
+		if option, ok := options["min_value"]; ok {
+			subData.MinVal = int(option.IntValue())
+		}
+		if option, ok := options["direction"]; ok {
+			subData.Direction = option.StringValue()
+		}
+		if option, ok := options["no_npc"]; ok {
+			subData.NoNPC = option.BoolValue()
+		}
+		for _, name := range slashTrackFilters {
+			option, ok := options[name]
+			if !ok {
+				continue
+			}
+			err = bot.setTrackFilter(subData, name, strings.TrimSpace(option.StringValue()))
+			if err != nil {
+				log.Errorf("Invalid %v filter %q: %v", name, option.StringValue(), err)
+				message.ReplyError(err.Error())
+				return
+			}
+		}
+
+		bot.zkillboardAddID(message, subData)
+
+	case "remove":
+		log.Info("Remove slash sub-command")
+		if !bot.permissions.RequireManage(message) {
+			return
+		}
+
+		// Without an ID every ID is removed
+		option, ok := options["id"]
+		if !ok {
+			bot.zkillboardRemoveAllIDs(message)
+			return
+		}
+		id, err := slashEveID(option)
+		if err != nil {
+			message.ReplyError("ID to remove must be numeric, pick one from the suggestions")
+			return
+		}
+		bot.zkillboardRemoveID(message, id)
+
+	case "list":
+		log.Info("List slash sub-command")
+		bot.zkillboardListIDs(message)
+
+	default:
+		log.Debugf("Invalid track slash sub-command %q", message.SubCommand)
+		message.ReplyError("Unknown sub-command " + message.SubCommand)
+	}
+}
+
+// slashEveID returns the eve ID given in an id option
+func slashEveID(option *discordgo.ApplicationCommandInteractionDataOption) (int, error) {
+	if option == nil {
+		return 0, fmt.Errorf("no ID given")
+	}
+	return strconv.Atoi(strings.TrimSpace(option.StringValue()))
+}
+
+// slashMaxChoices is the most autocomplete choices discord accepts
+const slashMaxChoices = 25
+
+// slashAutocomplete returns choices for the focused option of a slash command
+func (bot *ZKillBot) slashAutocomplete(channelID string, data discordgo.ApplicationCommandInteractionData) []*discordgo.ApplicationCommandOptionChoice {
+	log := bot.log
+
+	if data.Name != "track" || len(data.Options) != 1 {
+		return nil
+	}
+	subCommand := data.Options[0]
+
+	// Find what is being typed
+	var focused *discordgo.ApplicationCommandInteractionDataOption
+	for _, option := range subCommand.Options {
+		if option.Focused {
+			focused = option
+		}
+	}
+	if focused == nil || focused.Name != "id" {
+		return nil
+	}
+	typed := strings.ToLower(strings.TrimSpace(focused.StringValue()))
+
+	choices := []*discordgo.ApplicationCommandOptionChoice{}
+	switch subCommand.Name {
+	case "remove":
+		// IDs already tracked in the channel
+		bot.mux.Lock()
+		var subs []*subscriptionData
+		for _, subData := range bot.dataStorage.ChannelMap[channelID] {
+			subs = append(subs, subData)
+		}
+		bot.mux.Unlock()
+		sortSubscriptions(subs)
+
+		for _, subData := range subs {
+			name := fmt.Sprintf("%v (%v: %v)", subData.EveID, subData.EveCategory, subData.EveName)
+			if len(choices) < slashMaxChoices && strings.Contains(strings.ToLower(name), typed) {
+				choices = append(choices, &discordgo.ApplicationCommandOptionChoice{Name: name, Value: strconv.Itoa(subData.EveID)})
+			}
+		}
+
+	case "add":
+		// IDs can be typed directly, ESI requires at least 3 characters to search
+		if _, err := strconv.Atoi(typed); err == nil || len(typed) < 3 {
+			return choices
+		}
+
+		search, response, err := bot.esiClient.ESI.SearchApi.GetSearch(bot.ctx, []string{"alliance", "character", "corporation"}, typed, nil)
+		if err != nil || response.StatusCode != http.StatusOK {
+			log.Errorf("EVE ESI autocomplete search failed, err: %v", err)
+			return choices
+		}
+		var IDs []int32
+		IDs = append(IDs, search.Alliance...)
+		IDs = append(IDs, search.Corporation...)
+		IDs = append(IDs, search.Character...)
+		if len(IDs) > slashMaxChoices {
+			IDs = IDs[:slashMaxChoices]
+		}
+
+		names, err := bot.names.Resolve(bot.ctx, IDs)
+		if err != nil {
+			log.Errorf("EVE ESI autocomplete name lookup failed, err: %v", err)
+			return choices
+		}
+		for _, ID := range IDs {
+			if name, ok := names[ID]; ok {
+				choices = append(choices, &discordgo.ApplicationCommandOptionChoice{
+					Name:  fmt.Sprintf("%v (%v)", name.Name, name.Category),
+					Value: strconv.Itoa(int(ID)),
+				})
+			}
+		}
+	}
+
+	return choices
+}
+
+// interactionResponder replies to slash commands through the interaction.
+//
+// The interaction is acknowledged with a deferred response before the command runs, the first reply replaces it.
+// Errors are sent as ephemeral follow ups so only the user who ran the command sees them.
+type interactionResponder struct {
+	discord     DiscordSender
+	interaction *discordgo.Interaction
+
+	mux     sync.Mutex
+	replied bool
+}
+
+// Reply sends a message visible to the channel
+func (responder *interactionResponder) Reply(content string) error {
+	return responder.send(&discordgo.WebhookParams{Content: content}, false)
+}
+
+// ReplyEmbed sends an embed visible to the channel
+func (responder *interactionResponder) ReplyEmbed(embed *discordgo.MessageEmbed) error {
+	return responder.send(&discordgo.WebhookParams{Embeds: []*discordgo.MessageEmbed{embed}}, false)
+}
+
+// ReplyError sends a message only visible to the user who ran the command
+func (responder *interactionResponder) ReplyError(content string) error {
+	return responder.send(&discordgo.WebhookParams{Content: content}, true)
+}
+
+// send replaces the deferred response with the first reply, or follows up for any after it
+func (responder *interactionResponder) send(params *discordgo.WebhookParams, ephemeral bool) error {
+	responder.mux.Lock()
+	defer responder.mux.Unlock()
+
+	first := !responder.replied
+	responder.replied = true
+
+	if first && !ephemeral {
+		edit := &discordgo.WebhookEdit{}
+		if len(params.Content) > 0 {
+			edit.Content = &params.Content
+		}
+		if len(params.Embeds) > 0 {
+			edit.Embeds = &params.Embeds
+		}
+		_, err := responder.discord.InteractionResponseEdit(responder.interaction, edit)
+		return err
+	}
+
+	// The deferred response is visible to everyone, remove it before following up privately
+	if first {
+		responder.discord.InteractionResponseDelete(responder.interaction)
+	}
+	if ephemeral {
+		params.Flags = discordgo.MessageFlagsEphemeral
+	}
+	_, err := responder.discord.FollowupMessageCreate(responder.interaction, true, params)
+	return err
+}
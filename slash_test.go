@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestSlashCommandArgs(t *testing.T) {
+	stringOption := func(name string, value string) *discordgo.ApplicationCommandInteractionDataOption {
+		return &discordgo.ApplicationCommandInteractionDataOption{Name: name, Type: discordgo.ApplicationCommandOptionString, Value: value}
+	}
+	subCommand := func(name string, options ...*discordgo.ApplicationCommandInteractionDataOption) *discordgo.ApplicationCommandInteractionDataOption {
+		return &discordgo.ApplicationCommandInteractionDataOption{Name: name, Type: discordgo.ApplicationCommandOptionSubCommand, Options: options}
+	}
+	minValue := &discordgo.ApplicationCommandInteractionDataOption{Name: "min_value", Type: discordgo.ApplicationCommandOptionInteger, Value: float64(1000)}
+	noNPC := &discordgo.ApplicationCommandInteractionDataOption{Name: "no_npc", Type: discordgo.ApplicationCommandOptionBoolean, Value: true}
+
+	tests := []struct {
+		data discordgo.ApplicationCommandInteractionData
+		args string
+	}{
+		{discordgo.ApplicationCommandInteractionData{Name: "lookup", Options: []*discordgo.ApplicationCommandInteractionDataOption{stringOption("search", " Goonswarm Federation ")}}, "Goonswarm Federation"},
+		{discordgo.ApplicationCommandInteractionData{Name: "track", Options: []*discordgo.ApplicationCommandInteractionDataOption{subCommand("add", stringOption("id", "1354830081"), minValue, stringOption("region", "The Forge"), noNPC)}}, "add 1354830081 1000 The Forge no_npc=true"},
+		{discordgo.ApplicationCommandInteractionData{Name: "track", Options: []*discordgo.ApplicationCommandInteractionDataOption{subCommand("list")}}, "list"},
+	}
+
+	for _, test := range tests {
+		args := slashCommandArgs(test.data)
+		if args != test.args {
+			t.Logf("Expected %q, got %q", test.args, args)
+			t.Fail()
+		}
+	}
+}
+
+func TestZKillBot_slashTrack(t *testing.T) {
+	bot := testBot()
+	bot.kills = newFakeKillSource()
+	bot.dataStorage.addSubscription(&subscriptionData{DiscordChannelID: "chan-a", EveID: 100, EveCategory: "character"})
+
+	track := func(subCommand string, options ...*discordgo.ApplicationCommandInteractionDataOption) *fakeResponder {
+		responder := &fakeResponder{}
+		_, given := slashOptions(discordgo.ApplicationCommandInteractionData{Name: "track", Options: []*discordgo.ApplicationCommandInteractionDataOption{
+			{Name: subCommand, Type: discordgo.ApplicationCommandOptionSubCommand, Options: options},
+		}})
+		bot.zKillboardTrack(discordCommand{ChannelID: "chan-a", Prefix: slashPrefix, Command: "track", SubCommand: subCommand, Options: given, commandResponder: responder})
+		return responder
+	}
+	id := func(value string) *discordgo.ApplicationCommandInteractionDataOption {
+		return &discordgo.ApplicationCommandInteractionDataOption{Name: "id", Type: discordgo.ApplicationCommandOptionString, Value: value}
+	}
+
+	// IDs that look like other sub-commands or names are rejected, not matched as text
+	for _, value := range []string{"remove", "list", "Goonswarm Federation"} {
+		responder := track("add", id(value))
+		if len(responder.errors) != 1 || !strings.Contains(responder.errors[0], "must be numeric") || len(responder.replies) != 0 {
+			t.Logf("Expected /track add id:%v to be rejected, got %v %v", value, responder.errors, responder.replies)
+			t.Fail()
+		}
+	}
+	responder := track("remove", id("list"))
+	if len(responder.errors) != 1 || !strings.Contains(responder.errors[0], "must be numeric") {
+		t.Logf("Expected /track remove id:list to be rejected, got %v", responder.errors)
+		t.Fail()
+	}
+	if _, ok := bot.dataStorage.ChannelMap["chan-a"][100]; !ok {
+		t.Logf("Expected ID 100 to still be tracked")
+		t.Fail()
+	}
+
+	// The typed ID is removed
+	responder = track("remove", id("100"))
+	if len(responder.errors) != 0 || len(responder.replies) != 1 {
+		t.Logf("Expected ID 100 removed, got %v %v", responder.errors, responder.replies)
+		t.Fail()
+	}
+	if _, ok := bot.dataStorage.ChannelMap["chan-a"][100]; ok {
+		t.Logf("Expected ID 100 to no longer be tracked")
+		t.Fail()
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+)
+
+// statusWatcher turns changes of the kill feed's state into status messages
+type statusWatcher struct {
+	// connected is the state at the last observation, everConnected is set after the first connect
+	connected     bool
+	everConnected bool
+	// When the disconnect was noticed and the last message before it
+	disconnected time.Time
+	downSince    time.Time
+	maxBackoff   bool
+}
+
+// observe returns status messages for what changed since the last observation.
+// backfillSince is set when the feed reconnected, to the last message received before it went down.
+func (watcher *statusWatcher) observe(state KillSourceState, stats KillSourceStats, lastMessage time.Time, now time.Time) (messages []string, backfillSince time.Time) {
+	if state == KillSourceConnected {
+		if !watcher.connected && watcher.everConnected {
+			down := now.Sub(watcher.disconnected).Round(time.Second)
+			messages = append(messages, fmt.Sprintf("Kill feed reconnected after %v down, %v subscriptions replayed", down, stats.Replayed))
+			backfillSince = watcher.downSince
+		}
+		watcher.connected = true
+		watcher.everConnected = true
+		watcher.maxBackoff = false
+		return messages, backfillSince
+	}
+
+	if watcher.connected {
+		last := "never"
+		if !lastMessage.IsZero() {
+			last = lastMessage.UTC().Format(time.RFC3339)
+		}
+		messages = append(messages, fmt.Sprintf("Kill feed disconnected, last message at %v", last))
+		watcher.connected = false
+		watcher.disconnected = now
+		watcher.downSince = lastMessage
+	}
+	if stats.MaxBackoff && !watcher.maxBackoff {
+		messages = append(messages, "Kill feed reconnect backoff reached its maximum, still retrying")
+	}
+	watcher.maxBackoff = stats.MaxBackoff
+
+	return messages, backfillSince
+}
+
+// watchKillSource reports kill feed state changes to the status channel and backfills kills whenever the feed reconnects,
+// until the context is cancelled
+func (bot *ZKillBot) watchKillSource(cContext context.Context) {
+	log := bot.log
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	watcher := &statusWatcher{}
+	for {
+		select {
+		case <-cContext.Done():
+			log.Debugf("Exited watchKillSource thread")
+			return
+		case <-ticker.C:
+		}
+
+		messages, backfillSince := watcher.observe(bot.kills.State(), bot.kills.Stats(), bot.kills.LastMessage(), time.Now())
+		for _, message := range messages {
+			bot.notifyStatus(message)
+		}
+
+		if !backfillSince.IsZero() {
+			log.Infof("Kill feed reconnected, backfilling kills since %v", backfillSince.Format(time.RFC3339))
+			bot.goRun(func() { bot.backfill(cContext, backfillSince) })
+		}
+	}
+}
+
+// notifyStatus logs a status message and sends it to the status channel if one is configured
+func (bot *ZKillBot) notifyStatus(message string) {
+	log := bot.log
+
+	log.Info(message)
+
+	channelID := bot.viperConfig.GetString("status_channel")
+	if len(channelID) == 0 || bot.outbox == nil {
+		return
+	}
+	bot.outbox.Send(channelID, outboundMessage{Content: message})
+}
+
+// statusCmd replies with the state of the kill feed
+func (bot *ZKillBot) statusCmd(message discordCommand) {
+	now := time.Now()
+	stats := bot.kills.Stats()
+
+	// connected for, or how long since the last message if not
+	connected := "-"
+	if !stats.Connected.IsZero() {
+		connected = now.Sub(stats.Connected).Round(time.Second).String()
+	}
+	lastMessage := "never"
+	if last := bot.kills.LastMessage(); !last.IsZero() {
+		lastMessage = fmt.Sprintf("%v (%v ago)", last.UTC().Format(time.RFC3339), now.Sub(last).Round(time.Second))
+	}
+
+	bot.mux.Lock()
+	IDs := len(bot.dataStorage.SubMap)
+	channels := len(bot.dataStorage.ChannelMap)
+	bot.mux.Unlock()
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%-15v %v (%v)\n", "Kill feed:", bot.kills.State(), bot.viperConfig.GetString("kill_source"))
+	fmt.Fprintf(&buf, "%-15v %v\n", "Connected for:", connected)
+	fmt.Fprintf(&buf, "%-15v %v\n", "Last message:", lastMessage)
+	fmt.Fprintf(&buf, "%-15v %v\n", "Reconnects:", stats.Reconnects)
+	fmt.Fprintf(&buf, "%-15v %v IDs in %v channels\n", "Tracking:", IDs, channels)
+	if bot.outbox != nil {
+		outbox := bot.outbox.Stats()
+		fmt.Fprintf(&buf, "%-15v %v sent, %v batched, %v retried, %v delayed, %v dropped, %v queued\n", "Messages:", outbox.Sent, outbox.Batched, outbox.Retried, outbox.Delayed, outbox.Dropped, outbox.Queued)
+	}
+	fmt.Fprintf(&buf, "%-15v %v\n", "Uptime:", now.Sub(bot.started).Round(time.Second))
+
+	// send to discord as code block
+	message.Reply("```" + buf.String() + "```")
+}
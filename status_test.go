@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatusWatcher_observe(t *testing.T) {
+	watcher := &statusWatcher{}
+	start := time.Now()
+	lastMessage := start.Add(-time.Second)
+
+	// The first connect isn't reported
+	messages, backfillSince := watcher.observe(KillSourceConnected, KillSourceStats{}, lastMessage, start)
+	if len(messages) != 0 || !backfillSince.IsZero() {
+		t.Logf("Expected no messages on first connect, got %v", messages)
+		t.Fail()
+	}
+
+	// Disconnect
+	messages, _ = watcher.observe(KillSourceBackoff, KillSourceStats{}, lastMessage, start.Add(time.Minute))
+	if len(messages) != 1 || !strings.Contains(messages[0], "disconnected") {
+		t.Logf("Expected a disconnect message, got %v", messages)
+		t.Fail()
+	}
+
+	// Backoff at its maximum is only reported once
+	messages, _ = watcher.observe(KillSourceBackoff, KillSourceStats{MaxBackoff: true}, lastMessage, start.Add(2*time.Minute))
+	if len(messages) != 1 || !strings.Contains(messages[0], "maximum") {
+		t.Logf("Expected a max backoff message, got %v", messages)
+		t.Fail()
+	}
+	messages, _ = watcher.observe(KillSourceBackoff, KillSourceStats{MaxBackoff: true}, lastMessage, start.Add(3*time.Minute))
+	if len(messages) != 0 {
+		t.Logf("Expected no repeated messages, got %v", messages)
+		t.Fail()
+	}
+
+	// Reconnect reports downtime and replayed subscriptions, backfilling from the last message
+	messages, backfillSince = watcher.observe(KillSourceConnected, KillSourceStats{Replayed: 12}, lastMessage, start.Add(4*time.Minute))
+	if len(messages) != 1 || !strings.Contains(messages[0], "after 3m0s down, 12 subscriptions replayed") {
+		t.Logf("Expected a reconnect message, got %v", messages)
+		t.Fail()
+	}
+	if !backfillSince.Equal(lastMessage) {
+		t.Logf("Expected backfill since %v, got %v", lastMessage, backfillSince)
+		t.Fail()
+	}
+}
+
+func TestZKillBot_statusCmd(t *testing.T) {
+	source := newFakeKillSource()
+	source.setState(KillSourceConnected)
+	source.stats = KillSourceStats{Connected: time.Now().Add(-time.Hour), Reconnects: 3}
+
+	bot := testBot()
+	bot.kills = source
+
+	responder := &fakeResponder{}
+	bot.statusCmd(discordCommand{commandResponder: responder})
+	if len(responder.replies) != 1 {
+		t.Fatalf("Expected 1 reply, got %v", responder.replies)
+	}
+	for _, expected := range []string{"connected", "Reconnects:     3", "1h0m0s"} {
+		if !strings.Contains(responder.replies[0], expected) {
+			t.Logf("Expected %q in status:\n%v", expected, responder.replies[0])
+			t.Fail()
+		}
+	}
+}
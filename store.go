@@ -0,0 +1,156 @@
+package main
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// SubscriptionStore persists the subscriptions between discord channels and eve IDs.
+//
+// DataStorage remains the in memory index used for routing kills, the store is only read when the bot starts.
+// Every write is a single transaction, either all subscriptions passed are written or none are.
+type SubscriptionStore interface {
+	// Add saves the subscriptions, replacing any existing subscription for the same channel and eve ID
+	Add(subs ...*subscriptionData) error
+	// Remove deletes the channel's subscriptions to the eve IDs, IDs that are not tracked are ignored
+	Remove(channelID string, eveIDs ...int) error
+	// List returns every saved subscription
+	List() ([]*subscriptionData, error)
+	// Close releases the store
+	Close() error
+}
+
+// MemoryStore is a SubscriptionStore that only lives as long as the process, used by tests.
+type MemoryStore struct {
+	mux  sync.Mutex
+	subs map[string]map[int]subscriptionData
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		subs: make(map[string]map[int]subscriptionData),
+	}
+}
+
+// Add saves the subscriptions
+func (store *MemoryStore) Add(subs ...*subscriptionData) error {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+
+	for _, subData := range subs {
+		if _, ok := store.subs[subData.DiscordChannelID]; !ok {
+			store.subs[subData.DiscordChannelID] = make(map[int]subscriptionData)
+		}
+		// store a copy so later changes to subData are not saved without an Add
+		store.subs[subData.DiscordChannelID][subData.EveID] = *subData
+	}
+
+	return nil
+}
+
+// Remove deletes the channel's subscriptions to the eve IDs
+func (store *MemoryStore) Remove(channelID string, eveIDs ...int) error {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+
+	for _, eveID := range eveIDs {
+		delete(store.subs[channelID], eveID)
+	}
+	if len(store.subs[channelID]) == 0 {
+		delete(store.subs, channelID)
+	}
+
+	return nil
+}
+
+// List returns every saved subscription ordered by channel then eve ID
+func (store *MemoryStore) List() ([]*subscriptionData, error) {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+
+	var subs []*subscriptionData
+	for _, channel := range store.subs {
+		for _, subData := range channel {
+			subCopy := subData
+			subs = append(subs, &subCopy)
+		}
+	}
+	sortSubscriptions(subs)
+
+	return subs, nil
+}
+
+// Close does nothing for a MemoryStore
+func (store *MemoryStore) Close() error {
+	return nil
+}
+
+// sortSubscriptions orders subscriptions by channel then eve ID
+func sortSubscriptions(subs []*subscriptionData) {
+	sort.Slice(subs, func(i, j int) bool {
+		if subs[i].DiscordChannelID != subs[j].DiscordChannelID {
+			return subs[i].DiscordChannelID < subs[j].DiscordChannelID
+		}
+		return subs[i].EveID < subs[j].EveID
+	})
+}
+
+// newDataStorage builds the in memory index from the subscriptions saved in the store
+func newDataStorage(store SubscriptionStore) (*DataStorage, error) {
+	dataStorage := &DataStorage{
+		SubMap:     make(map[int]map[string]*subscriptionData, 10),
+		ChannelMap: make(map[string]map[int]*subscriptionData, 10),
+	}
+
+	subs, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, subData := range subs {
+		dataStorage.addSubscription(subData)
+	}
+
+	return dataStorage, nil
+}
+
+// migrateViperData imports subscriptions saved in the config file by older versions into the store.
+//
+// The import only happens while the store is empty, afterwards the datastorage key is cleared from the config file.
+func migrateViperData(config *viper.Viper, store SubscriptionStore, log *logrus.Logger) error {
+	data := config.Get("datastorage")
+	if len(config.GetStringMap("datastorage")) == 0 {
+		return nil
+	}
+
+	// Never overwrite an existing store
+	existing, err := store.List()
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		log.Warn("Subscription store already has data, skipping import of datastorage from the config file")
+		return nil
+	}
+
+	// Import every subscription in a single transaction
+	dataStorage := loadViperData(data, log)
+	var subs []*subscriptionData
+	for _, channel := range dataStorage.ChannelMap {
+		for _, subData := range channel {
+			subs = append(subs, subData)
+		}
+	}
+	err = store.Add(subs...)
+	if err != nil {
+		return err
+	}
+	log.Infof("Imported %v subscriptions from the config file", len(subs))
+
+	// Clear the old data from the config file, viper ignores nil and merges maps so an empty string is used
+	config.Set("datastorage", "")
+	return config.WriteConfig()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// subscriptionsBucket holds a nested bucket per discord channel, keyed by eve ID
+var subscriptionsBucket = []byte("subscriptions")
+
+// BoltStore is a SubscriptionStore saved to a BoltDB file
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore opens or creates the BoltDB file at path
+func NewBoltStore(path string) (*BoltStore, error) {
+	// Timeout so a second instance using the same file fails instead of hanging
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the top level bucket
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(subscriptionsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+// Add saves the subscriptions
+func (store *BoltStore) Add(subs ...*subscriptionData) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		for _, subData := range subs {
+			channel, err := tx.Bucket(subscriptionsBucket).CreateBucketIfNotExists([]byte(subData.DiscordChannelID))
+			if err != nil {
+				return err
+			}
+
+			value, err := json.Marshal(subData)
+			if err != nil {
+				return err
+			}
+			err = channel.Put([]byte(strconv.Itoa(subData.EveID)), value)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Remove deletes the channel's subscriptions to the eve IDs
+func (store *BoltStore) Remove(channelID string, eveIDs ...int) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		channel := tx.Bucket(subscriptionsBucket).Bucket([]byte(channelID))
+		if channel == nil {
+			return nil
+		}
+
+		for _, eveID := range eveIDs {
+			err := channel.Delete([]byte(strconv.Itoa(eveID)))
+			if err != nil {
+				return err
+			}
+		}
+
+		// Drop the channel once empty
+		if key, _ := channel.Cursor().First(); key == nil {
+			return tx.Bucket(subscriptionsBucket).DeleteBucket([]byte(channelID))
+		}
+		return nil
+	})
+}
+
+// List returns every saved subscription ordered by channel then eve ID
+func (store *BoltStore) List() ([]*subscriptionData, error) {
+	var subs []*subscriptionData
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(subscriptionsBucket).ForEach(func(channelID, _ []byte) error {
+			return tx.Bucket(subscriptionsBucket).Bucket(channelID).ForEach(func(_, value []byte) error {
+				subData := &subscriptionData{}
+				err := json.Unmarshal(value, subData)
+				if err != nil {
+					return err
+				}
+				subs = append(subs, subData)
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// keys are sorted as strings, sort IDs numerically
+	sortSubscriptions(subs)
+
+	return subs, nil
+}
+
+// Close closes the BoltDB file
+func (store *BoltStore) Close() error {
+	return store.db.Close()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// testSubscriptionStore runs the same add/remove/list checks against any SubscriptionStore
+func testSubscriptionStore(t *testing.T, store SubscriptionStore) {
+	err := store.Add(
+		&subscriptionData{DiscordChannelID: "chan-a", EveID: 100, EveName: "Alpha", MinVal: 10},
+		&subscriptionData{DiscordChannelID: "chan-a", EveID: 20, EveName: "Beta", Direction: directionKills},
+		&subscriptionData{DiscordChannelID: "chan-b", EveID: 100, EveName: "Alpha"},
+	)
+	if err != nil {
+		t.Logf("Failed to add subscriptions: %v", err)
+		t.FailNow()
+	}
+
+	subs, err := store.List()
+	if err != nil || len(subs) != 3 {
+		t.Logf("Expected 3 subscriptions, but got %v, %v", len(subs), err)
+		t.FailNow()
+	}
+	// ordered by channel then numeric eve ID
+	if subs[0].EveID != 20 || subs[0].Direction != directionKills || subs[1].MinVal != 10 || subs[2].DiscordChannelID != "chan-b" {
+		t.Logf("Unexpected subscriptions: %+v, %+v, %+v", subs[0], subs[1], subs[2])
+		t.Fail()
+	}
+
+	// Removing an untracked ID is not an error
+	err = store.Remove("chan-a", 100, 999)
+	if err != nil {
+		t.Logf("Failed to remove subscriptions: %v", err)
+		t.Fail()
+	}
+	err = store.Remove("chan-b", 100)
+	if err != nil {
+		t.Logf("Failed to remove subscriptions: %v", err)
+		t.Fail()
+	}
+
+	subs, _ = store.List()
+	if len(subs) != 1 || subs[0].EveID != 20 {
+		t.Logf("Expected only chan-a's subscription to 20 to remain, but got %v", subs)
+		t.Fail()
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testSubscriptionStore(t, NewMemoryStore())
+}
+
+func TestBoltStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zkillbot")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewBoltStore(filepath.Join(dir, "zkillbot.db"))
+	if err != nil {
+		t.Logf("Failed to open bolt store: %v", err)
+		t.FailNow()
+	}
+	defer store.Close()
+
+	testSubscriptionStore(t, store)
+}
+
+func TestMigrateViperData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zkillbot")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	// Config as written by older versions, note the weakly typed keys
+	configPath := filepath.Join(dir, "zkillbot.json")
+	ioutil.WriteFile(configPath, []byte(`{
+		"discord_bot_token": "secret",
+		"datastorage": {
+			"channelmap": {"chan-a": {"100": {"discord_channel_id": "chan-a", "eve_id": 100, "eve_name": "Alpha", "eve_category": "alliance", "min_val": "5"}}},
+			"submap": {"100": {"chan-a": {"discord_channel_id": "chan-a", "eve_id": 100, "eve_name": "Alpha", "eve_category": "alliance", "min_val": "5"}}}
+		}
+	}`), 0600)
+	config := viper.New()
+	config.SetConfigFile(configPath)
+	config.ReadInConfig()
+
+	store := NewMemoryStore()
+	err = migrateViperData(config, store, log.StandardLogger())
+	if err != nil {
+		t.Logf("Failed to migrate: %v", err)
+		t.FailNow()
+	}
+
+	subs, _ := store.List()
+	if len(subs) != 1 || subs[0].EveName != "Alpha" || subs[0].MinVal != 5 {
+		t.Logf("Expected the single saved subscription to be imported, but got %v", subs)
+		t.Fail()
+	}
+
+	// The old data is cleared while other config is kept
+	config = viper.New()
+	config.SetConfigFile(configPath)
+	config.ReadInConfig()
+	if len(config.GetStringMap("datastorage")) != 0 || config.GetString("discord_bot_token") != "secret" {
+		t.Logf("Expected datastorage to be cleared from the config file")
+		t.Fail()
+	}
+}
@@ -2,11 +2,12 @@ package main
 
 import (
 	"context"
+	"net/http"
 	"sync"
+	"time"
 
 	"github.com/antihax/goesi"
 	"github.com/bwmarrin/discordgo"
-	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
@@ -16,9 +17,15 @@ type ZKillBot struct {
 	// Context
 	ctx context.Context
 
+	// When the bot started, for uptime
+	started time.Time
+
 	// Mux
 	mux sync.Mutex
 
+	// Running goroutines, waited for on shutdown
+	wg sync.WaitGroup
+
 	// Config Management
 	viperConfig *viper.Viper
 
@@ -28,18 +35,40 @@ type ZKillBot struct {
 	// goesi Client
 	esiClient *goesi.APIClient
 
+	// Cached ID -> name lookups
+	names *NameResolver
+
+	// Cached universe data, e.g. ship groups
+	universe *UniverseResolver
+
+	// Kills already sent to each channel
+	seen *KillDeduper
+
+	// Caching http client, used for zKillboard API requests
+	httpClient *http.Client
+
 	// Discord websocket session
 	discord *discordgo.Session
+	// Outgoing discord requests, the discord session outside of tests
+	sender DiscordSender
 
-	// Channels
-	eveIDLookup   chan discordCommand
-	zkillMessage  chan string
-	zkillTracking chan discordCommand
+	// Queued messages to discord channels
+	outbox *Outbox
 
-	// zkillboard websocket
-	zKillboard *websocket.Conn
+	// Discord command routing
+	commands *CommandRouter
+
+	// Who may manage subscriptions
+	permissions *Permissions
+
+	// zKillboard kill feed
+	kills KillSource
+
+	// Kill processing and delivery
+	pool *KillPool
 
 	// Subscription data structures
+	store       SubscriptionStore
 	dataStorage *DataStorage
 }
 
@@ -47,31 +76,32 @@ type ZKillBot struct {
 	passing commands from discord to zkill functions
 */
 type discordCommand struct {
+	GuildID   string
 	ChannelID string
 	Message   string
-}
 
-/*
-	Not sure if this will be a thing yet
-	Potentially store looked up values as a cache, less ESI calls
-*/
-type cacheData struct {
-	IDtoConv []struct {
-		Num12654 struct {
-			Type  string `json:"Type"`
-			Value string `json:"Value"`
-		} `json:"12654"`
-		Num45677 struct {
-			Type  string `json:"Type"`
-			Value string `json:"Value"`
-		} `json:"45677"`
-	} `json:"IDtoConv"`
+	// Set by the CommandRouter, e.g. for "!track list" Prefix is "!", Command is "track" and Args is "list"
+	Prefix  string
+	Command string
+	Args    string
+
+	// Who sent the command, Permissions are the author's permissions in the channel
+	AuthorID    string
+	Roles       []string
+	Permissions int64
+
+	// Slash commands only, the sub-command used and the typed options given to it by name
+	SubCommand string
+	Options    map[string]*discordgo.ApplicationCommandInteractionDataOption
+
+	// Replies go back through the same path the command arrived on
+	commandResponder
 }
 
 // DataStorage is used to store the mapping between discord channels and eveID that we are tracking.
 // We store this index in both channel to eve_id and eve_id to channel
 //
-// This is initially set during bot initiation, then modified by zkillboardAddID and zkillboardRemoveID
+// This is initially loaded from the SubscriptionStore during bot initiation, then modified by zkillboardAddID and zkillboardRemoveID
 type DataStorage struct {
 	// Discord Channel -> Eve ID
 	ChannelMap map[string]map[int]*subscriptionData `mapstructure:"channelmap"`
@@ -84,15 +114,47 @@ type subscriptionData struct {
 	EveName          string `json:"eve_name" mapstructure:"eve_name"`
 	EveCategory      string `json:"eve_category" mapstructure:"eve_category"`
 	MinVal           int    `json:"min_val" mapstructure:"min_val"`
+	Direction        string `json:"direction" mapstructure:"direction"`
+
+	// Optional filters, nil or empty when not set
+	Ships     *shipFilter       `json:"ships,omitempty" mapstructure:"ships"`
+	Location  *locationFilter   `json:"location,omitempty" mapstructure:"location"`
+	Space     []string          `json:"space,omitempty" mapstructure:"space"`
+	Attackers *attackerRange    `json:"attackers,omitempty" mapstructure:"attackers"`
+	NoNPC     bool              `json:"no_npc,omitempty" mapstructure:"no_npc"`
+	Filter    *filterExpression `json:"filter,omitempty" mapstructure:"filter"`
 }
 
+// Subscription directions, an empty direction is treated as directionBoth
+const (
+	directionBoth   = "both"
+	directionKills  = "kills"
+	directionLosses = "losses"
+)
+
 // KillSummary is the format messages from the zkill websocket json payload arrive in.
 type KillSummary struct {
-	Action        string `json:"action"`
-	KillID        int    `json:"killID"`
-	CharacterID   int    `json:"character_id"`
-	CorporationID int    `json:"corporation_id"`
-	AllianceID    int    `json:"alliance_id"`
-	ShipTypeID    int    `json:"ship_type_id"`
-	URL           string `json:"url"`
+	Action        string  `json:"action"`
+	KillID        int     `json:"killID"`
+	CharacterID   int     `json:"character_id"`
+	CorporationID int     `json:"corporation_id"`
+	AllianceID    int     `json:"alliance_id"`
+	ShipTypeID    int     `json:"ship_type_id"`
+	URL           string  `json:"url"`
+	Zkb           ZkbData `json:"zkb"`
+
+	// Backfilled is set for kills missed while the kill feed was down and found afterwards through the zKillboard API
+	Backfilled bool `json:"-"`
+}
+
+// ZkbData is the zKillboard metadata of a kill, it is included in full killstream payloads and zKillboard API responses.
+type ZkbData struct {
+	LocationID  int     `json:"locationID"`
+	Hash        string  `json:"hash"`
+	FittedValue float64 `json:"fittedValue"`
+	TotalValue  float64 `json:"totalValue"`
+	Points      int     `json:"points"`
+	NPC         bool    `json:"npc"`
+	Solo        bool    `json:"solo"`
+	Awox        bool    `json:"awox"`
 }
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/antihax/goesi"
+	"github.com/antihax/goesi/esi"
+)
+
+// universeSystem is where a solar system is and its security space
+type universeSystem struct {
+	ConstellationID int32
+	RegionID        int32
+	Security        float32
+	Space           string
+}
+
+// Security space bands
+const (
+	spaceHighsec  = "highsec"
+	spaceLowsec   = "lowsec"
+	spaceNullsec  = "nullsec"
+	spaceWormhole = "wormhole"
+	spacePochven  = "pochven"
+	spaceAbyssal  = "abyssal"
+)
+
+// Regions outside of known space, J-space and abyssal regions are allocated their own ID ranges
+const (
+	pochvenRegionID  = 10000070
+	wormholeRegionID = 11000000
+	abyssalRegionID  = 12000000
+)
+
+// securitySpace returns the security space band of a solar system
+func securitySpace(regionID int32, security float32) string {
+	switch {
+	case regionID == pochvenRegionID:
+		return spacePochven
+	case regionID >= abyssalRegionID && regionID < abyssalRegionID+1000000:
+		return spaceAbyssal
+	case regionID >= wormholeRegionID && regionID < wormholeRegionID+1000000:
+		return spaceWormhole
+	// Security is shown rounded to one decimal, anything above 0.0 shows as at least 0.1
+	case security >= 0.45:
+		return spaceHighsec
+	case security > 0:
+		return spaceLowsec
+	}
+	return spaceNullsec
+}
+
+// UniverseResolver sits in front of ESI's universe endpoints, caching the static data kills are filtered on
+//
+// Universe data only changes with game patches, so cached entries never expire.
+type UniverseResolver struct {
+	mux sync.Mutex
+	// Type ID -> group ID
+	groups map[int32]int32
+	// Solar system ID -> location, and constellation ID -> region ID
+	systems        map[int32]universeSystem
+	constellations map[int32]int32
+
+	// ESI requests, replaced in tests
+	typeGroup           func(ctx context.Context, typeID int32) (int32, error)
+	system              func(ctx context.Context, systemID int32) (esi.GetUniverseSystemsSystemIdOk, error)
+	constellationRegion func(ctx context.Context, constellationID int32) (int32, error)
+	ids                 func(ctx context.Context, names []string) (esi.PostUniverseIdsOk, error)
+
+	// Lookups answered from the maps and sent to ESI, counted with sync/atomic
+	hits   uint64
+	misses uint64
+}
+
+// NewUniverseResolver creates an empty UniverseResolver using the esiClient
+func NewUniverseResolver(esiClient *goesi.APIClient) *UniverseResolver {
+	resolver := newUniverseResolver()
+	resolver.typeGroup = func(ctx context.Context, typeID int32) (int32, error) {
+		itemType, response, err := esiClient.ESI.UniverseApi.GetUniverseTypesTypeId(ctx, typeID, nil)
+		if err != nil {
+			return 0, err
+		}
+		if response.StatusCode != http.StatusOK {
+			return 0, fmt.Errorf("EVE ESI request failed code: %v", response.StatusCode)
+		}
+		return itemType.GroupId, nil
+	}
+	resolver.system = func(ctx context.Context, systemID int32) (esi.GetUniverseSystemsSystemIdOk, error) {
+		system, response, err := esiClient.ESI.UniverseApi.GetUniverseSystemsSystemId(ctx, systemID, nil)
+		if err != nil {
+			return esi.GetUniverseSystemsSystemIdOk{}, err
+		}
+		if response.StatusCode != http.StatusOK {
+			return esi.GetUniverseSystemsSystemIdOk{}, fmt.Errorf("EVE ESI request failed code: %v", response.StatusCode)
+		}
+		return system, nil
+	}
+	resolver.constellationRegion = func(ctx context.Context, constellationID int32) (int32, error) {
+		constellation, response, err := esiClient.ESI.UniverseApi.GetUniverseConstellationsConstellationId(ctx, constellationID, nil)
+		if err != nil {
+			return 0, err
+		}
+		if response.StatusCode != http.StatusOK {
+			return 0, fmt.Errorf("EVE ESI request failed code: %v", response.StatusCode)
+		}
+		return constellation.RegionId, nil
+	}
+	resolver.ids = func(ctx context.Context, names []string) (esi.PostUniverseIdsOk, error) {
+		IDs, response, err := esiClient.ESI.UniverseApi.PostUniverseIds(ctx, names, nil)
+		if err != nil {
+			return esi.PostUniverseIdsOk{}, err
+		}
+		if response.StatusCode != http.StatusOK {
+			return esi.PostUniverseIdsOk{}, fmt.Errorf("EVE ESI request failed code: %v", response.StatusCode)
+		}
+		return IDs, nil
+	}
+
+	return resolver
+}
+
+// newUniverseResolver creates an empty UniverseResolver without any ESI requests set
+func newUniverseResolver() *UniverseResolver {
+	return &UniverseResolver{
+		groups:         make(map[int32]int32),
+		systems:        make(map[int32]universeSystem),
+		constellations: make(map[int32]int32),
+	}
+}
+
+// TypeGroups returns the group of each type, types ESI failed to return are missing along with the first error
+func (resolver *UniverseResolver) TypeGroups(ctx context.Context, typeIDs []int32) (map[int32]int32, error) {
+	groups := make(map[int32]int32)
+	var missing []int32
+
+	// Check cache
+	resolver.mux.Lock()
+	for _, typeID := range uniqueIDs(typeIDs) {
+		if groupID, ok := resolver.groups[typeID]; ok {
+			groups[typeID] = groupID
+		} else {
+			missing = append(missing, typeID)
+		}
+	}
+	resolver.mux.Unlock()
+	atomic.AddUint64(&resolver.hits, uint64(len(groups)))
+	atomic.AddUint64(&resolver.misses, uint64(len(missing)))
+
+	// ESI only returns one type per request
+	var firstErr error
+	for _, typeID := range missing {
+		groupID, err := resolver.typeGroup(ctx, typeID)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("type %v: %v", typeID, err)
+			}
+			continue
+		}
+
+		resolver.mux.Lock()
+		resolver.groups[typeID] = groupID
+		resolver.mux.Unlock()
+		groups[typeID] = groupID
+	}
+
+	return groups, firstErr
+}
+
+// System returns the constellation, region and security space of a solar system
+func (resolver *UniverseResolver) System(ctx context.Context, systemID int32) (universeSystem, error) {
+	resolver.mux.Lock()
+	system, ok := resolver.systems[systemID]
+	resolver.mux.Unlock()
+	if ok {
+		atomic.AddUint64(&resolver.hits, 1)
+		return system, nil
+	}
+	atomic.AddUint64(&resolver.misses, 1)
+
+	result, err := resolver.system(ctx, systemID)
+	if err != nil {
+		return universeSystem{}, fmt.Errorf("solar system %v: %v", systemID, err)
+	}
+	constellationID := result.ConstellationId
+	system.ConstellationID = constellationID
+	system.Security = result.SecurityStatus
+
+	// Constellations are shared by several systems
+	resolver.mux.Lock()
+	regionID, ok := resolver.constellations[constellationID]
+	resolver.mux.Unlock()
+	if !ok {
+		regionID, err = resolver.constellationRegion(ctx, constellationID)
+		if err != nil {
+			return universeSystem{}, fmt.Errorf("constellation %v: %v", constellationID, err)
+		}
+	}
+	system.RegionID = regionID
+	system.Space = securitySpace(regionID, system.Security)
+
+	resolver.mux.Lock()
+	resolver.constellations[constellationID] = regionID
+	resolver.systems[systemID] = system
+	resolver.mux.Unlock()
+
+	return system, nil
+}
+
+// IDs looks up the IDs of exact names, e.g. ship types or regions. Lookups aren't cached.
+func (resolver *UniverseResolver) IDs(ctx context.Context, names []string) (esi.PostUniverseIdsOk, error) {
+	return resolver.ids(ctx, names)
+}
+
+// Stats returns the number of lookups served from the cache and the number requested from ESI
+func (resolver *UniverseResolver) Stats() (hits uint64, misses uint64) {
+	return atomic.LoadUint64(&resolver.hits), atomic.LoadUint64(&resolver.misses)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestUniverseResolver_TypeGroups(t *testing.T) {
+	var requests []int32
+	resolver := newUniverseResolver()
+	resolver.typeGroup = func(ctx context.Context, typeID int32) (int32, error) {
+		requests = append(requests, typeID)
+		if typeID == 999 {
+			return 0, errors.New("not found")
+		}
+		return typeID / 100, nil
+	}
+
+	groups, err := resolver.TypeGroups(context.Background(), []int32{587, 0, 587, 19720})
+	if err != nil {
+		t.Logf("Lookup failed: %v", err)
+		t.Fail()
+	}
+	if len(groups) != 2 || groups[587] != 5 || groups[19720] != 197 {
+		t.Logf("Unexpected groups: %v", groups)
+		t.Fail()
+	}
+
+	// Cached types aren't requested again, failures are left out
+	groups, err = resolver.TypeGroups(context.Background(), []int32{587, 999})
+	if err == nil {
+		t.Logf("Expected an error for the failed type")
+		t.Fail()
+	}
+	if len(groups) != 1 || groups[587] != 5 {
+		t.Logf("Unexpected groups: %v", groups)
+		t.Fail()
+	}
+	if len(requests) != 3 {
+		t.Logf("Expected 3 requests, got %v", requests)
+		t.Fail()
+	}
+	if hits, misses := resolver.Stats(); hits != 1 || misses != 3 {
+		t.Logf("Expected 1 hit and 3 misses, got %v and %v", hits, misses)
+		t.Fail()
+	}
+}
+
+func TestUniverseResolver_System(t *testing.T) {
+	resolver := fakeUniverse()
+
+	system, err := resolver.System(context.Background(), 30004759)
+	if err != nil || system.ConstellationID != 20000696 || system.RegionID != 10000060 || system.Space != spaceNullsec {
+		t.Logf("Unexpected location %+v: %v", system, err)
+		t.Fail()
+	}
+
+	// Cached after the first lookup
+	resolver.System(context.Background(), 30004759)
+	if hits, misses := resolver.Stats(); hits != 1 || misses != 1 {
+		t.Logf("Expected 1 hit and 1 miss, got %v and %v", hits, misses)
+		t.Fail()
+	}
+
+	_, err = resolver.System(context.Background(), 1)
+	if err == nil {
+		t.Logf("Expected an error for an unknown system")
+		t.Fail()
+	}
+}
+
+func TestSecuritySpace(t *testing.T) {
+	tests := []struct {
+		regionID int32
+		security float32
+		space    string
+	}{
+		{10000002, 0.946, spaceHighsec},
+		{10000002, 0.45, spaceHighsec},
+		{10000002, 0.44, spaceLowsec},
+		{10000002, 0.01, spaceLowsec},
+		{10000060, 0, spaceNullsec},
+		{10000060, -0.38, spaceNullsec},
+		{11000031, -0.99, spaceWormhole},
+		{10000070, -1, spacePochven},
+		{12000004, -1, spaceAbyssal},
+	}
+
+	for _, test := range tests {
+		if space := securitySpace(test.regionID, test.security); space != test.space {
+			t.Logf("Expected %v for region %v security %v, got %v", test.space, test.regionID, test.security, space)
+			t.Fail()
+		}
+	}
+}
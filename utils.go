@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"os"
 
 	"math"
@@ -68,9 +71,58 @@ func loadViperData(data interface{}, log *log.Logger) DataStorage {
 		log.Errorf("Failed to decode previous subscriptions, any new requests will erase the existing config: %v", err)
 	}
 
+	// Nothing saved yet, init empty mappings
+	if dataStorage.SubMap == nil {
+		dataStorage.SubMap = make(map[int]map[string]*subscriptionData, 10)
+	}
+	if dataStorage.ChannelMap == nil {
+		dataStorage.ChannelMap = make(map[string]map[int]*subscriptionData, 10)
+	}
+
 	return dataStorage
 }
 
+// formatISK shortens an ISK value into a human readable string, e.g. 1.25b ISK
+func formatISK(value float64) string {
+	switch {
+	case value >= 1e12:
+		return fmt.Sprintf("%.2ft ISK", value/1e12)
+	case value >= 1e9:
+		return fmt.Sprintf("%.2fb ISK", value/1e9)
+	case value >= 1e6:
+		return fmt.Sprintf("%.2fm ISK", value/1e6)
+	case value >= 1e3:
+		return fmt.Sprintf("%.2fk ISK", value/1e3)
+	default:
+		return fmt.Sprintf("%.2f ISK", value)
+	}
+}
+
+// userAgent identifies the bot in requests to ESI and zKillboard
+const userAgent = "andytsnowden/zkillbot"
+
+// newZKillboardRequest creates a GET request to zKillboard, which asks for a descriptive user agent
+func newZKillboardRequest(ctx context.Context, url string) (*http.Request, error) {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("User-Agent", userAgent)
+
+	return request, nil
+}
+
+// writeFileAtomic writes data to a temp file next to path and renames it over path, so a crash never leaves a half written file
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	err := ioutil.WriteFile(tmpPath, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
 // Backoff is a time.Duration counter. It starts at Min.  After every call to Duration()
 // it is multiplied by Factor.  It is capped at Max. It returns to Min on every call to Reset().
 type Backoff struct {
@@ -153,3 +153,20 @@ func TestBackoff_Reset(t *testing.T) {
 		t.Logf("Backoff duration should be %v, but was %v", testDur, staticDur)
 	}
 }
+
+func TestFormatISK(t *testing.T) {
+	tests := map[float64]string{
+		0:             "0.00 ISK",
+		10000:         "10.00k ISK",
+		1250000:       "1.25m ISK",
+		2500000000:    "2.50b ISK",
+		1100000000000: "1.10t ISK",
+	}
+
+	for value, expected := range tests {
+		if formatISK(value) != expected {
+			t.Logf("ISK value %v should format as %v, but was %v", value, expected, formatISK(value))
+			t.Fail()
+		}
+	}
+}
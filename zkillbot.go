@@ -8,26 +8,21 @@ import (
 	"net/http"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/antihax/goesi"
 	"github.com/bwmarrin/discordgo"
-	"github.com/gorilla/websocket"
 	"github.com/gregjones/httpcache"
 	"github.com/olekukonko/tablewriter"
-	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
 // NewZKillBot is the initialization function of the bot.
 // It reads or creates the configuration file via Viper, setups up channels, and starts logging.
 func NewZKillBot() *ZKillBot {
-	// Command line flags
-	pflag.Bool("verbose", false, "Print logs to command line")
-	pflag.Parse()
-
 	// Config file and locations
 	viper.SetConfigName("zkillbot")
 	viper.SetConfigType("json")
@@ -42,6 +37,29 @@ func NewZKillBot() *ZKillBot {
 	// TODO set this to a reasonable value after testing
 	viper.SetDefault("esi_max_search_requests", 200)
 	viper.SetDefault("esi_max_search_requests_soft", 10)
+	viper.SetDefault("zkillboard_api_url", "https://zkillboard.com/api")
+	viper.SetDefault("zkillboard_ws_url", "wss://zkillboard.com:2096")
+	viper.SetDefault("zkillboard_redisq_url", "https://zkillredisq.stream/listen.php")
+	viper.SetDefault("redisq_queue_id", "")
+	viper.SetDefault("redisq_queue_path", "zkillbot_redisq.json")
+	viper.SetDefault("kill_source", "websocket")
+	viper.SetDefault("redisq_fallback", true)
+	viper.SetDefault("kill_workers", 4)
+	viper.SetDefault("shutdown_timeout", "30s")
+	viper.SetDefault("status_channel", "")
+	viper.SetDefault("discord_queue_size", 50)
+	viper.SetDefault("discord_batch_size", 5)
+	viper.SetDefault("discord_max_retries", 5)
+	viper.SetDefault("database_path", "zkillbot.db")
+	viper.SetDefault("command_prefix", "!")
+	viper.SetDefault("guild_prefixes", map[string]string{})
+	viper.SetDefault("slash_commands", true)
+	viper.SetDefault("track_permissions", map[string]interface{}{})
+	viper.SetDefault("esi_name_cache_ttl", "24h")
+	viper.SetDefault("esi_name_cache_path", "zkillbot_names.json")
+	viper.SetDefault("dedup_window", "1h")
+	viper.SetDefault("dedup_max_kills", 10000)
+	viper.SetDefault("dedup_path", "zkillbot_seen.json")
 
 	// Read in or create then read config
 	err := viper.ReadInConfig()
@@ -60,19 +78,36 @@ func NewZKillBot() *ZKillBot {
 	log := ConfigureLogging(viper.GetViper())
 	log.Debug("Logging initialized")
 
-	// TODO come up with good channel sizes
-	// Init channels
-	eveIDLookupChan := make(chan discordCommand, 5)
-	zkillMessageChan := make(chan string, 5)
-	zkillTrackingChan := make(chan discordCommand, 5)
+	// Open subscription store
+	store, err := NewBoltStore(viper.GetString("database_path"))
+	if err != nil {
+		log.Fatalf("Failed to open subscription database: %v", err)
+	}
+
+	// One time import of subscriptions saved in the config file by older versions
+	err = migrateViperData(viper.GetViper(), store, log)
+	if err != nil {
+		log.Fatalf("Failed to import subscriptions from the config file: %v", err)
+	}
 
 	// Subscription data structures
-	var dataStorage DataStorage
-	dataStorage.SubMap = make(map[int]map[string]*subscriptionData, 10)
-	dataStorage.ChannelMap = make(map[string]map[int]*subscriptionData, 10)
+	dataStorage, err := newDataStorage(store)
+	if err != nil {
+		log.Fatalf("Failed to load subscriptions: %v", err)
+	}
 
-	// Read in dataStorage from viper
-	dataStorage = loadViperData(viper.Get("datastorage"), log)
+	// zKillboard kill feed, subscriptions are sent once it connects
+	kills, err := newKillSource(viper.GetViper(), log)
+	if err != nil {
+		log.Fatalf("Failed to create kill feed: %v", err)
+	}
+	for _, subs := range dataStorage.SubMap {
+		// one subscription per ID however many channels track it
+		for _, subData := range subs {
+			kills.Subscribe(subData.EveCategory, subData.EveID)
+			break
+		}
+	}
 
 	// Init Context, Httpcache and goesi
 	tCache := httpcache.NewMemoryCacheTransport()
@@ -82,22 +117,87 @@ func NewZKillBot() *ZKillBot {
 	httpClient := &http.Client{
 		Transport: tCache,
 	}
-	esiClient := goesi.NewAPIClient(httpClient, "andytsnowden/zkillbot")
+	esiClient := goesi.NewAPIClient(httpClient, userAgent)
+
+	// Cache ID -> name lookups in front of ESI
+	names, err := NewNameResolver(esiClient, viper.GetDuration("esi_name_cache_ttl"), viper.GetString("esi_name_cache_path"))
+	if err != nil {
+		log.Errorf("Failed to load name cache, starting empty: %v", err)
+	}
 
-	// Return setup struct
-	return &ZKillBot{
+	// Cache the universe data kills are filtered on
+	universe := NewUniverseResolver(esiClient)
+
+	// Remember delivered kills, an empty dedup_path keeps them in memory only
+	seen, err := NewKillDeduper(viper.GetDuration("dedup_window"), viper.GetInt("dedup_max_kills"), viper.GetString("dedup_path"))
+	if err != nil {
+		log.Errorf("Failed to load seen kills, starting empty: %v", err)
+	}
+
+	// Setup struct
+	bot := &ZKillBot{
 		ctx:         context.Background(),
+		started:     time.Now(),
 		viperConfig: viper.GetViper(),
 		log:         log,
 
-		eveIDLookup:   eveIDLookupChan,
-		zkillMessage:  zkillMessageChan,
-		zkillTracking: zkillTrackingChan,
+		esiClient:  esiClient,
+		httpClient: httpClient,
+		names:      names,
+		universe:   universe,
+		seen:       seen,
+
+		store:       store,
+		dataStorage: dataStorage,
 
-		esiClient: esiClient,
+		kills: kills,
+	}
 
-		dataStorage: &dataStorage,
+	// Permission rules per guild
+	var permissionRules map[string]permissionRule
+	err = viper.UnmarshalKey("track_permissions", &permissionRules)
+	if err != nil {
+		log.Fatalf("Failed to read track_permissions: %v", err)
 	}
+	bot.permissions = NewPermissions(permissionRules, log)
+
+	// Outbound discord messages
+	bot.outbox = NewOutbox(bot.discordSend, viper.GetInt("discord_queue_size"), viper.GetInt("discord_batch_size"), viper.GetInt("discord_max_retries"), log)
+
+	// Kill processing
+	bot.pool = NewKillPool(viper.GetInt("kill_workers"), bot.routeKill, bot.buildDeliveries, bot.sendKill, log)
+
+	// Commands
+	bot.commands = NewCommandRouter(viper.GetString("command_prefix"), viper.GetStringMapString("guild_prefixes"), log)
+	bot.registerCommands()
+
+	return bot
+}
+
+// registerCommands adds the bot's commands to its CommandRouter
+func (bot *ZKillBot) registerCommands() {
+	bot.commands.Register(&Command{
+		Name:        "lookup",
+		Aliases:     []string{"search"},
+		Args:        "<search>",
+		MinArgs:     1,
+		Description: "Search for alliance, corporation and character IDs by name",
+		Handler:     bot.eveIDLookupCmd,
+	})
+	bot.commands.Register(&Command{
+		Name:        "track",
+		Aliases:     []string{"sub"},
+		Args:        "<sub-command>",
+		MinArgs:     1,
+		Description: "Manage the eve IDs tracked in this channel",
+		Usage:       trackUsage,
+		Handler:     bot.zKillboardTrack,
+	})
+	bot.commands.Register(&Command{
+		Name:        "status",
+		Description: "Show the kill feed's connection status",
+		Handler:     bot.statusCmd,
+	})
 }
 
 // connectDiscord creates a websocket connection to the Discord API given a bot_token
@@ -112,532 +212,961 @@ func (bot *ZKillBot) connectDiscord() {
 	}
 
 	// Start session
-	discord, err := discordgo.New("Bot " + discordToken)
+	discord, err := newDiscordSession(discordToken)
 	if err != nil {
 		log.Fatalf("Failed to start discord session: %v", err)
 	}
 
 	// Pass session into method struct
 	bot.discord = discord
+	bot.sender = discord
 
-	// Register callback for messages
+	// Register callback for messages and slash commands
 	discord.AddHandler(bot.discordReceive)
+	discord.AddHandler(bot.discordInteraction)
 
 	// Open websocket connection and start listening for messages
-	err = discord.Open()
+	err = openDiscordSession(discord, log)
 	if err != nil {
 		log.Fatalf("Failed to start discord websocket session: %v", err)
 	}
+
+	// Text commands remain as a fallback when slash commands are disabled or can't be registered
+	if bot.viperConfig.GetBool("slash_commands") {
+		bot.registerSlashCommands()
+	}
 }
 
-// connectzKillboardWS creates a websocket connection to the zKillboard API
-// This function will attempt to maintain the websocket connection and reconnect if it fails using a backoff
-func (bot *ZKillBot) connectzKillboardWS() {
-	log := bot.log
-	boff := Backoff{
-		Min:    500 * time.Millisecond,
-		Max:    5 * time.Minute,
-		Factor: 2,
-		Jitter: true,
+// discordReceive is a callback function that executes whenever a websocket message is received from Discord
+// Messages are passed to the CommandRouter which queues them for the matching command's processing thread
+func (bot *ZKillBot) discordReceive(s *discordgo.Session, m *discordgo.MessageCreate) {
+	// Ignore my own messages
+	if m.Author.ID == s.State.User.ID {
+		return
+	}
+
+	message := discordCommand{
+		GuildID:   m.GuildID,
+		ChannelID: m.ChannelID,
+		Message:   m.Content,
+		AuthorID:  m.Author.ID,
+
+		commandResponder: &channelResponder{
+			outbox:    bot.outbox,
+			channelID: m.ChannelID,
+		},
 	}
 
-	// Forever keep the connection alive
-	for {
-		conn, _, err := websocket.DefaultDialer.Dial("wss://zkillboard.com:2096", nil)
+	// Roles and permissions are only known for messages sent in a guild
+	if m.Member != nil {
+		message.Roles = m.Member.Roles
 
+		permissions, err := s.State.MessagePermissions(m.Message)
 		if err != nil {
-			dur := boff.Duration()
-			log.Warnf("zkill reconnection %d failed: %s", boff.Attempts(), err)
-			log.Warnln(" -> reconnecting in", dur)
-			time.Sleep(dur)
-			continue
+			// Not everything is in the state cache, ask discord
+			permissions, err = bot.sender.UserChannelPermissions(m.Author.ID, m.ChannelID)
 		}
-		log.Info("Connected to zKillboard Websocket")
-
-		// reset backoff once successfully reconnected
-		boff.Reset()
-
-		bot.mux.Lock()
-		// set conn for everyone
-		if bot.zKillboard != nil {
-			bot.zKillboard.Close()
-			bot.zKillboard = nil
-		}
-		bot.zKillboard = conn
-		bot.mux.Unlock()
-
-		log.Errorf("Connection before resub: %s", bot.zKillboard.UnderlyingConn().LocalAddr().String())
-		// Automatically connect to any saved subscriptions
-		for _, subs := range bot.dataStorage.SubMap {
-			// range over subs
-			for _, subData := range subs {
-				// build sub payload and send
-				subString := []byte(fmt.Sprintf(`{"action":"sub","channel":"%v:%v"}`, subData.EveCategory, subData.EveID))
-				err := conn.WriteMessage(websocket.TextMessage, subString)
-				if err != nil {
-					log.Errorf("Failed to subscribe to killstream: %v", err)
-				} else {
-					log.Debugf("subscribed to killstream for id: %v, name: %v", subData.EveID, subData.EveName)
-				}
-			}
+		if err != nil {
+			bot.log.Warnf("Failed to get permissions of user %v in channel %v: %v", m.Author.ID, m.ChannelID, err)
 		}
+		message.Permissions = permissions
+	}
+
+	bot.commands.Dispatch(message)
+}
 
-		// subscribe to zkillboard's public channel since they don't response to websocket PINGs
-		err = bot.zKillboard.WriteMessage(websocket.TextMessage, []byte(`{"action":"sub","channel":"public"}`))
+// killDelivery is a kill ready to be sent to a discord channel
+type killDelivery struct {
+	ChannelID string
+	KillID    int
+	// Embed is nil when the kill couldn't be enriched, Content is sent instead
+	Embed   *discordgo.MessageEmbed
+	Content string
+}
+
+// routedKill is a kill along with the discord channels tracking an ID involved in it
+type routedKill struct {
+	Kill KillSummary
+	// Enriched is nil when the full killmail couldn't be fetched
+	Enriched *enrichedKill
+	Channels map[string]*killMatch
+}
+
+// routeKill fetches the kill's zkb data and full killmail, and matches everyone involved against the tracked IDs
+func (bot *ZKillBot) routeKill(kill KillSummary) *routedKill {
+	log := bot.log
+
+	// The zkb block holds the kill's value and the hash needed to fetch the full killmail
+	if len(kill.Zkb.Hash) == 0 {
+		zkb, err := bot.zkillboardKillZkb(kill.KillID)
 		if err != nil {
-			log.Errorf("Failed to sub to public status")
-			break
+			// the value is unknown, so channels with a minimum value don't get the kill
+			log.Warnf("Unable to get zkb data of kill %v, dropping it for channels with a minimum value: %v", kill.KillID, err)
+		} else {
+			kill.Zkb = zkb
 		}
+	}
 
-		// Listen for messages
-		for {
-			// set a deadline so ReadMessage will timeout eventually
-			// normally the public channel will send a message every 15 seconds, if not there's a good chance the connection is dead
-			conn.SetReadDeadline(time.Now().Add(time.Second * 30))
-			_, message, err := conn.ReadMessage()
-			if err != nil {
-				// log error and exit for, this will trigger a new connection
-				log.Errorf("Error while reading from WS, reconnecting: %v", err)
-				break
-				// trigger context.cancel to kill keepalive thread
-			} else {
-				// Put message into channel
-				bot.zkillMessage <- string(message)
-			}
-
+	// The summary only holds the victim, the full killmail is needed to match attackers
+	var enriched *enrichedKill
+	if len(kill.Zkb.Hash) != 0 {
+		var err error
+		enriched, err = bot.fetchKillmail(kill)
+		if err != nil {
+			log.Errorf("Failed to fetch killmail %v, only matching the victim: %v", kill.KillID, err)
 		}
+	}
+
+	return bot.matchKill(kill, enriched)
+}
 
-		// Close connection
-		bot.zKillboard.Close()
+// matchKill matches everyone involved in a kill against the tracked IDs, only the victim when enriched is nil
+func (bot *ZKillBot) matchKill(kill KillSummary, enriched *enrichedKill) *routedKill {
+	victimIDs := []int{kill.CharacterID, kill.CorporationID, kill.AllianceID, kill.ShipTypeID}
+	var attackerIDs []int
+	if enriched != nil {
+		victimIDs, attackerIDs = enriched.participants()
 	}
+
+	// Find every channel tracking one of the IDs involved
+	bot.mux.Lock()
+	channels := bot.dataStorage.subscriptionsForKill(victimIDs, attackerIDs)
+	bot.mux.Unlock()
+
+	return &routedKill{Kill: kill, Enriched: enriched, Channels: channels}
 }
 
-// discordReceive is a callback function that executes whenever a websocket message is received from Discord
-// Initial filtering and routing of the commands occurs here. each command will have a unique channel and processing thread
-func (bot ZKillBot) discordReceive(s *discordgo.Session, m *discordgo.MessageCreate) {
-	// Ignore my own messages
-	if m.Author.ID == s.State.User.ID {
-		return
+// buildDeliveries filters a routed kill for each of its channels and builds the message for every channel it passes
+func (bot *ZKillBot) buildDeliveries(routed *routedKill) []killDelivery {
+	log := bot.log
+	kill, enriched := routed.Kill, routed.Enriched
+
+	// The routed channels are left as they are, filtered channels are dropped from a copy
+	channels := make(map[string]*killMatch)
+	for channelID, match := range routed.Channels {
+		channels[channelID] = match
 	}
 
-	// Handle ID Lookup
-	if strings.HasPrefix(m.Content, "!lookup") {
-		// throw into command chan
-		bot.eveIDLookup <- discordCommand{
-			ChannelID: m.ChannelID,
-			Message:   m.Content,
+	// Drop channels whose filters, e.g. minimum value, don't pass the kill, and keep only the passing subscriptions of the others
+	facts := bot.killFacts(kill, enriched, channels)
+	for channelID, match := range channels {
+		passing := match.passing(facts)
+		if passing == nil {
+			log.Debugf("Kill %v filtered out for channel %v", kill.KillID, channelID)
+			delete(channels, channelID)
+			continue
 		}
-		return
+		channels[channelID] = passing
 	}
 
-	// Handle Track
-	if strings.HasPrefix(m.Content, "!track") {
-		// throw into command chan
-		bot.zkillTracking <- discordCommand{
-			ChannelID: m.ChannelID,
-			Message:   m.Content,
+	// Drop channels the kill was already sent to, e.g. received again after a reconnect or from both feeds
+	for channelID := range channels {
+		if !bot.seen.Deliver(kill.KillID, channelID) {
+			log.Debugf("Kill %v already sent to channel %v", kill.KillID, channelID)
+			delete(channels, channelID)
+		}
+	}
+
+	// Nothing to deliver
+	if len(channels) == 0 {
+		return nil
+	}
+
+	// Names are only needed for the embed, falling back to the plain zkillboard url
+	if enriched != nil {
+		err := bot.resolveKillNames(enriched)
+		if err != nil {
+			log.Errorf("Failed to resolve names for kill %v: %v", kill.KillID, err)
+			enriched = nil
 		}
-		return
 	}
 
-	// TODO more commands!
+	var deliveries []killDelivery
+	for channelID, match := range channels {
+		delivery := killDelivery{
+			ChannelID: channelID,
+			KillID:    kill.KillID,
+		}
+		if enriched != nil {
+			delivery.Embed = killEmbed(enriched, match.Loss)
+		} else {
+			delivery.Content = kill.URL
+			if kill.Backfilled {
+				delivery.Content = "Backfilled: " + delivery.Content
+			}
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries
 }
 
-// zKillboardReceive is a work in progress
-//
-// Current we accept messages off the bot.zkillMessage channel and print them directly to a testing discord channel
-func (bot ZKillBot) zKillboardReceive(cContext context.Context) {
+// sendKill queues a kill for its discord channel
+func (bot *ZKillBot) sendKill(delivery killDelivery) {
 	log := bot.log
 
-	log.Debugf("Starting zKillboardReceive thread")
-	for {
-		select {
-		// cancel cleanly
-		case <-cContext.Done():
-			return
-			// on message do work
-		case message := <-bot.zkillMessage:
-			// TODO handle public info and store for later use
-
-			kill := KillSummary{}
-			err := json.Unmarshal([]byte(message), &kill)
-			if err == nil {
-				bot.discord.ChannelMessageSend("482251762863177741", kill.URL)
-			}
+	log.Debugf("Sending kill %v to channel %v", delivery.KillID, delivery.ChannelID)
+	message := outboundMessage{Content: delivery.Content}
+	if delivery.Embed != nil {
+		message = outboundMessage{Embeds: []*discordgo.MessageEmbed{delivery.Embed}}
+	}
 
-			// TODO for each kill we need to iterate over the killed, people who kills and look for a match in a reference map/slice/something
-			// TODO if that matches one of the IDs we're watching it needs to be sent to the correct channel
+	// The kill was marked as seen when it was built, so it may be sent again if this fails
+	message.Dropped = func() {
+		log.Debugf("Kill %v not sent to channel %v, no longer marked as seen", delivery.KillID, delivery.ChannelID)
+		bot.seen.Forget(delivery.KillID, delivery.ChannelID)
+	}
+	bot.outbox.Send(delivery.ChannelID, message)
+}
 
-		default:
-			// don't murder the cpu
-			time.Sleep(500 * time.Nanosecond)
+// killMatch holds the subscriptions of a single channel that matched a kill
+type killMatch struct {
+	Subs []*subscriptionData
+	// Loss is true when one of the channel's tracked IDs is the victim
+	Loss bool
+	// Lost holds the subscriptions matched as the victim
+	Lost map[*subscriptionData]bool
+}
+
+// subscriptionsForKill returns the discord channels that track any of the IDs involved in the kill,
+// along with the matching subscriptions. Each channel is only returned once even if several of its tracked IDs match.
+//
+// Subscriptions only match on the side of the kill their direction asks for, victimIDs for losses and attackerIDs for kills.
+func (dataStorage *DataStorage) subscriptionsForKill(victimIDs []int, attackerIDs []int) map[string]*killMatch {
+	channels := make(map[string]*killMatch)
+
+	add := func(subData *subscriptionData, loss bool) {
+		match, ok := channels[subData.DiscordChannelID]
+		if !ok {
+			match = &killMatch{Lost: make(map[*subscriptionData]bool)}
+			channels[subData.DiscordChannelID] = match
 		}
+		// the same ID may be several attackers
+		for _, existing := range match.Subs {
+			if existing == subData {
+				return
+			}
+		}
+		match.Subs = append(match.Subs, subData)
+		match.Loss = match.Loss || loss
+		match.Lost[subData] = loss
+	}
+
+	for _, eveID := range victimIDs {
+		for _, subData := range dataStorage.SubMap[eveID] {
+			if eveID != 0 && subData.wantsLosses() {
+				add(subData, true)
+			}
+		}
+	}
+	for _, eveID := range attackerIDs {
+		for _, subData := range dataStorage.SubMap[eveID] {
+			if eveID != 0 && subData.wantsKills() {
+				add(subData, false)
+			}
+		}
+	}
+
+	return channels
+}
+
+// directionName returns the subscription's direction, subscriptions saved before directions existed track both
+func (subData *subscriptionData) directionName() string {
+	if len(subData.Direction) == 0 {
+		return directionBoth
 	}
-	log.Debugf("Exited zKillboardReceive thread")
+	return subData.Direction
 }
 
+// wantsKills returns true if the subscription wants kills made by the tracked ID
+func (subData *subscriptionData) wantsKills() bool {
+	return subData.Direction != directionLosses
+}
+
+// wantsLosses returns true if the subscription wants losses suffered by the tracked ID
+func (subData *subscriptionData) wantsLosses() bool {
+	return subData.Direction != directionKills
+}
+
+// addSubscription adds the subscription to both the channel and eve ID mappings.
+// It returns true if no other channel was already tracking the eve ID.
+func (dataStorage *DataStorage) addSubscription(subData *subscriptionData) bool {
+	// init if not existing
+	newSub := len(dataStorage.SubMap[subData.EveID]) == 0
+	if _, ok := dataStorage.SubMap[subData.EveID]; !ok {
+		dataStorage.SubMap[subData.EveID] = map[string]*subscriptionData{}
+	}
+	dataStorage.SubMap[subData.EveID][subData.DiscordChannelID] = subData
+
+	// init if not existing
+	if _, ok := dataStorage.ChannelMap[subData.DiscordChannelID]; !ok {
+		dataStorage.ChannelMap[subData.DiscordChannelID] = map[int]*subscriptionData{}
+	}
+	dataStorage.ChannelMap[subData.DiscordChannelID][subData.EveID] = subData
+
+	return newSub
+}
+
+// removeSubscription removes the channel's subscription to eveID from both mappings.
+// It returns the removed subscription, or nil if the channel was not tracking the ID,
+// and true if no other channel still references the eve ID.
+func (dataStorage *DataStorage) removeSubscription(channelID string, eveID int) (*subscriptionData, bool) {
+	subData, ok := dataStorage.ChannelMap[channelID][eveID]
+	if !ok {
+		return nil, false
+	}
+
+	delete(dataStorage.ChannelMap[channelID], eveID)
+	if len(dataStorage.ChannelMap[channelID]) == 0 {
+		delete(dataStorage.ChannelMap, channelID)
+	}
+
+	delete(dataStorage.SubMap[eveID], channelID)
+	if len(dataStorage.SubMap[eveID]) == 0 {
+		delete(dataStorage.SubMap, eveID)
+		return subData, true
+	}
+
+	return subData, false
+}
+
+// trackUsage is the usage of the track command's sub-commands, each line is prefixed with the command
+const trackUsage = `<eve_id>              - Add a eve ID to tracking
+<eve_id> <min_value>  - Add a eve ID to tracking with a minimum isk filter
+<eve_id> --kills      - Only track kills made by the eve ID, --losses for only losses, --both is the default
+<eve_id> --ships capital,!pod - Only kills involving the ship groups, types or type IDs, excluding losses of those prefixed with !
+<eve_id> --region Delve,Querious - Only kills in the regions, --constellation and --system work the same way
+<eve_id> --space lowsec,nullsec - Only kills in highsec, lowsec, nullsec, wormhole or pochven space
+<eve_id> --attackers 2-10 - Only kills with solo, small (2-10), fleet (11+) or a custom range of attackers, e.g. 5, 2-10 or 10+
+<eve_id> --no-npc     - Ignore kills made only by NPCs
+<eve_id> --filter value > 1b && region == "Delve" - Only kills matching the expression, it must be the last option
+remove <eve_id>       - Remove a eve ID from tracking
+remove                - Removes all ID from tracking
+list                  - List all tracked IDs and their names/types`
+
+// track sub-command patterns, matched against the command's arguments
+var (
+	trackAddID     = regexp.MustCompile(`^(\d+)\s?(\d+)?`)                                                  // <eve_id> | <eve_id> <min_value>
+	trackRemoveID  = regexp.MustCompile(`^remove\s*(\S+)?`)                                                 // remove | remove <eve_id>
+	trackListID    = regexp.MustCompile(`^list.*?`)                                                         // list
+	trackDirection = regexp.MustCompile(`\s--(kills|losses|both)\b`)                                        // --kills | --losses | --both
+	trackShips     = regexp.MustCompile(`\s--ships\s+([^\s,]+(?:\s*,\s*[^\s,]+)*)`)                         // --ships <ship>,<ship>
+	trackSpace     = regexp.MustCompile(`\s--space\s+([^\s,]+(?:\s*,\s*[^\s,]+)*)`)                         // --space <band>,<band>
+	trackAttackers = regexp.MustCompile(`\s--attackers\s+(\S+)`)                                            // --attackers solo | small | fleet | <min>-<max> | <min>+
+	trackNoNPC     = regexp.MustCompile(`\s--no-npc\b`)                                                     // --no-npc
+	trackLocation  = regexp.MustCompile(`\s--(region|constellation|system)\s+([^\s,]+(?:\s*,\s*[^\s,]+)*)`) // --region <region>,<region> | --constellation ... | --system ...
+	trackFilter    = regexp.MustCompile(`(?s)\s--filter\s+(.*)$`)                                           // --filter <expression>
+)
+
 // zKillboardTrack handles subscription requests from discord commands
 //
-// We accept commands !track <eve_id> <min_value> and !track remove <eve_id> as commands here
-// If no sub-command is provided a contextual help will be returned TODO
-func (bot *ZKillBot) zKillboardTrack(cContext context.Context) {
+// We accept commands !track <eve_id> <min_value> [--kills|--losses|--both] [--ships <ships>] [--region|--constellation|--system <locations>] [--space <bands>] [--attackers <range>] [--no-npc] [--filter <expression>] and !track remove <eve_id> as commands here
+// If no sub-command is provided a contextual help will be returned
+func (bot *ZKillBot) zKillboardTrack(message discordCommand) {
 	log := bot.log
-	discord := bot.discord
-
-	help := `Valid commands:
-!track <eve_id>              - Add a eve ID to tracking
-!track <eve_id> <min_value>  - Add a eve ID to tracking with a minimum isk filter
-!track remove <eve_id>       - Remove a eve ID from tracking
-!track remove                - Removes all ID from tracking
-!track list                  - List all tracked IDs and their names/types`
-
-	// sub-command patterns
-	addID := regexp.MustCompile(`!track\s(?P<first_char>\d+)\s?(\d+)?`) // !track <eve_id> | !track <eve_id> <min_value>
-	removeID := regexp.MustCompile(`!track\sremove\s?(\d+)?`)           // !track remove | !track remove <eve_id)
-	listID := regexp.MustCompile(`!track\slist.*?`)                     // !track list
-
-	log.Debugf("Starting zKillboardTrack thread")
-	for {
-		select {
-		// cancel cleanly
-		case <-cContext.Done():
-			return
-			// on message do work
-		case message := <-bot.zkillTracking:
-			// switch over sub-commands
-			switch {
-			case addID.MatchString(message.Message):
-				log.Info("Add ID sub-command")
-
-				// Pull out ID and optionally min filter value
-				id, err := strconv.Atoi(addID.FindAllStringSubmatch(message.Message, -1)[0][1]) // This is the first capture group from the first match and converts to int
-				if err != nil {
-					discord.ChannelMessageSend(message.ChannelID, "ID to add must be numeric")
-					break
-				}
-				minVal, err := strconv.Atoi(addID.FindAllStringSubmatch(message.Message, -1)[0][2]) // This is the second capture group from the first match and converts to int
-				if err != nil {
-					// on fail we just default to 0
-					minVal = 0
-				}
-
-				// Handle Add Request
-				bot.zkillboardAddID(message.ChannelID, id, minVal)
-				break
-
-			case removeID.MatchString(message.Message):
-				log.Info("Remove sub-command")
-
-				// Pull out ID and optionally min filter value
-				id, err := strconv.Atoi(addID.FindAllStringSubmatch(message.Message, -1)[0][1]) // This is the first capture group from the first match and converts to int
-				if err != nil {
-					discord.ChannelMessageSend(message.ChannelID, "ID to add must be numeric")
-					break
-				}
-
-				// Handle Remove Request
-				bot.zkillboardRemoveID(message.ChannelID, id)
-				break
-
-			case listID.MatchString(message.Message):
-				log.Info("List sub-command")
-
-				// Handle List Request
-				bot.zkillboardListIDs(message.ChannelID)
-				break
-
-			default:
-				log.Debugf("Invalid !track sub-command")
-				// ``` wrapper tells discord to use a code block
-				discord.ChannelMessageSend(message.ChannelID, "Invalid !track command, ```"+help+"```")
-				break
-			}
-		default:
-			// don't murder the cpu
-			time.Sleep(500 * time.Nanosecond)
+
+	// Slash commands have typed options rather than text to match
+	if len(message.SubCommand) > 0 {
+		bot.slashTrack(message)
+		return
+	}
+
+	// switch over sub-commands
+	switch {
+	case trackAddID.MatchString(message.Args):
+		log.Info("Add ID sub-command")
+		if !bot.permissions.RequireManage(message) {
+			break
 		}
+
+		// Pull out ID and optionally min filter value
+		id, err := strconv.Atoi(trackAddID.FindAllStringSubmatch(message.Args, -1)[0][1]) // This is the first capture group from the first match and converts to int
+		if err != nil {
+			message.ReplyError("ID to add must be numeric")
+			break
+		}
+		minVal, err := strconv.Atoi(trackAddID.FindAllStringSubmatch(message.Args, -1)[0][2]) // This is the second capture group from the first match and converts to int
+		if err != nil {
+			// on fail we just default to 0
+			minVal = 0
+		}
+
+		// Direction defaults to both
+		subData := &subscriptionData{
+			EveID:     id,
+			MinVal:    minVal,
+			Direction: directionBoth,
+		}
+
+		// Optional direction and filters
+		err = bot.parseTrackFilters(message.Args, subData)
+		if err != nil {
+			log.Errorf("Invalid filter in %q: %v", message.Args, err)
+			message.ReplyError(err.Error())
+			break
+		}
+
+		// Handle Add Request
+		bot.zkillboardAddID(message, subData)
+		break
+
+	case trackRemoveID.MatchString(message.Args):
+		log.Info("Remove sub-command")
+		if !bot.permissions.RequireManage(message) {
+			break
+		}
+
+		// Pull out the optional ID, without one every ID is removed
+		idStr := trackRemoveID.FindAllStringSubmatch(message.Args, -1)[0][1] // This is the first capture group from the first match
+		if len(idStr) == 0 {
+			// Handle Remove All Request
+			bot.zkillboardRemoveAllIDs(message)
+			break
+		}
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			message.ReplyError("ID to remove must be numeric")
+			break
+		}
+
+		// Handle Remove Request
+		bot.zkillboardRemoveID(message, id)
+		break
+
+	case trackListID.MatchString(message.Args):
+		log.Info("List sub-command")
+
+		// Handle List Request
+		bot.zkillboardListIDs(message)
+		break
+
+	default:
+		log.Debugf("Invalid track sub-command")
+		// ``` wrapper tells discord to use a code block
+		message.ReplyError("Invalid " + message.Prefix + message.Command + " command, ```" + bot.commands.usage(message.Prefix, "track") + "```")
+		break
 	}
-	log.Debugf("Exited zKillboardTrack thread")
+}
+
+// parseTrackFilters sets the optional direction and filters given to !track <eve_id> on subData
+func (bot *ZKillBot) parseTrackFilters(args string, subData *subscriptionData) error {
+	// The expression runs to the end of the arguments, it is cut off first so nothing in it is taken for an option
+	expression := trackFilter.FindStringSubmatchIndex(args)
+	filter := ""
+	if expression != nil {
+		args, filter = args[:expression[0]], args[expression[2]:expression[3]]
+	}
+
+	if match := trackDirection.FindStringSubmatch(args); match != nil {
+		subData.Direction = match[1]
+	}
+
+	if match := trackShips.FindStringSubmatch(args); match != nil {
+		err := bot.setTrackFilter(subData, "ships", match[1])
+		if err != nil {
+			return err
+		}
+	}
+	if match := trackSpace.FindStringSubmatch(args); match != nil {
+		err := bot.setTrackFilter(subData, "space", match[1])
+		if err != nil {
+			return err
+		}
+	}
+	if match := trackAttackers.FindStringSubmatch(args); match != nil {
+		err := bot.setTrackFilter(subData, "attackers", match[1])
+		if err != nil {
+			return err
+		}
+	}
+	subData.NoNPC = trackNoNPC.MatchString(args)
+
+	// Kills in any of the regions, constellations and systems given pass
+	for _, match := range trackLocation.FindAllStringSubmatch(args, -1) {
+		err := bot.setTrackFilter(subData, match[1], match[2])
+		if err != nil {
+			return err
+		}
+	}
+
+	if expression != nil {
+		return bot.setTrackFilter(subData, "filter", filter)
+	}
+	return nil
+}
+
+// setTrackFilter parses the value given to one of the filter options of !track <eve_id> and sets the filter on subData
+func (bot *ZKillBot) setTrackFilter(subData *subscriptionData, option string, value string) error {
+	switch option {
+	case "filter":
+		filter, err := bot.parseFilterExpression(value)
+		if err != nil {
+			return fmt.Errorf("Invalid --filter: %v", err)
+		}
+		subData.Filter = filter
+
+	case "ships":
+		ships, err := bot.parseShipFilter(value)
+		if err != nil {
+			return fmt.Errorf("Invalid --ships filter: %v", err)
+		}
+		subData.Ships = ships
+
+	case "space":
+		space, err := parseSpace(value)
+		if err != nil {
+			return fmt.Errorf("Invalid --space filter: %v", err)
+		}
+		subData.Space = space
+
+	case "attackers":
+		attackers, err := parseAttackerRange(value)
+		if err != nil {
+			return fmt.Errorf("Invalid --attackers filter: %v", err)
+		}
+		subData.Attackers = attackers
+
+	case locationRegion, locationConstellation, locationSystem:
+		if subData.Location == nil {
+			subData.Location = &locationFilter{}
+		}
+		err := bot.parseLocations(subData.Location, option, value)
+		if err != nil {
+			return fmt.Errorf("Invalid --%v filter: %v", option, err)
+		}
+
+	default:
+		return fmt.Errorf("Unknown filter %v", option)
+	}
+
+	return nil
 }
 
 // zkillboardAddID handles adding the requested ID to the mapping struct and sending the subscription command to the zkillboard websocket.
-func (bot *ZKillBot) zkillboardAddID(channelID string, eveID int, minVal int) {
+// subData holds the eve ID and filters, the channel and the ID's name are filled in here.
+func (bot *ZKillBot) zkillboardAddID(message discordCommand, subData *subscriptionData) {
 	log := bot.log
-	discord := bot.discord
-	esiClient := bot.esiClient
+	channelID := message.ChannelID
+	eveID := subData.EveID
 
 	// Test if exists first
-	if _, ok := bot.dataStorage.SubMap[eveID][channelID]; ok {
+	bot.mux.Lock()
+	_, exists := bot.dataStorage.SubMap[eveID][channelID]
+	bot.mux.Unlock()
+	if exists {
 		log.Error("ID already exists for channel")
-		discord.ChannelMessageSend(channelID, fmt.Sprintf("EVE ID: %v has already been added for this channel", eveID))
+		message.ReplyError(fmt.Sprintf("EVE ID: %v has already been added for this channel", eveID))
 		return
 	}
 
 	// Get Name of Type from eveID
-	eveID32 := []int32{int32(eveID)} // int to single slice of int32
-	search, response, err := esiClient.ESI.UniverseApi.PostUniverseNames(bot.ctx, eveID32, nil)
-	if err != nil || response.StatusCode != 200 {
+	names, err := bot.names.Resolve(bot.ctx, []int32{int32(eveID)})
+	if err != nil {
 		log.Errorf("Failed to perform typeID lookup, err: %v", err)
-		discord.ChannelMessageSend(channelID, "EVE ESI error, unable to find match for ID")
+		message.ReplyError("EVE ESI error, unable to find match for ID")
 		return
 	}
 
-	// We only care about the first result, error if somehow this does not exist
-	if len(search[0].Category) == 0 {
+	// Error if somehow this does not exist
+	name, ok := names[int32(eveID)]
+	if !ok || len(name.Category) == 0 {
 		// TODO better error message
-		log.Errorf("Failed to perform typeID lookup, err: %v", err)
-		discord.ChannelMessageSend(channelID, "EVE ESI error, unable to find match for ID")
+		log.Errorf("Failed to perform typeID lookup, no name returned for %v", eveID)
+		message.ReplyError("EVE ESI error, unable to find match for ID")
 		return
 	}
 
-	// Init and assign data
+	subData.DiscordChannelID = channelID
+	subData.EveName = name.Name
+	subData.EveCategory = name.Category
+
+	// Save then assign data, the store syncs to disk so it's kept out from under the lock kill routing waits on
+	storeErr := bot.store.Add(subData)
+	if storeErr != nil {
+		log.Errorf("Failed to save subscription: %v", storeErr)
+		message.ReplyError("Failed to add ID to channel due to internal error")
+		return
+	}
 	bot.mux.Lock()
-	// init if not existing
-	if _, ok := bot.dataStorage.SubMap[eveID]; !ok {
-		bot.dataStorage.SubMap[eveID] = map[string]*subscriptionData{}
+	newSub := bot.dataStorage.addSubscription(subData)
+	bot.mux.Unlock()
+
+	// Subscribe to channel, only needed if no other channel is already tracking this ID
+	note := ""
+	if newSub {
+		subErr := bot.kills.Subscribe(name.Category, eveID)
+		switch {
+		case subErr == ErrKillSourceQueued:
+			log.Warnf("Subscription to %v queued until the kill feed reconnects", eveID)
+			note = ", the kill feed is currently disconnected so kills will start once it reconnects"
+		case subErr != nil:
+			log.Errorf("Failed to subscribe to killstream: %v", subErr)
+
+			// Roll back so the channel isn't left tracking an ID without kills
+			storeErr = bot.store.Remove(channelID, eveID)
+			if storeErr != nil {
+				log.Errorf("Failed to delete subscription after failing to subscribe: %v", storeErr)
+			}
+			bot.mux.Lock()
+			_, unsub := bot.dataStorage.removeSubscription(channelID, eveID)
+			bot.mux.Unlock()
+
+			// The feed keeps the subscription to replay on reconnect, unless another channel started tracking the ID meanwhile
+			if unsub {
+				bot.zkillboardUnsubscribe(subData)
+			}
+
+			message.ReplyError("Unable to subscribe to killstream due to error")
+			return
+		}
 	}
-	bot.dataStorage.SubMap[eveID] = map[string]*subscriptionData{}
-	bot.dataStorage.SubMap[eveID][channelID] = &subscriptionData{
-		DiscordChannelID: channelID,
-		EveID:            eveID,
-		EveName:          search[0].Name,
-		EveCategory:      search[0].Category,
-		MinVal:           minVal,
+
+	log.Infof("Eve ID: %v added to channel", eveID)
+	filters := ""
+	if len(subData.Space) > 0 {
+		filters += " in " + subData.spaceText()
 	}
+	if text := subData.filterText(); len(text) > 0 {
+		filters += " and " + text
+	}
+	message.Reply(fmt.Sprintf("Eve ID: %v (%v: %v) added to channel tracking %v with minimum value filter of: %v%v%v", eveID, name.Category, name.Name, subData.directionName(), subData.MinVal, filters, note))
+	return
+}
 
-	// init if not existing
-	if _, ok := bot.dataStorage.ChannelMap[channelID]; !ok {
-		bot.dataStorage.ChannelMap[channelID] = map[int]*subscriptionData{}
+// zkillboardRemoveID handles removing a ID from subscription and the internal mapping
+//
+// The zkillboard websocket is only unsubscribed once no other channel shares the subscription
+func (bot *ZKillBot) zkillboardRemoveID(message discordCommand, eveID int) {
+	log := bot.log
+	channelID := message.ChannelID
+
+	// Was it ever tracked?
+	bot.mux.Lock()
+	_, ok := bot.dataStorage.ChannelMap[channelID][eveID]
+	bot.mux.Unlock()
+	if !ok {
+		log.Infof("Remove command for channelID %v fails due to ID %v not being tracked", channelID, eveID)
+		message.ReplyError(fmt.Sprintf("EVE ID: %v is not tracked in this channel", eveID))
+		return
 	}
-	bot.dataStorage.ChannelMap[channelID][eveID] = &subscriptionData{
-		DiscordChannelID: channelID,
-		EveID:            eveID,
-		EveName:          search[0].Name,
-		EveCategory:      search[0].Category,
-		MinVal:           minVal,
+
+	// Delete then remove from both mappings, only the mappings need the lock
+	storeErr := bot.store.Remove(channelID, eveID)
+	if storeErr != nil {
+		log.Errorf("Failed to delete subscription: %v", storeErr)
+		message.ReplyError("Failed to remove ID from channel due to internal error")
+		return
 	}
+	bot.mux.Lock()
+	subData, unsub := bot.dataStorage.removeSubscription(channelID, eveID)
 	bot.mux.Unlock()
+	if subData == nil {
+		// Removed by another command meanwhile
+		message.ReplyError(fmt.Sprintf("EVE ID: %v is not tracked in this channel", eveID))
+		return
+	}
+
+	// Unsubscribe if this was the last channel
+	if unsub {
+		bot.zkillboardUnsubscribe(subData)
+	}
+
+	log.Infof("Eve ID: %v removed from channel", eveID)
+	message.Reply(fmt.Sprintf("Eve ID: %v (%v: %v) removed from channel", eveID, subData.EveCategory, subData.EveName))
+}
 
-	// Write out config
-	bot.viperConfig.Set("dataStorage", &bot.dataStorage)
-	cfgerr := bot.viperConfig.WriteConfig()
-	if cfgerr != nil {
-		log.Errorf("Failed to write config file: %v", cfgerr)
-		discord.ChannelMessageSend(channelID, "Failed to add ID to channel due to internal error")
+// zkillboardRemoveAllIDs handles removing every ID tracked by a channel
+func (bot *ZKillBot) zkillboardRemoveAllIDs(message discordCommand) {
+	log := bot.log
+	channelID := message.ChannelID
+
+	// Does the channel have any IDs being tracked?
+	var eveIDs []int
+	bot.mux.Lock()
+	for eveID := range bot.dataStorage.ChannelMap[channelID] {
+		eveIDs = append(eveIDs, eveID)
+	}
+	bot.mux.Unlock()
+	if len(eveIDs) == 0 {
+		log.Infof("Remove command for channelID %v fails due to no tracked IDs", channelID)
+		message.ReplyError("Channel currently has no tracked ID, use the !track command to add")
 		return
 	}
 
-	// Subscribe to channel
-	log.Errorf("Connection before write: %s", bot.zKillboard.UnderlyingConn().LocalAddr().String())
-	subErr := bot.zKillboard.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"action":"sub","channel":"%v:%v"}`, search[0].Category, eveID)))
-	if subErr != nil {
-		log.Errorf("Failed to subscribe to killstream: %v", subErr)
-		discord.ChannelMessageSend(channelID, "Unable to subscribe to killstream due to error")
+	// Delete all in one transaction then remove from both mappings
+	storeErr := bot.store.Remove(channelID, eveIDs...)
+	if storeErr != nil {
+		log.Errorf("Failed to delete subscriptions: %v", storeErr)
+		message.ReplyError("Failed to remove IDs from channel due to internal error")
 		return
 	}
+	var removed []string
+	var unsubs []*subscriptionData
+	bot.mux.Lock()
+	for _, eveID := range eveIDs {
+		subData, unsub := bot.dataStorage.removeSubscription(channelID, eveID)
+		if subData == nil {
+			// Already gone, e.g. a /track remove ran at the same time
+			continue
+		}
+		removed = append(removed, fmt.Sprintf("%v (%v: %v)", subData.EveID, subData.EveCategory, subData.EveName))
+		if unsub {
+			unsubs = append(unsubs, subData)
+		}
+	}
+	bot.mux.Unlock()
 
-	log.Infof("Eve ID: %v added to channel", eveID)
-	discord.ChannelMessageSend(channelID, fmt.Sprintf("Eve ID: %v (%v: %v) added to channel with minimum value filter of: %v", eveID, search[0].Category, search[0].Name, minVal))
-	return
+	// Unsubscribe anything no longer tracked by any channel
+	for _, subData := range unsubs {
+		bot.zkillboardUnsubscribe(subData)
+	}
+
+	sort.Strings(removed)
+	log.Infof("%v Eve IDs removed from channel %v", len(removed), channelID)
+	message.Reply("Removed from channel: ```" + strings.Join(removed, "\n") + "```")
 }
 
-// zkillboardRemoveID handles removing a ID from subscription and the internal mapping
-func (bot *ZKillBot) zkillboardRemoveID(channelID string, eveID int) {
-	//_ := bot.log
-	//_ := bot.discord
-	//_ := bot.esiClient
-
-	// TODO check if currently subscribed
-	// check if multiple channels share a subscription
-	// - if yes don't unsubscribe but remove sub->channel mapping
-	// - if no unsubscribe and remove mapping
+// zkillboardAPIKill is a kill in zKillboard API responses
+type zkillboardAPIKill struct {
+	KillmailID int     `json:"killmail_id"`
+	Zkb        ZkbData `json:"zkb"`
 }
 
-// zkillboardListIDs lists all ID's currently being tracked for the channel by zkillbot
-func (bot ZKillBot) zkillboardListIDs(channelID string) {
+// zkillboardAPIKills requests a list of kills from the zKillboard API, path is relative to the API url, e.g. killID/72223640/
+func (bot *ZKillBot) zkillboardAPIKills(path string) ([]zkillboardAPIKill, error) {
+	url := fmt.Sprintf("%v/%v", strings.TrimRight(bot.viperConfig.GetString("zkillboard_api_url"), "/"), path)
+
+	request, err := newZKillboardRequest(bot.ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := bot.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	// Handle non-200s
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("zKillboard API request failed code: %v", response.StatusCode)
+	}
+
+	var kills []zkillboardAPIKill
+	err = json.NewDecoder(response.Body).Decode(&kills)
+	if err != nil {
+		return nil, err
+	}
+
+	return kills, nil
+}
+
+// zkillboardKillZkb looks up the zkb block (value, hash, etc) of a kill via the zKillboard API
+func (bot *ZKillBot) zkillboardKillZkb(killID int) (ZkbData, error) {
+	// API returns a list of kills even when asking for a single ID
+	kills, err := bot.zkillboardAPIKills(fmt.Sprintf("killID/%v/", killID))
+	if err != nil {
+		return ZkbData{}, err
+	}
+	if len(kills) == 0 {
+		return ZkbData{}, fmt.Errorf("zKillboard API has no kill with ID %v", killID)
+	}
+
+	return kills[0].Zkb, nil
+}
+
+// zkillboardUnsubscribe stops the kill feed sending kills for a subscription
+func (bot *ZKillBot) zkillboardUnsubscribe(subData *subscriptionData) {
 	log := bot.log
-	discord := bot.discord
 
-	// Does the channel have any IDs being tracked?
-	if len(bot.dataStorage.ChannelMap[channelID]) == 0 {
-		log.Infof("List command for channelID %v fails due to no tracked IDs", channelID)
-		discord.ChannelMessageSend(channelID, "Channel currently has no tracked ID, use the !track command to add")
+	err := bot.kills.Unsubscribe(subData.EveCategory, subData.EveID)
+	if err != nil {
+		log.Errorf("Failed to unsubscribe from killstream: %v", err)
 		return
 	}
+	log.Debugf("unsubscribed from killstream for id: %v, name: %v", subData.EveID, subData.EveName)
+}
 
-	var data [][]string
+// zkillboardListIDs lists all ID's currently being tracked for the channel by zkillbot
+func (bot *ZKillBot) zkillboardListIDs(message discordCommand) {
+	log := bot.log
+	channelID := message.ChannelID
 
-	// Iterate over ids
+	// Build the rows under the lock, kill workers and other commands use the same maps
+	var data [][]string
+	bot.mux.Lock()
 	for _, IDs := range bot.dataStorage.ChannelMap[channelID] {
 		data = append(data, []string{
 			strconv.Itoa(IDs.EveID),
 			strings.Title(IDs.EveCategory),
 			IDs.EveName,
 			strconv.Itoa(IDs.MinVal),
+			IDs.spaceText(),
+			strings.Title(IDs.directionName()),
+			IDs.filterText(),
 		})
 	}
+	bot.mux.Unlock()
+
+	// Does the channel have any IDs being tracked?
+	if len(data) == 0 {
+		log.Infof("List command for channelID %v fails due to no tracked IDs", channelID)
+		message.ReplyError("Channel currently has no tracked ID, use the !track command to add")
+		return
+	}
 
 	// Take data from map to write it into a nice looking spaced table
 	buf := new(bytes.Buffer)
 	table := tablewriter.NewWriter(buf)
-	table.SetHeader([]string{"Eve-ID", "Type", "Name", "Min Amount"})
+	table.SetHeader([]string{"Eve-ID", "Type", "Name", "Min Amount", "Space", "Direction", "Filters"})
 	table.SetBorders(tablewriter.Border{Left: true, Top: false, Right: true, Bottom: false})
 	table.SetCenterSeparator("|")
 	table.AppendBulk(data) // Add Bulk Data
 	table.Render()
 
 	// send to discord as code block
-	discord.ChannelMessageSend(channelID, "```"+buf.String()+"```")
+	message.Reply("```" + buf.String() + "```")
 }
 
 // eveIDLookupCmd handles lookup requests from discord commands
 //
 // Given a string from discord we search the EVE API via ESI and return a limited amount of typed results
-func (bot ZKillBot) eveIDLookupCmd(cContext context.Context) {
+func (bot *ZKillBot) eveIDLookupCmd(message discordCommand) {
 	log := bot.log
 	esiClient := bot.esiClient
-	discord := bot.discord
 	config := bot.viperConfig
 
-	log.Debug("Starting Eve-ID lookup thread")
-	for {
-		select {
-		// cancel cleanly
-		case <-cContext.Done():
-			return
-			// on message do work
-		case message := <-bot.eveIDLookup:
-			log.Debugf("Lookup command received: %v, %v", message.Message, message.ChannelID)
-
-			// Remove command prefix and format request
-			msg := regexp.MustCompile(`!lookup\s`).ReplaceAllString(message.Message, "")
-
-			// ESI requires at least 3 elements to search
-			if len(msg) < 3 {
-				log.Error("search must have at least 3 elements")
-				discord.ChannelMessageSend(message.ChannelID, "Lookup requires at least 3 characters")
-				break
-			}
+	log.Debugf("Lookup command received: %v, %v", message.Message, message.ChannelID)
 
-			// Wildcard search
-			search, response, err := esiClient.ESI.SearchApi.GetSearch(bot.ctx, []string{"alliance", "character", "corporation"}, msg, nil)
+	// Router has already removed the command prefix
+	msg := message.Args
 
-			// Handle Err and non-200s
-			if err != nil || response.StatusCode != http.StatusOK {
-				log.Errorf("EVE ESI request failed code: %v, err: %v", response, err)
-				discord.ChannelMessageSend(message.ChannelID, "EVE ESI error, unable to perform lookup at this time.")
-				break
-			}
+	// ESI requires at least 3 elements to search
+	if len(msg) < 3 {
+		log.Error("search must have at least 3 elements")
+		message.ReplyError("Lookup requires at least 3 characters")
+		return
+	}
 
-			// Add responses and return error if greater than xx, ask for more specific search
-			tLen := len(search.Alliance) + len(search.Corporation) + len(search.Character)
-			if tLen > config.GetInt("esi_max_search_requests") {
-				log.Info("Too many results returned by search")
-				discord.ChannelMessageSend(message.ChannelID, "Too many results returned, please use more specific search phrase")
-				break
-			}
+	// Wildcard search
+	search, response, err := esiClient.ESI.SearchApi.GetSearch(bot.ctx, []string{"alliance", "character", "corporation"}, msg, nil)
 
-			// Merge slices
-			var IDs []int32
-			IDs = append(IDs, search.Alliance...)
-			IDs = append(IDs, search.Corporation...)
-			IDs = append(IDs, search.Character...)
-
-			// Translate IDs to Strings
-			idToStrings, response, err := esiClient.ESI.UniverseApi.PostUniverseNames(bot.ctx, IDs, nil)
-
-			// Handle Err and non-200s
-			if err != nil || response.StatusCode != http.StatusOK {
-				log.Errorf("EVE ESI request failed code: %v, err: %v", response.StatusCode, err)
-				// TODO for 400's we should return a different error message
-				discord.ChannelMessageSend(message.ChannelID, "EVE ESI error, unable to perform lookup at this time.")
-				break
-			}
+	// Handle Err and non-200s, there may be no response when the request failed
+	if err != nil || response == nil || response.StatusCode != http.StatusOK {
+		code := 0
+		if response != nil {
+			code = response.StatusCode
+		}
+		log.Errorf("EVE ESI request failed code: %v, err: %v", code, err)
+		message.ReplyError("EVE ESI error, unable to perform lookup at this time.")
+		return
+	}
 
-			// No results?
-			if len(idToStrings) == 0 {
-				log.Info("No results returned for search query")
-				discord.ChannelMessageSend(message.ChannelID, "No results for lookup query")
-				break
-			}
+	// Add responses and return error if greater than xx, ask for more specific search
+	tLen := len(search.Alliance) + len(search.Corporation) + len(search.Character)
+	if tLen > config.GetInt("esi_max_search_requests") {
+		log.Info("Too many results returned by search")
+		message.ReplyError("Too many results returned, please use more specific search phrase")
+		return
+	}
 
-			// Translate struct return into array of strings for message embed
-			var alliances []string
-			var corporations []string
-			var characters []string
-			// If we exceed the stop cap we drop results, this is due to discord's max message length
-			resCount := 0
-			resMax := viper.GetInt("esi_max_search_requests_soft")
-			// TODO come up with a nicer looking format, perhaps using markdown
-			for _, res := range idToStrings {
-				switch res.Category {
-				case "alliance":
-					if resCount < resMax {
-						alliances = append(alliances, fmt.Sprintf("%v - %v", res.Name, res.Id))
-						resCount++
-					}
-
-				case "corporation":
-					if resCount < resMax {
-						corporations = append(corporations, fmt.Sprintf("%v - %v", res.Name, res.Id))
-						resCount++
-					}
-
-				case "character":
-					if resCount < resMax {
-						characters = append(characters, fmt.Sprintf("%v - %v", res.Name, res.Id))
-						resCount++
-					}
-				}
-			}
+	// Merge slices
+	var IDs []int32
+	IDs = append(IDs, search.Alliance...)
+	IDs = append(IDs, search.Corporation...)
+	IDs = append(IDs, search.Character...)
 
-			// Build embed objects if there are results to return for that type
-			var embedFields []*discordgo.MessageEmbedField
-			if len(alliances) > 0 {
-				embedFields = append(embedFields, &discordgo.MessageEmbedField{
-					Name:   "Alliances",
-					Value:  strings.Join(alliances, "\n"),
-					Inline: false,
-				})
-			}
-			if len(corporations) > 0 {
-				embedFields = append(embedFields, &discordgo.MessageEmbedField{
-					Name:   "Corporations",
-					Value:  strings.Join(corporations, "\n"),
-					Inline: false,
-				})
+	// Translate IDs to Strings
+	idToStrings, err := bot.names.Resolve(bot.ctx, IDs)
+
+	// Handle Err and non-200s
+	if err != nil {
+		log.Errorf("EVE ESI request failed, err: %v", err)
+		// TODO for 400's we should return a different error message
+		message.ReplyError("EVE ESI error, unable to perform lookup at this time.")
+		return
+	}
+
+	// No results?
+	if len(idToStrings) == 0 {
+		log.Info("No results returned for search query")
+		message.ReplyError("No results for lookup query")
+		return
+	}
+
+	// Translate struct return into array of strings for message embed
+	var alliances []string
+	var corporations []string
+	var characters []string
+	// If we exceed the stop cap we drop results, this is due to discord's max message length
+	resCount := 0
+	resMax := viper.GetInt("esi_max_search_requests_soft")
+	// TODO come up with a nicer looking format, perhaps using markdown
+	for _, ID := range IDs {
+		res, ok := idToStrings[ID]
+		if !ok {
+			continue
+		}
+
+		switch res.Category {
+		case "alliance":
+			if resCount < resMax {
+				alliances = append(alliances, fmt.Sprintf("%v - %v", res.Name, ID))
+				resCount++
 			}
-			if len(characters) > 0 {
-				embedFields = append(embedFields, &discordgo.MessageEmbedField{
-					Name:   "Characters",
-					Value:  strings.Join(characters, "\n"),
-					Inline: false,
-				})
+
+		case "corporation":
+			if resCount < resMax {
+				corporations = append(corporations, fmt.Sprintf("%v - %v", res.Name, ID))
+				resCount++
 			}
 
-			// Warn the user if their search result has been limited dur to size
-			desc := ""
-			if resCount >= resMax {
-				desc = fmt.Sprintf("Only %v of the %v results shown, please use a more specific lookup phrase", resCount, len(idToStrings))
+		case "character":
+			if resCount < resMax {
+				characters = append(characters, fmt.Sprintf("%v - %v", res.Name, ID))
+				resCount++
 			}
+		}
+	}
 
-			// Send final message back to discord
-			_, errr := discord.ChannelMessageSendEmbed(message.ChannelID, &discordgo.MessageEmbed{
-				Title:       "Lookup Results",
-				Color:       0x6AA84F,
-				Fields:      embedFields,
-				Description: desc,
-			})
+	// Build embed objects if there are results to return for that type
+	var embedFields []*discordgo.MessageEmbedField
+	if len(alliances) > 0 {
+		embedFields = append(embedFields, &discordgo.MessageEmbedField{
+			Name:   "Alliances",
+			Value:  strings.Join(alliances, "\n"),
+			Inline: false,
+		})
+	}
+	if len(corporations) > 0 {
+		embedFields = append(embedFields, &discordgo.MessageEmbedField{
+			Name:   "Corporations",
+			Value:  strings.Join(corporations, "\n"),
+			Inline: false,
+		})
+	}
+	if len(characters) > 0 {
+		embedFields = append(embedFields, &discordgo.MessageEmbedField{
+			Name:   "Characters",
+			Value:  strings.Join(characters, "\n"),
+			Inline: false,
+		})
+	}
 
-			if errr != nil {
-				log.Errorf("Failed to send discord message: %v", err)
+	// Warn the user if their search result has been limited dur to size
+	desc := ""
+	if resCount >= resMax {
+		desc = fmt.Sprintf("Only %v of the %v results shown, please use a more specific lookup phrase", resCount, len(idToStrings))
+	}
 
-			}
+	// Send final message back to discord
+	err = message.ReplyEmbed(&discordgo.MessageEmbed{
+		Title:       "Lookup Results",
+		Color:       0x6AA84F,
+		Fields:      embedFields,
+		Description: desc,
+	})
 
-		default:
-			// don't murder the cpu
-			time.Sleep(500 * time.Nanosecond)
-		}
+	if err != nil {
+		log.Errorf("Failed to send discord message: %v", err)
 	}
-	log.Debug("Exited Eve-ID lookup thread")
 }
@@ -1,12 +1,62 @@
 package main
 
 import (
+    "context"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "os"
     "testing"
+    "time"
+
+    log "github.com/sirupsen/logrus"
+    "github.com/spf13/viper"
 )
 
+// testBot returns a bot with empty subscriptions and in-memory storage, without discord or a kill feed
+func testBot() *ZKillBot {
+	dataStorage := loadViperData(nil, log.StandardLogger())
+
+	return &ZKillBot{
+		ctx:         context.Background(),
+		started:     time.Now(),
+		viperConfig: viper.New(),
+		log:         log.StandardLogger(),
+		store:       NewMemoryStore(),
+		dataStorage: &dataStorage,
+		permissions: NewPermissions(nil, log.StandardLogger()),
+	}
+}
+
+// inTempDir runs the test from an empty temp dir with a fresh viper, so NewZKillBot's config and state files are written there
+func inTempDir(t *testing.T) func() {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "zkillbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viper.Reset()
+
+	return func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+		viper.Reset()
+	}
+}
+
 func TestNewZKillBot(t *testing.T) {
+    defer inTempDir(t)()
+
     // Init the method
     bot := NewZKillBot()
+    defer bot.store.Close()
 
     // Did viper find any keys
     // Default should always have several
@@ -18,11 +68,17 @@ func TestNewZKillBot(t *testing.T) {
 }
 
 func TestNewZKillBot_connectDiscord(t *testing.T) {
+    defer inTempDir(t)()
+
     // Init the method
     bot := NewZKillBot()
+    defer bot.store.Close()
 
     // Setting the bot_token so discord can connect for the test
     //bot.viperConfig.Set("discord_bot_token", "NDgxNTY1MDU1Nzg4MjUzMjAy.DmRv5g.cvJK0mcPJKzKzJQAmo-weNChRmA")
+    if len(bot.viperConfig.GetString("discord_bot_token")) == 0 {
+        t.Skip("discord_bot_token is not configured, the offline tests use fakeDiscord instead")
+    }
 
     // Connect to discord
     bot.connectDiscord()
@@ -32,4 +88,195 @@ func TestNewZKillBot_connectDiscord(t *testing.T) {
         t.Fail()
     }
 
-}
\ No newline at end of file
+}
+
+func TestDataStorage_subscriptionsForKill(t *testing.T) {
+	dataStorage := DataStorage{
+		SubMap: map[int]map[string]*subscriptionData{
+			// character tracked in two channels
+			100: {"chan-a": {DiscordChannelID: "chan-a", EveID: 100}, "chan-b": {DiscordChannelID: "chan-b", EveID: 100}},
+			// alliance tracked in one of the same channels
+			300: {"chan-a": {DiscordChannelID: "chan-a", EveID: 300}},
+			// unrelated id
+			999: {"chan-c": {DiscordChannelID: "chan-c", EveID: 999}},
+		},
+	}
+
+	channels := dataStorage.subscriptionsForKill([]int{100, 200, 300, 0}, nil)
+
+	// chan-a matches twice but should only be returned once
+	if len(channels) != 2 {
+		t.Logf("Expected 2 channels, but got %v: %v", len(channels), channels)
+		t.Fail()
+	}
+	if match, ok := channels["chan-a"]; !ok || len(match.Subs) != 2 || !match.Loss {
+		t.Logf("Expected 2 matched subscriptions as a loss for chan-a, but got %+v", match)
+		t.Fail()
+	}
+	if _, ok := channels["chan-c"]; ok {
+		t.Logf("Channel chan-c does not track any ID in the kill")
+		t.Fail()
+	}
+}
+
+func TestDataStorage_subscriptionsForKillDirection(t *testing.T) {
+	dataStorage := DataStorage{
+		SubMap: map[int]map[string]*subscriptionData{
+			100: {
+				"chan-kills":  {DiscordChannelID: "chan-kills", EveID: 100, Direction: directionKills},
+				"chan-losses": {DiscordChannelID: "chan-losses", EveID: 100, Direction: directionLosses},
+				"chan-both":   {DiscordChannelID: "chan-both", EveID: 100},
+			},
+		},
+	}
+
+	// 100 is the victim
+	channels := dataStorage.subscriptionsForKill([]int{100}, []int{200, 201})
+	if _, ok := channels["chan-kills"]; ok {
+		t.Logf("Kills only channel should not receive a loss")
+		t.Fail()
+	}
+	if match, ok := channels["chan-losses"]; !ok || !match.Loss {
+		t.Logf("Losses only channel should receive a loss, got %+v", match)
+		t.Fail()
+	}
+	if match, ok := channels["chan-both"]; !ok || !match.Loss {
+		t.Logf("Channel without a direction should receive a loss, got %+v", match)
+		t.Fail()
+	}
+
+	// 100 is one of the attackers, twice over
+	channels = dataStorage.subscriptionsForKill([]int{200}, []int{100, 100})
+	if match, ok := channels["chan-kills"]; !ok || match.Loss || len(match.Subs) != 1 {
+		t.Logf("Kills only channel should receive a single kill, got %+v", match)
+		t.Fail()
+	}
+	if _, ok := channels["chan-losses"]; ok {
+		t.Logf("Losses only channel should not receive a kill")
+		t.Fail()
+	}
+	if match, ok := channels["chan-both"]; !ok || match.Loss {
+		t.Logf("Channel without a direction should receive a kill, got %+v", match)
+		t.Fail()
+	}
+}
+
+func TestPassesMinVal(t *testing.T) {
+	bot := testBot()
+	bot.dataStorage.addSubscription(&subscriptionData{DiscordChannelID: "chan-a", EveID: 100, MinVal: 1000000000})
+	bot.dataStorage.addSubscription(&subscriptionData{DiscordChannelID: "chan-a", EveID: 300, MinVal: 50000000})
+
+	// the alliance subscription allows anything over 50m
+	if routedMatch(bot, KillSummary{CharacterID: 100, AllianceID: 300, Zkb: ZkbData{TotalValue: 60000000}}, nil, "chan-a") == nil {
+		t.Logf("Kill worth 60m should pass a 50m filter")
+		t.Fail()
+	}
+	if routedMatch(bot, KillSummary{CharacterID: 100, AllianceID: 300, Zkb: ZkbData{TotalValue: 10000000}}, nil, "chan-a") != nil {
+		t.Logf("Kill worth 10m should not pass 50m and 1b filters")
+		t.Fail()
+	}
+}
+
+func TestZKillBot_zkillboardKillZkb(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/killID/72223640/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`[{"killmail_id":72223640,"zkb":{"locationID":40009081,"hash":"abc","totalValue":123456789.5,"npc":false}}]`))
+	}))
+	defer server.Close()
+
+	config := viper.New()
+	config.Set("zkillboard_api_url", server.URL+"/api/")
+	bot := &ZKillBot{
+		ctx:         context.Background(),
+		viperConfig: config,
+		log:         log.StandardLogger(),
+		httpClient:  server.Client(),
+	}
+
+	zkb, err := bot.zkillboardKillZkb(72223640)
+	if err != nil {
+		t.Logf("Kill lookup failed: %v", err)
+		t.FailNow()
+	}
+	if zkb.TotalValue != 123456789.5 || zkb.Hash != "abc" {
+		t.Logf("Unexpected zkb data: %+v", zkb)
+		t.Fail()
+	}
+
+	// unknown kills should error
+	_, err = bot.zkillboardKillZkb(1)
+	if err == nil {
+		t.Logf("Kill lookup for unknown ID should fail")
+		t.Fail()
+	}
+}
+
+func TestZKillBot_routeKillUnknownValue(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	bot := testBot()
+	bot.viperConfig.Set("zkillboard_api_url", server.URL+"/api/")
+	bot.httpClient = server.Client()
+	bot.seen, _ = NewKillDeduper(time.Hour, 100, "")
+	bot.dataStorage.addSubscription(&subscriptionData{DiscordChannelID: "chan-a", EveID: 100})
+	bot.dataStorage.addSubscription(&subscriptionData{DiscordChannelID: "chan-b", EveID: 100, MinVal: 1000000000})
+
+	// zKillboard is rate limiting, so the kill's value is unknown
+	deliveries := bot.buildDeliveries(bot.routeKill(KillSummary{KillID: 1, CharacterID: 100, URL: "https://zkillboard.com/kill/1/"}))
+	if len(deliveries) != 1 || deliveries[0].ChannelID != "chan-a" {
+		t.Logf("Expected the kill only for the channel without a minimum value, got %+v", deliveries)
+		t.Fail()
+	}
+}
+
+func TestDataStorage_removeSubscriptionShared(t *testing.T) {
+	dataStorage := loadViperData(nil, log.StandardLogger())
+
+	// two channels share a subscription
+	if !dataStorage.addSubscription(&subscriptionData{DiscordChannelID: "chan-a", EveID: 100}) {
+		t.Logf("First channel to track an ID should create a new subscription")
+		t.Fail()
+	}
+	if dataStorage.addSubscription(&subscriptionData{DiscordChannelID: "chan-b", EveID: 100}) {
+		t.Logf("Second channel to track an ID should reuse the existing subscription")
+		t.Fail()
+	}
+
+	// first removal keeps the websocket subscription alive
+	subData, unsub := dataStorage.removeSubscription("chan-a", 100)
+	if subData == nil || unsub {
+		t.Logf("Removing a shared ID should not unsubscribe, got %v, %v", subData, unsub)
+		t.Fail()
+	}
+	if _, ok := dataStorage.ChannelMap["chan-a"]; ok {
+		t.Logf("Channel with no tracked IDs should be removed from ChannelMap")
+		t.Fail()
+	}
+
+	// last removal unsubscribes
+	subData, unsub = dataStorage.removeSubscription("chan-b", 100)
+	if subData == nil || !unsub {
+		t.Logf("Removing the last reference should unsubscribe, got %v, %v", subData, unsub)
+		t.Fail()
+	}
+	if _, ok := dataStorage.SubMap[100]; ok {
+		t.Logf("ID with no channels should be removed from SubMap")
+		t.Fail()
+	}
+}
+
+func TestDataStorage_removeSubscriptionMissing(t *testing.T) {
+	dataStorage := loadViperData(nil, log.StandardLogger())
+
+	subData, unsub := dataStorage.removeSubscription("chan-a", 100)
+	if subData != nil || unsub {
+		t.Logf("Removing an untracked ID should do nothing, got %v, %v", subData, unsub)
+		t.Fail()
+	}
+}